@@ -0,0 +1,174 @@
+package cf
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Peripli/service-broker-proxy/pkg/platform"
+	"github.com/Peripli/service-manager/pkg/log"
+)
+
+type BrokerDeletionPolicyValue string
+
+// BrokerDeletionPolicy is the handling of the deletion of brokers which still have service instances.
+var BrokerDeletionPolicy = struct {
+	// FAIL is when the deletion fails with a BrokerInUseError.
+	FAIL BrokerDeletionPolicyValue
+	// REVOKE_VISIBILITIES is when the broker is kept, but its plans are made visible to admins only.
+	// The deletion fails with a BrokerInUseError as well.
+	REVOKE_VISIBILITIES BrokerDeletionPolicyValue
+	// FORCE is when the broker is deleted without checking its service instances.
+	FORCE BrokerDeletionPolicyValue
+}{
+	FAIL:                "fail",
+	REVOKE_VISIBILITIES: "revoke_visibilities",
+	FORCE:               "force",
+}
+
+// PlanUsage is the number of service instances of a plan
+type PlanUsage struct {
+	ServiceOfferingName string
+	PlanName            string
+	PlanGUID            string
+	Instances           int
+}
+
+// BrokerInUseError is the error of the deletion of a broker whose plans still have service instances
+type BrokerInUseError struct {
+	BrokerGUID string
+	BrokerName string
+	// PlansInUse are the plans with service instances ordered by service offering and plan name
+	PlansInUse []PlanUsage
+	// VisibilitiesRevoked is set if the plans of the broker are made visible to admins only
+	VisibilitiesRevoked bool
+}
+
+func (e *BrokerInUseError) Error() string {
+	plans := make([]string, 0, len(e.PlansInUse))
+	for _, plan := range e.PlansInUse {
+		plans = append(plans, fmt.Sprintf("service offering %s plan %s (%d instances)",
+			plan.ServiceOfferingName, plan.PlanName, plan.Instances))
+	}
+	message := fmt.Sprintf("service broker with name %s and GUID %s still has service instances of %s",
+		e.BrokerName, e.BrokerGUID, strings.Join(plans, ", "))
+	if e.VisibilitiesRevoked {
+		message += ", the visibilities of its plans are revoked instead"
+	}
+	return message
+}
+
+// checkBrokerInstances applies the broker deletion policy to the broker if its plans still have service instances.
+// It returns a BrokerInUseError if the broker must not be deleted.
+func (pc *PlatformClient) checkBrokerInstances(ctx context.Context, r *platform.DeleteServiceBrokerRequest) error {
+	policy := pc.settings.CF.BrokerDeletionPolicy
+	if policy == BrokerDeletionPolicy.FORCE {
+		return nil
+	}
+
+	plans, plansInUse, err := pc.getBrokerPlansInUse(ctx, r.GUID)
+	if err != nil {
+		return err
+	}
+	if len(plansInUse) == 0 {
+		return nil
+	}
+
+	inUseErr := &BrokerInUseError{
+		BrokerGUID: r.GUID,
+		BrokerName: r.Name,
+		PlansInUse: plansInUse,
+	}
+	if policy != BrokerDeletionPolicy.REVOKE_VISIBILITIES {
+		return inUseErr
+	}
+
+	log.C(ctx).Warnf("Keeping service broker and revoking the visibilities of its plans: %v", inUseErr)
+	for _, plan := range plans {
+		if plan.VisibilityType == VisibilityType.ADMIN || plan.VisibilityType == VisibilityType.SPACE {
+			continue
+		}
+		if err := pc.UpdateServicePlanVisibilityType(ctx, plan.GUID, VisibilityType.ADMIN); err != nil {
+			return fmt.Errorf("could not revoke the visibilities of plan with GUID %s: %v", plan.GUID, err)
+		}
+		pc.planResolver.UpdatePlanVisibilityType(plan.CatalogPlanId, r.Name, VisibilityType.ADMIN)
+	}
+	inUseErr.VisibilitiesRevoked = true
+	return inUseErr
+}
+
+// getBrokerPlansInUse returns the plans of the broker and the number of service instances of the plans which have any
+func (pc *PlatformClient) getBrokerPlansInUse(ctx context.Context, brokerGUID string) ([]ServicePlan, []PlanUsage, error) {
+	serviceOfferings, err := pc.ListServiceOfferingsByQuery(ctx, url.Values{
+		CCQueryParams.PageSize:           []string{strconv.Itoa(pc.settings.CF.PageSize)},
+		CCQueryParams.ServiceBrokerGuids: []string{brokerGUID},
+	})
+	if err != nil || len(serviceOfferings) == 0 {
+		return nil, nil, err
+	}
+
+	serviceOfferingNames := make(map[string]string, len(serviceOfferings))
+	serviceOfferingGUIDs := make([]string, 0, len(serviceOfferings))
+	for _, serviceOffering := range serviceOfferings {
+		serviceOfferingNames[serviceOffering.GUID] = serviceOffering.Name
+		serviceOfferingGUIDs = append(serviceOfferingGUIDs, serviceOffering.GUID)
+	}
+
+	var plans []ServicePlan
+	for _, chunk := range splitStringsIntoChunks(serviceOfferingGUIDs, pc.settings.CF.ChunkSize) {
+		chunkPlans, err := pc.ListServicePlansByQuery(ctx, url.Values{
+			CCQueryParams.PageSize:             []string{strconv.Itoa(pc.settings.CF.PageSize)},
+			CCQueryParams.ServiceOfferingGuids: []string{strings.Join(chunk, ",")},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		plans = append(plans, chunkPlans...)
+	}
+
+	plansByGUID := make(map[string]ServicePlan, len(plans))
+	planGUIDs := make([]string, 0, len(plans))
+	for _, plan := range plans {
+		plansByGUID[plan.GUID] = plan
+		planGUIDs = append(planGUIDs, plan.GUID)
+	}
+
+	instances := make(map[string]int)
+	for _, chunk := range splitStringsIntoChunks(planGUIDs, pc.settings.CF.ChunkSize) {
+		serviceInstances, err := pc.ListServiceInstancesByQuery(ctx, url.Values{
+			CCQueryParams.PageSize:         []string{strconv.Itoa(pc.settings.CF.PageSize)},
+			CCQueryParams.ServicePlanGuids: []string{strings.Join(chunk, ",")},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, serviceInstance := range serviceInstances {
+			instances[serviceInstance.Relationships.ServicePlan.Data.GUID]++
+		}
+	}
+
+	var plansInUse []PlanUsage
+	for planGUID, count := range instances {
+		plan, found := plansByGUID[planGUID]
+		if !found {
+			continue
+		}
+		plansInUse = append(plansInUse, PlanUsage{
+			ServiceOfferingName: serviceOfferingNames[plan.ServiceOfferingGuid],
+			PlanName:            plan.Name,
+			PlanGUID:            plan.GUID,
+			Instances:           count,
+		})
+	}
+	sort.Slice(plansInUse, func(i, j int) bool {
+		if plansInUse[i].ServiceOfferingName != plansInUse[j].ServiceOfferingName {
+			return plansInUse[i].ServiceOfferingName < plansInUse[j].ServiceOfferingName
+		}
+		return plansInUse[i].PlanName < plansInUse[j].PlanName
+	})
+
+	return plans, plansInUse, nil
+}
@@ -0,0 +1,95 @@
+package cf
+
+import (
+	"sync"
+)
+
+// Metadata labels and annotations marking the brokers in CF which are managed by Service Manager
+const (
+	// ManagedBrokerLabel marks the brokers registered by Service Manager
+	ManagedBrokerLabel = "service-manager.peripli.io/managed"
+	// BrokerIDLabel is the ID of the broker in Service Manager
+	BrokerIDLabel = "service-manager.peripli.io/broker-id"
+	// ProxyInstanceLabel is the proxy instance which registered the broker
+	ProxyInstanceLabel = "service-manager.peripli.io/proxy-instance"
+	// ServiceManagerURLAnnotation is the URL of the Service Manager the broker is registered in
+	ServiceManagerURLAnnotation = "service-manager.peripli.io/url"
+)
+
+// brokerMetadata returns the metadata marking a broker as managed for the Service Manager broker with the given ID
+func (pc *PlatformClient) brokerMetadata(brokerID string) *CCMetadata {
+	metadata := &CCMetadata{
+		Labels:      map[string]string{ManagedBrokerLabel: "true"},
+		Annotations: map[string]string{ServiceManagerURLAnnotation: pc.settings.Sm.URL},
+	}
+	if brokerID != "" {
+		metadata.Labels[BrokerIDLabel] = brokerID
+	}
+	if pc.settings.CF.ProxyInstance != "" {
+		metadata.Labels[ProxyInstanceLabel] = pc.settings.CF.ProxyInstance
+	}
+
+	return metadata
+}
+
+// isForeignBroker reports whether the broker is labeled as registered by another proxy instance
+func (pc *PlatformClient) isForeignBroker(broker CCServiceBroker) bool {
+	proxyInstance, found := broker.Metadata.Labels[ProxyInstanceLabel]
+	return found && pc.settings.CF.ProxyInstance != "" && proxyInstance != pc.settings.CF.ProxyInstance
+}
+
+// isManagedBroker reports whether the broker is managed by the proxy, i.e. it is labeled as managed by the
+// proxy or, if it was registered before the brokers were labeled, its URL points to the proxy
+func (pc *PlatformClient) isManagedBroker(broker CCServiceBroker) bool {
+	if pc.isForeignBroker(broker) {
+		return false
+	}
+	return broker.Metadata.Labels[ManagedBrokerLabel] == "true" || pc.isManagedBrokerURL(broker.URL)
+}
+
+// knownBrokers keeps the brokers retrieved from CF by GUID, so that the proxy does not modify brokers
+// which it does not manage
+type knownBrokers struct {
+	mutex   sync.RWMutex
+	brokers map[string]CCServiceBroker
+}
+
+func newKnownBrokers() *knownBrokers {
+	return &knownBrokers{brokers: make(map[string]CCServiceBroker)}
+}
+
+func (kb *knownBrokers) add(brokers ...CCServiceBroker) {
+	kb.mutex.Lock()
+	defer kb.mutex.Unlock()
+
+	for _, broker := range brokers {
+		kb.brokers[broker.GUID] = broker
+	}
+}
+
+func (kb *knownBrokers) remove(brokerGUID string) {
+	kb.mutex.Lock()
+	defer kb.mutex.Unlock()
+
+	delete(kb.brokers, brokerGUID)
+}
+
+// retain removes the brokers whose GUIDs are not in the given set, i.e. which no longer exist in CF
+func (kb *knownBrokers) retain(guids map[string]bool) {
+	kb.mutex.Lock()
+	defer kb.mutex.Unlock()
+
+	for guid := range kb.brokers {
+		if !guids[guid] {
+			delete(kb.brokers, guid)
+		}
+	}
+}
+
+func (kb *knownBrokers) get(brokerGUID string) (CCServiceBroker, bool) {
+	kb.mutex.RLock()
+	defer kb.mutex.RUnlock()
+
+	broker, found := kb.brokers[brokerGUID]
+	return broker, found
+}
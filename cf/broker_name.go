@@ -0,0 +1,64 @@
+package cf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// brokerNamePlaceholder stands for the broker name when the name template is split into prefix and suffix
+const brokerNamePlaceholder = "\x00name\x00"
+
+// brokerNameData is the data the broker name template is executed with
+type brokerNameData struct {
+	// Name is the name of the broker in Service Manager
+	Name string
+	// Env is the configured environment of the proxy
+	Env string
+}
+
+// brokerNamer maps the names of the brokers in Service Manager to the names of their registrations in CF
+// and back. The CF name is the Service Manager name surrounded by the fixed prefix and suffix of the template.
+type brokerNamer struct {
+	prefix string
+	suffix string
+}
+
+// newBrokerNamer creates a broker namer from the given template, which must contain {{.Name}} exactly once.
+// An empty template keeps the names unchanged.
+func newBrokerNamer(nameTemplate, env string) (*brokerNamer, error) {
+	if nameTemplate == "" {
+		return &brokerNamer{}, nil
+	}
+
+	tmpl, err := template.New("broker_name").Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker name template %s: %v", nameTemplate, err)
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, brokerNameData{Name: brokerNamePlaceholder, Env: env}); err != nil {
+		return nil, fmt.Errorf("invalid broker name template %s: %v", nameTemplate, err)
+	}
+
+	parts := strings.Split(buf.String(), brokerNamePlaceholder)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid broker name template %s: it must contain {{.Name}} exactly once", nameTemplate)
+	}
+	return &brokerNamer{prefix: parts[0], suffix: parts[1]}, nil
+}
+
+// platformName returns the name of the registration in CF of the broker with the given Service Manager name
+func (n *brokerNamer) platformName(name string) string {
+	return n.prefix + name + n.suffix
+}
+
+// smName returns the Service Manager name of the broker registered in CF with the given name.
+// It returns false and the name unchanged for names not produced by the template.
+func (n *brokerNamer) smName(platformName string) (string, bool) {
+	if len(platformName) < len(n.prefix)+len(n.suffix) ||
+		!strings.HasPrefix(platformName, n.prefix) || !strings.HasSuffix(platformName, n.suffix) {
+		return platformName, false
+	}
+	return platformName[len(n.prefix) : len(platformName)-len(n.suffix)], true
+}
@@ -2,18 +2,62 @@ package cf
 
 import (
 	"context"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Peripli/service-broker-proxy/pkg/platform"
 	"github.com/Peripli/service-manager/pkg/log"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var _ platform.Caching = &PlatformClient{}
 
-// ResetCache reloads all the data from CF
-func (pc *PlatformClient) ResetCache(ctx context.Context) error {
+const (
+	// cacheRefreshOverlap is subtracted from the time of the last sync when loading the data changed since then.
+	// It compensates the second precision of the timestamps of Cloud Controller and the clock skew between
+	// the proxy and Cloud Controller. Data loaded twice is applied idempotently.
+	cacheRefreshOverlap = time.Minute
+	// guidsPageSize is the page size of the listings of GUIDs detecting deleted data, the maximum allowed by CC
+	guidsPageSize = 5000
+)
+
+// ccGUIDsResponse is the part of a CF CC pagination response needed to list the GUIDs of the resources
+type ccGUIDsResponse struct {
+	Pagination CCPagination `json:"pagination"`
+	Resources  []struct {
+		GUID string `json:"guid"`
+	} `json:"resources"`
+}
+
+// ResetCache refreshes the data from CF. All the data is reloaded on the first call and after
+// CacheRefresh.FullResetInterval, in between only the data changed since the last refresh is loaded.
+func (pc *PlatformClient) ResetCache(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "ResetCache")
+	defer func() { endSpan(span, err) }()
+
+	pc.cacheMutex.Lock()
+	defer pc.cacheMutex.Unlock()
+
+	syncTime := time.Now()
+	lastSync, lastFullSync, lastDeletionCheck := pc.planResolver.SyncTimes()
+	refresh := pc.settings.CF.CacheRefresh
+	if refresh.FullResetInterval <= 0 || lastFullSync.IsZero() || syncTime.Sub(lastFullSync) >= refresh.FullResetInterval {
+		span.SetAttributes(attribute.Bool("cf.cache.incremental", false))
+		return pc.reloadCache(ctx, syncTime)
+	}
+
+	span.SetAttributes(attribute.Bool("cf.cache.incremental", true))
+	checkDeletions := syncTime.Sub(lastDeletionCheck) >= refresh.DeletionCheckInterval
+	return pc.refreshCache(ctx, syncTime, lastSync, checkDeletions)
+}
+
+// reloadCache reloads all the data of the brokers managed by Service Manager from CF
+func (pc *PlatformClient) reloadCache(ctx context.Context, syncTime time.Time) error {
 	logger := log.C(ctx)
 
 	query := url.Values{
@@ -21,41 +65,217 @@ func (pc *PlatformClient) ResetCache(ctx context.Context) error {
 	}
 
 	logger.Info("Loading all service brokers from Cloud Foundry...")
-	var brokers []platform.ServiceBroker
-	brokersResponse, err := pc.ListServiceBrokersByQuery(ctx, query)
+	brokers, unmanagedBrokerGUIDs, err := pc.listManagedBrokers(ctx, query)
 	if err != nil {
 		return err
 	}
-	for _, broker := range brokersResponse {
-		brokers = append(brokers, platform.ServiceBroker{
-			GUID:      broker.GUID,
-			Name:      broker.Name,
-			BrokerURL: broker.URL,
-		})
+	existingBrokerGUIDs := make(map[string]bool, len(brokers)+len(unmanagedBrokerGUIDs))
+	for _, guid := range append(brokerGUIDs(brokers), unmanagedBrokerGUIDs...) {
+		existingBrokerGUIDs[guid] = true
 	}
-	logger.Infof("Loaded %d service brokers from Cloud Foundry", len(brokers))
+	pc.knownBrokers.retain(existingBrokerGUIDs)
+	logger.Infof("Loaded %d service brokers managed by Service Manager from Cloud Foundry", len(brokers))
 
-	logger.Info("Loading all service offerings from Cloud Foundry...")
-	serviceOfferings, err := pc.ListServiceOfferingsByQuery(ctx, query)
+	serviceOfferings, plans, err := pc.listBrokersPlans(ctx, brokerGUIDs(brokers), query)
 	if err != nil {
 		return err
 	}
-	logger.Infof("Loaded %d service offerings from Cloud Foundry", len(serviceOfferings))
 
-	logger.Info("Loading all service plans from Cloud Foundry...")
-	plans, err := pc.ListServicePlansByQuery(ctx, query)
+	pc.planResolver.Reset(ctx, syncTime, brokers, serviceOfferings, plans)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("cf.plans", len(plans)))
+
+	return nil
+}
+
+// refreshCache loads the data changed in CF since the last sync and, if checkDeletions is set,
+// the GUIDs of all the brokers and of the service offerings and plans of the cached brokers to detect the deleted data
+func (pc *PlatformClient) refreshCache(ctx context.Context, syncTime, lastSync time.Time, checkDeletions bool) error {
+	logger := log.C(ctx)
+
+	since := lastSync.Add(-cacheRefreshOverlap).UTC().Format(time.RFC3339)
+	query := url.Values{
+		CCQueryParams.PageSize:        []string{strconv.Itoa(pc.settings.CF.PageSize)},
+		CCQueryParams.UpdatedAtsAfter: []string{since},
+	}
+
+	logger.Infof("Loading service brokers, service offerings and plans updated after %s from Cloud Foundry...", since)
+	var (
+		changes CacheChanges
+		err     error
+	)
+	if changes.Brokers, changes.UnmanagedBrokerGUIDs, err = pc.listManagedBrokers(ctx, query); err != nil {
+		return err
+	}
+
+	// the brokers which became managed or were updated are loaded completely, as their service offerings
+	// and plans were not necessarily updated with them
+	changedGUIDs := make(map[string]bool, len(changes.Brokers)+len(changes.UnmanagedBrokerGUIDs))
+	for _, guid := range append(brokerGUIDs(changes.Brokers), changes.UnmanagedBrokerGUIDs...) {
+		changedGUIDs[guid] = true
+	}
+	if changes.ServiceOfferings, changes.Plans, err = pc.listBrokersPlans(ctx, brokerGUIDs(changes.Brokers), url.Values{
+		CCQueryParams.PageSize: []string{strconv.Itoa(pc.settings.CF.PageSize)},
+	}); err != nil {
+		return err
+	}
+
+	var unchangedGUIDs []string
+	for _, guid := range pc.planResolver.BrokerGUIDs() {
+		if !changedGUIDs[guid] {
+			unchangedGUIDs = append(unchangedGUIDs, guid)
+		}
+	}
+	serviceOfferings, plans, err := pc.listBrokersPlans(ctx, unchangedGUIDs, query)
 	if err != nil {
 		return err
 	}
-	logger.Infof("Loaded %d service plans from Cloud Foundry...", len(plans))
+	changes.ServiceOfferings = append(changes.ServiceOfferings, serviceOfferings...)
+	changes.Plans = append(changes.Plans, plans...)
+	logger.Infof("Loaded %d updated service brokers, %d service brokers no longer managed by Service Manager, "+
+		"%d updated service offerings and %d updated service plans from Cloud Foundry",
+		len(changes.Brokers), len(changes.UnmanagedBrokerGUIDs), len(changes.ServiceOfferings), len(changes.Plans))
 
-	pc.planResolver.Reset(ctx, brokers, serviceOfferings, plans)
+	if checkDeletions {
+		logger.Info("Loading the GUIDs of all service brokers and of the service offerings and plans of the cached service brokers from Cloud Foundry...")
+		changes.ExistingGUIDs = make(map[string]bool)
+		if err := pc.listGUIDs(ctx, "/v3/service_brokers", url.Values{}, changes.ExistingGUIDs); err != nil {
+			return err
+		}
+		cachedGUIDs := append(unchangedGUIDs, brokerGUIDs(changes.Brokers)...)
+		for _, chunk := range splitStringsIntoChunks(cachedGUIDs, pc.settings.CF.ChunkSize) {
+			chunkQuery := url.Values{
+				CCQueryParams.ServiceBrokerGuids: []string{strings.Join(chunk, ",")},
+			}
+			for _, path := range []string{"/v3/service_offerings", "/v3/service_plans"} {
+				if err := pc.listGUIDs(ctx, path, chunkQuery, changes.ExistingGUIDs); err != nil {
+					return err
+				}
+			}
+		}
+		logger.Infof("Loaded %d GUIDs from Cloud Foundry", len(changes.ExistingGUIDs))
+		pc.knownBrokers.retain(changes.ExistingGUIDs)
+	}
+
+	pc.planResolver.Update(ctx, syncTime, changes)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("cf.plans", len(changes.Plans)))
 
 	return nil
 }
 
+// listManagedBrokers lists the brokers matching the query which are managed by Service Manager
+// and the GUIDs of the ones which are not. Brokers not named by the broker name template are not
+// reported to Service Manager, so they are not managed either.
+func (pc *PlatformClient) listManagedBrokers(ctx context.Context, query url.Values) ([]platform.ServiceBroker, []string, error) {
+	brokersResponse, err := pc.ListServiceBrokersByQuery(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	pc.knownBrokers.add(brokersResponse...)
+
+	var (
+		brokers          []platform.ServiceBroker
+		unmanagedBrokers []string
+	)
+	for _, broker := range brokersResponse {
+		name, ok := pc.brokerNamer.smName(broker.Name)
+		if !ok || !pc.isManagedBroker(broker) {
+			unmanagedBrokers = append(unmanagedBrokers, broker.GUID)
+			continue
+		}
+		brokers = append(brokers, platform.ServiceBroker{
+			GUID:      broker.GUID,
+			Name:      name,
+			BrokerURL: broker.URL,
+		})
+	}
+	return brokers, unmanagedBrokers, nil
+}
+
+// listBrokersPlans lists the service offerings and plans matching the query of the brokers with the given GUIDs
+func (pc *PlatformClient) listBrokersPlans(ctx context.Context, brokerGUIDs []string, query url.Values) ([]ServiceOffering, []ServicePlan, error) {
+	logger := log.C(ctx)
+
+	var (
+		serviceOfferings []ServiceOffering
+		plans            []ServicePlan
+	)
+	for _, chunk := range splitStringsIntoChunks(brokerGUIDs, pc.settings.CF.ChunkSize) {
+		chunkQuery := url.Values{
+			CCQueryParams.ServiceBrokerGuids: []string{strings.Join(chunk, ",")},
+		}
+		for param, values := range query {
+			chunkQuery[param] = values
+		}
+
+		logger.Infof("Loading service offerings and plans of %d service brokers from Cloud Foundry...", len(chunk))
+		chunkServiceOfferings, err := pc.ListServiceOfferingsByQuery(ctx, chunkQuery)
+		if err != nil {
+			return nil, nil, err
+		}
+		chunkPlans, err := pc.ListServicePlansByQuery(ctx, chunkQuery)
+		if err != nil {
+			return nil, nil, err
+		}
+		serviceOfferings = append(serviceOfferings, chunkServiceOfferings...)
+		plans = append(plans, chunkPlans...)
+	}
+	logger.Infof("Loaded %d service offerings and %d service plans from Cloud Foundry", len(serviceOfferings), len(plans))
+
+	return serviceOfferings, plans, nil
+}
+
+func brokerGUIDs(brokers []platform.ServiceBroker) []string {
+	guids := make([]string, 0, len(brokers))
+	for _, broker := range brokers {
+		guids = append(guids, broker.GUID)
+	}
+	return guids
+}
+
+// listGUIDs adds the GUIDs of all the resources listed by the given path and matching the query to guids
+func (pc *PlatformClient) listGUIDs(ctx context.Context, path string, query url.Values, guids map[string]bool) error {
+	guidsQuery := url.Values{
+		CCQueryParams.PageSize: []string{strconv.Itoa(guidsPageSize)},
+	}
+	for param, values := range query {
+		guidsQuery[param] = values
+	}
+	requestUrl := path + "?" + guidsQuery.Encode()
+	for {
+		var guidsResponse ccGUIDsResponse
+		request := PlatformClientRequest{
+			CTX:          ctx,
+			URL:          requestUrl,
+			Method:       http.MethodGet,
+			ResponseBody: &guidsResponse,
+		}
+		if _, err := pc.MakeRequest(request); err != nil {
+			return errors.Wrapf(err, "Error requesting the GUIDs of %s", path)
+		}
+
+		for _, resource := range guidsResponse.Resources {
+			guids[resource.GUID] = true
+		}
+
+		requestUrl = guidsResponse.Pagination.Next.Href
+		if requestUrl == "" {
+			return nil
+		}
+	}
+}
+
 // ResetBroker resets the data for the given broker
-func (pc *PlatformClient) ResetBroker(ctx context.Context, broker *platform.ServiceBroker, deleted bool) error {
+func (pc *PlatformClient) ResetBroker(ctx context.Context, broker *platform.ServiceBroker, deleted bool) (err error) {
+	ctx, span := startSpan(ctx, "ResetBroker", trace.WithAttributes(
+		attribute.String("cf.broker.guid", broker.GUID),
+		attribute.Bool("cf.broker.deleted", deleted)))
+	defer func() { endSpan(span, err) }()
+
+	if pc.isDryRun() {
+		// the brokers are not changed in CF in dry-run mode, so their cached plans are still valid
+		return nil
+	}
+
 	if deleted {
 		pc.planResolver.DeleteBroker(broker.Name)
 		return nil
@@ -88,7 +308,7 @@ func (pc *PlatformClient) ResetBroker(ctx context.Context, broker *platform.Serv
 	}
 	logger.Infof("Loaded %d plans from Cloud Foundry", len(plans))
 
-	pc.planResolver.ResetBroker(broker.Name, plans)
+	pc.planResolver.ResetBroker(ctx, *broker, serviceOfferings, plans)
 
 	return nil
 }
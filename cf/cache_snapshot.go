@@ -0,0 +1,168 @@
+package cf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/Peripli/service-broker-proxy/pkg/platform"
+	"github.com/Peripli/service-manager/pkg/log"
+)
+
+// PlanResolverSnapshotVersion is the version of the format of the snapshots, snapshots of other versions are rejected
+const PlanResolverSnapshotVersion = 2
+
+// PlanResolverSnapshot is the state of a PlanResolver persisted to be restored after a restart of the proxy
+type PlanResolverSnapshot struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+
+	LastSync          time.Time `json:"last_sync"`
+	LastFullSync      time.Time `json:"last_full_sync"`
+	LastDeletionCheck time.Time `json:"last_deletion_check"`
+
+	// ProxyInstance, BrokerNameTemplate and BrokerNameEnv are the settings the snapshot was written with.
+	// They determine which brokers are cached, so the snapshot is not restored if they were changed since.
+	ProxyInstance      string `json:"proxy_instance"`
+	BrokerNameTemplate string `json:"broker_name_template"`
+	BrokerNameEnv      string `json:"broker_name_env"`
+
+	Brokers          []platform.ServiceBroker `json:"brokers"`
+	ServiceOfferings []ServiceOffering        `json:"service_offerings"`
+	Plans            []ServicePlan            `json:"plans"`
+}
+
+// SaveSnapshot writes the snapshot to the file with the given path
+func SaveSnapshot(path string, snapshot PlanResolverSnapshot) error {
+	content, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(path, content); err != nil {
+		return fmt.Errorf("could not write cache snapshot file %s: %v", path, err)
+	}
+	return nil
+}
+
+// LoadSnapshot reads the snapshot from the file with the given path. Snapshots which cannot be parsed,
+// have another version or are older than maxAge are rejected. The age is not checked if maxAge is 0.
+// It returns nil if the file does not exist.
+func LoadSnapshot(path string, maxAge time.Duration) (*PlanResolverSnapshot, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read cache snapshot file %s: %v", path, err)
+	}
+
+	var snapshot PlanResolverSnapshot
+	if err := json.Unmarshal(content, &snapshot); err != nil {
+		return nil, fmt.Errorf("cache snapshot file %s is corrupted: %v", path, err)
+	}
+	if snapshot.Version != PlanResolverSnapshotVersion {
+		return nil, fmt.Errorf("cache snapshot file %s has version %d instead of %d",
+			path, snapshot.Version, PlanResolverSnapshotVersion)
+	}
+	if snapshot.CreatedAt.IsZero() || snapshot.LastFullSync.IsZero() {
+		return nil, fmt.Errorf("cache snapshot file %s is corrupted: its timestamps are missing", path)
+	}
+	if age := time.Since(snapshot.CreatedAt); maxAge > 0 && age > maxAge {
+		return nil, fmt.Errorf("cache snapshot file %s is %s old, older than %s", path, age.Round(time.Second), maxAge)
+	}
+	return &snapshot, nil
+}
+
+// RestoreCache loads the cache from the configured snapshot file, so that the plans can be resolved
+// before the data is loaded from CF, and then refreshes the restored cache in the background.
+// Missing, corrupted or too old snapshots and snapshots written with other broker settings are ignored,
+// the cache is then reloaded completely on the first sync.
+func (pc *PlatformClient) RestoreCache(ctx context.Context) {
+	logger := log.C(ctx)
+	config := pc.settings.CF.CacheSnapshot
+	if config.File == "" {
+		return
+	}
+
+	snapshot, err := LoadSnapshot(config.File, config.MaxAge)
+	if err != nil {
+		logger.Warnf("Ignoring cache snapshot: %v", err)
+		return
+	}
+	if snapshot == nil {
+		logger.Infof("No cache snapshot found in %s", config.File)
+		return
+	}
+	if settings := pc.settings.CF; snapshot.ProxyInstance != settings.ProxyInstance ||
+		snapshot.BrokerNameTemplate != settings.BrokerNameTemplate || snapshot.BrokerNameEnv != settings.BrokerNameEnv {
+		logger.Warnf("Ignoring cache snapshot %s: it was written with other proxy_instance or broker name settings",
+			config.File)
+		return
+	}
+
+	pc.planResolver.Restore(ctx, *snapshot)
+	logger.Infof("Restored %d service brokers, %d service offerings and %d service plans from cache snapshot taken at %s",
+		len(snapshot.Brokers), len(snapshot.ServiceOfferings), len(snapshot.Plans), snapshot.CreatedAt)
+
+	go func() {
+		if err := pc.ResetCache(ctx); err != nil {
+			logger.Errorf("Could not refresh the cache restored from the snapshot: %v", err)
+		}
+	}()
+}
+
+// SaveCacheSnapshot writes a snapshot of the cache to the configured snapshot file.
+// Nothing is written if the cache was not loaded yet.
+func (pc *PlatformClient) SaveCacheSnapshot(ctx context.Context) error {
+	config := pc.settings.CF.CacheSnapshot
+	if config.File == "" {
+		return nil
+	}
+
+	snapshot := pc.planResolver.Snapshot()
+	if snapshot.LastFullSync.IsZero() {
+		return nil
+	}
+	snapshot.ProxyInstance = pc.settings.CF.ProxyInstance
+	snapshot.BrokerNameTemplate = pc.settings.CF.BrokerNameTemplate
+	snapshot.BrokerNameEnv = pc.settings.CF.BrokerNameEnv
+	if err := SaveSnapshot(config.File, snapshot); err != nil {
+		return err
+	}
+	log.C(ctx).Debugf("Saved snapshot of %d service plans to %s", len(snapshot.Plans), config.File)
+	return nil
+}
+
+// StartCacheSnapshots writes a snapshot of the cache every CacheSnapshot.Interval
+// and a last one when the context is done. The returned channel is closed after the last snapshot is written.
+func (pc *PlatformClient) StartCacheSnapshots(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	config := pc.settings.CF.CacheSnapshot
+	if config.File == "" || config.Interval <= 0 {
+		close(done)
+		return done
+	}
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				if err := pc.SaveCacheSnapshot(context.Background()); err != nil {
+					log.C(ctx).Errorf("Could not save cache snapshot: %v", err)
+				}
+				return
+			}
+			if err := pc.SaveCacheSnapshot(ctx); err != nil {
+				log.C(ctx).Errorf("Could not save cache snapshot: %v", err)
+			}
+		}
+	}()
+	return done
+}
@@ -0,0 +1,113 @@
+package cf_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Peripli/service-broker-proxy-cf/cf"
+	"github.com/Peripli/service-broker-proxy/pkg/platform"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cache snapshot", func() {
+	var (
+		dir          string
+		snapshotPath string
+		snapshot     cf.PlanResolverSnapshot
+		err          error
+	)
+
+	BeforeEach(func() {
+		dir, err = ioutil.TempDir("", "cache-snapshot")
+		Expect(err).ShouldNot(HaveOccurred())
+		snapshotPath = filepath.Join(dir, "cache", "cache.json")
+
+		syncTime := time.Now().UTC().Truncate(time.Second)
+		snapshot = cf.PlanResolverSnapshot{
+			Version:            cf.PlanResolverSnapshotVersion,
+			CreatedAt:          syncTime,
+			LastSync:           syncTime,
+			LastFullSync:       syncTime,
+			LastDeletionCheck:  syncTime,
+			ProxyInstance:      "proxy-1",
+			BrokerNameTemplate: "sm-{{.Name}}",
+			BrokerNameEnv:      "dev",
+			Brokers:            []platform.ServiceBroker{{GUID: "b1-id", Name: "b1"}},
+			ServiceOfferings:   []cf.ServiceOffering{{GUID: "b1-s1-id", ServiceBrokerGuid: "b1-id"}},
+			Plans: []cf.ServicePlan{
+				{GUID: "b1-s1-p1-id", ServiceOfferingGuid: "b1-s1-id", CatalogPlanId: "s1-p1-cid", VisibilityType: cf.VisibilityType.ADMIN},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	Context("when the snapshot was saved", func() {
+		BeforeEach(func() {
+			Expect(cf.SaveSnapshot(snapshotPath, snapshot)).To(Succeed())
+		})
+
+		It("loads it", func() {
+			loadedSnapshot, err := cf.LoadSnapshot(snapshotPath, time.Hour)
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(loadedSnapshot).To(Equal(&snapshot))
+		})
+	})
+
+	Context("when no snapshot was saved", func() {
+		It("loads no snapshot", func() {
+			loadedSnapshot, err := cf.LoadSnapshot(snapshotPath, time.Hour)
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(loadedSnapshot).To(BeNil())
+		})
+	})
+
+	Context("when the snapshot file is corrupted", func() {
+		It("rejects it", func() {
+			Expect(os.MkdirAll(filepath.Dir(snapshotPath), 0700)).To(Succeed())
+			Expect(ioutil.WriteFile(snapshotPath, []byte(`{"version": 1, "brokers": [`), 0600)).To(Succeed())
+
+			_, err := cf.LoadSnapshot(snapshotPath, time.Hour)
+
+			Expect(err).To(MatchError(ContainSubstring("is corrupted")))
+		})
+	})
+
+	Context("when the snapshot has another version", func() {
+		It("rejects it", func() {
+			snapshot.Version = cf.PlanResolverSnapshotVersion + 1
+			Expect(cf.SaveSnapshot(snapshotPath, snapshot)).To(Succeed())
+
+			_, err := cf.LoadSnapshot(snapshotPath, time.Hour)
+
+			Expect(err).To(MatchError(ContainSubstring("has version")))
+		})
+	})
+
+	Context("when the snapshot is too old", func() {
+		BeforeEach(func() {
+			snapshot.CreatedAt = snapshot.CreatedAt.Add(-2 * time.Hour)
+			Expect(cf.SaveSnapshot(snapshotPath, snapshot)).To(Succeed())
+		})
+
+		It("rejects it", func() {
+			_, err := cf.LoadSnapshot(snapshotPath, time.Hour)
+
+			Expect(err).To(MatchError(ContainSubstring("older than")))
+		})
+
+		It("loads it if the snapshots do not expire", func() {
+			loadedSnapshot, err := cf.LoadSnapshot(snapshotPath, 0)
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(loadedSnapshot).ToNot(BeNil())
+		})
+	})
+})
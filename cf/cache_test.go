@@ -4,9 +4,14 @@ import (
 	"context"
 	"github.com/Peripli/service-broker-proxy-cf/cf/internal"
 	"github.com/Peripli/service-broker-proxy/pkg/platform"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/Peripli/service-broker-proxy-cf/cf"
 	"github.com/Peripli/service-manager/pkg/log"
@@ -121,6 +126,7 @@ var _ = Describe("Cache", func() {
 			broker: cf.CCServiceBroker{
 				GUID: "broker1-guid",
 				Name: "broker1",
+				URL:  smBrokerURL("broker1-id"),
 			},
 			serviceOfferings: []cf.CCServiceOffering{
 				{
@@ -146,8 +152,9 @@ var _ = Describe("Cache", func() {
 			},
 			plans: []cf.CCServicePlan{
 				{
-					GUID: "broker1-service1-plan1-guid",
-					Name: "broker1-service1-plan1",
+					GUID:          "broker1-service1-plan1-guid",
+					Name:          "broker1-service1-plan1",
+					BrokerCatalog: cf.CCBrokerCatalog{ID: "broker1-service1-plan1-catalog-id"},
 					Relationships: cf.CCServicePlanRelationships{
 						ServiceOffering: cf.CCRelationship{
 							Data: cf.CCData{
@@ -157,8 +164,9 @@ var _ = Describe("Cache", func() {
 					},
 				},
 				{
-					GUID: "broker1-service2-plan1-guid",
-					Name: "broker1-service2-plan1",
+					GUID:          "broker1-service2-plan1-guid",
+					Name:          "broker1-service2-plan1",
+					BrokerCatalog: cf.CCBrokerCatalog{ID: "broker1-service2-plan1-catalog-id"},
 					Relationships: cf.CCServicePlanRelationships{
 						ServiceOffering: cf.CCRelationship{
 							Data: cf.CCData{
@@ -173,6 +181,7 @@ var _ = Describe("Cache", func() {
 			broker: cf.CCServiceBroker{
 				GUID: "broker2-guid",
 				Name: "broker2",
+				URL:  smBrokerURL("broker2-id"),
 			},
 			serviceOfferings: []cf.CCServiceOffering{
 				{
@@ -188,8 +197,9 @@ var _ = Describe("Cache", func() {
 			},
 			plans: []cf.CCServicePlan{
 				{
-					GUID: "broker2-service1-plan1-guid",
-					Name: "broker2-service1-plan1",
+					GUID:          "broker2-service1-plan1-guid",
+					Name:          "broker2-service1-plan1",
+					BrokerCatalog: cf.CCBrokerCatalog{ID: "broker2-service1-plan1-catalog-id"},
 					Relationships: cf.CCServicePlanRelationships{
 						ServiceOffering: cf.CCRelationship{
 							Data: cf.CCData{
@@ -199,8 +209,9 @@ var _ = Describe("Cache", func() {
 					},
 				},
 				{
-					GUID: "broker2-service1-plan2-guid",
-					Name: "broker2-service1-plan2",
+					GUID:          "broker2-service1-plan2-guid",
+					Name:          "broker2-service1-plan2",
+					BrokerCatalog: cf.CCBrokerCatalog{ID: "broker2-service1-plan2-catalog-id"},
 					Relationships: cf.CCServicePlanRelationships{
 						ServiceOffering: cf.CCRelationship{
 							Data: cf.CCData{
@@ -256,6 +267,316 @@ var _ = Describe("Cache", func() {
 				"broker2-service1-plan2-guid",
 			}))
 		})
+
+		It("loads only the service offerings and plans of the brokers managed by Service Manager", func() {
+			broker2.broker.URL = "http://example.com"
+			setupCCRoutes(broker1, broker2)
+
+			Expect(client.ResetCache(ctx)).To(Succeed())
+			Expect(getRequestGUIDS(serviceOfferingsRequest, cf.CCQueryParams.ServiceBrokerGuids)).
+				To(ConsistOf([]string{"broker1-guid"}))
+			Expect(getRequestGUIDS(plansRequest, cf.CCQueryParams.ServiceBrokerGuids)).
+				To(ConsistOf([]string{"broker1-guid"}))
+			Expect(getPlanGUIDS()).To(ConsistOf([]string{
+				"broker1-service1-plan1-guid",
+				"broker1-service2-plan1-guid",
+			}))
+		})
+
+		It("does not load service offerings and plans if no broker is managed by Service Manager", func() {
+			broker1.broker.URL = "http://example.com"
+			setupCCRoutes(broker1)
+
+			Expect(client.ResetCache(ctx)).To(Succeed())
+			Expect(brokersRequest).ToNot(BeNil())
+			Expect(serviceOfferingsRequest).To(BeNil())
+			Expect(plansRequest).To(BeNil())
+			Expect(getPlanGUIDS()).To(BeEmpty())
+		})
+	})
+
+	Describe("ResetCache with a broker name template", func() {
+		It("resolves the plans by the Service Manager names of the brokers named by the template", func() {
+			settings := testhelper.CCSettings(ccServer.URL(), 50, 2)
+			settings.CF.BrokerNameTemplate = "sm-{{.Name}}-{{.Env}}"
+			settings.CF.BrokerNameEnv = "dev"
+			client, err = cf.NewClient(settings)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			broker1.broker.Name = "sm-broker1-dev"
+			setupCCRoutes(broker1, broker2)
+
+			Expect(client.ResetCache(ctx)).To(Succeed())
+			Expect(getPlanGUIDS()).To(ConsistOf([]string{
+				"broker1-service1-plan1-guid",
+				"broker1-service2-plan1-guid",
+			}))
+		})
+	})
+
+	Describe("ResetCache with incremental refreshes", func() {
+		var settings *cf.Settings
+
+		BeforeEach(func() {
+			settings = testhelper.CCSettings(ccServer.URL(), 50, 2)
+			settings.CF.CacheRefresh = cf.CacheRefreshConfig{
+				FullResetInterval:     time.Hour,
+				DeletionCheckInterval: time.Hour,
+			}
+		})
+
+		JustBeforeEach(func() {
+			client, err = cf.NewClient(settings)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			setupCCRoutes(broker1)
+			Expect(client.ResetCache(ctx)).To(Succeed())
+			Expect(brokersRequest.URL.Query()).ToNot(HaveKey(cf.CCQueryParams.UpdatedAtsAfter))
+		})
+
+		It("loads only the data updated since the last refresh", func() {
+			setupCCRoutes(broker2)
+			Expect(client.ResetCache(ctx)).To(Succeed())
+
+			for _, req := range []*http.Request{brokersRequest, serviceOfferingsRequest, plansRequest} {
+				Expect(req.URL.Query()).To(HaveKey(cf.CCQueryParams.UpdatedAtsAfter))
+			}
+			Expect(getPlanGUIDS()).To(ConsistOf([]string{
+				"broker1-service1-plan1-guid",
+				"broker1-service2-plan1-guid",
+				"broker2-service1-plan1-guid",
+				"broker2-service1-plan2-guid",
+			}))
+		})
+
+		It("loads all the service offerings and plans of the updated brokers", func() {
+			setupCCRoutes(broker2)
+			Expect(client.ResetCache(ctx)).To(Succeed())
+
+			brokerQueries := map[string]url.Values{}
+			for _, req := range ccServer.ReceivedRequests() {
+				if req.URL.Path == "/v3/service_plans" {
+					brokerQueries[req.URL.Query().Get(cf.CCQueryParams.ServiceBrokerGuids)] = req.URL.Query()
+				}
+			}
+			Expect(brokerQueries).To(HaveKey("broker2-guid"))
+			Expect(brokerQueries["broker2-guid"]).ToNot(HaveKey(cf.CCQueryParams.UpdatedAtsAfter))
+			Expect(brokerQueries).To(HaveKey("broker1-guid"))
+			Expect(brokerQueries["broker1-guid"]).To(HaveKey(cf.CCQueryParams.UpdatedAtsAfter))
+		})
+
+		It("removes the plans removed from the catalogs of the updated brokers", func() {
+			broker1.plans = broker1.plans[:1]
+			setupCCRoutes(broker1)
+			Expect(client.ResetCache(ctx)).To(Succeed())
+
+			Expect(getPlanGUIDS()).To(ConsistOf([]string{
+				"broker1-service1-plan1-guid",
+			}))
+		})
+
+		It("removes the data of the brokers which are no longer managed by Service Manager", func() {
+			broker1.broker.URL = "http://example.com"
+			setupCCRoutes(broker1)
+			Expect(client.ResetCache(ctx)).To(Succeed())
+
+			Expect(getPlanGUIDS()).To(BeEmpty())
+		})
+
+		Context("when the deletions are checked", func() {
+			BeforeEach(func() {
+				settings.CF.CacheRefresh.DeletionCheckInterval = 0
+			})
+
+			It("removes the data deleted in CF", func() {
+				setupCCRoutes(broker2)
+				Expect(client.ResetCache(ctx)).To(Succeed())
+
+				Expect(getPlanGUIDS()).To(ConsistOf([]string{
+					"broker2-service1-plan1-guid",
+					"broker2-service1-plan2-guid",
+				}))
+			})
+
+			It("lists the GUIDs of the service offerings and plans of the cached brokers only", func() {
+				setupCCRoutes(broker2)
+				Expect(client.ResetCache(ctx)).To(Succeed())
+
+				guidsRequests := map[string][]string{}
+				for _, req := range ccServer.ReceivedRequests() {
+					if req.URL.Query().Get(cf.CCQueryParams.PageSize) == "5000" {
+						guidsRequests[req.URL.Path] = strings.Split(req.URL.Query().Get(cf.CCQueryParams.ServiceBrokerGuids), ",")
+					}
+				}
+				Expect(guidsRequests).To(HaveKey("/v3/service_brokers"))
+				Expect(guidsRequests["/v3/service_brokers"]).To(Equal([]string{""}))
+				for _, path := range []string{"/v3/service_offerings", "/v3/service_plans"} {
+					Expect(guidsRequests[path]).To(ConsistOf("broker1-guid", "broker2-guid"))
+				}
+			})
+
+			Context("when a broker is not managed by Service Manager", func() {
+				BeforeEach(func() {
+					settings.CF.BrokerDeletionPolicy = cf.BrokerDeletionPolicy.FORCE
+				})
+
+				It("forgets the brokers deleted in CF", func() {
+					broker1.broker.URL = "http://example.com"
+					setupCCRoutes(broker1)
+					Expect(client.ResetCache(ctx)).To(Succeed())
+					request := &platform.DeleteServiceBrokerRequest{GUID: broker1.broker.GUID, Name: broker1.broker.Name}
+					Expect(client.DeleteBroker(ctx, request)).To(MatchError(ContainSubstring("not managed by Service Manager")))
+
+					setupCCRoutes(broker2)
+					Expect(client.ResetCache(ctx)).To(Succeed())
+					ccServer.RouteToHandler(http.MethodDelete, "/v3/service_brokers/"+broker1.broker.GUID,
+						ghttp.RespondWithJSONEncoded(http.StatusNotFound, cf.CCErrorResponse{Errors: []cf.CCError{{
+							Code: 10010, Title: "CF-ResourceNotFound", Detail: "Service broker not found",
+						}}}))
+
+					err := client.DeleteBroker(ctx, request)
+					Expect(err).To(MatchError(ContainSubstring("Service broker not found")))
+					Expect(err).ToNot(MatchError(ContainSubstring("not managed by Service Manager")))
+				})
+			})
+		})
+
+		Context("when the full reset interval elapsed", func() {
+			BeforeEach(func() {
+				settings.CF.CacheRefresh.FullResetInterval = time.Nanosecond
+			})
+
+			It("reloads all the data", func() {
+				setupCCRoutes(broker2)
+				Expect(client.ResetCache(ctx)).To(Succeed())
+
+				Expect(plansRequest.URL.Query()).ToNot(HaveKey(cf.CCQueryParams.UpdatedAtsAfter))
+				Expect(getPlanGUIDS()).To(ConsistOf([]string{
+					"broker2-service1-plan1-guid",
+					"broker2-service1-plan2-guid",
+				}))
+			})
+		})
+	})
+
+	Describe("RestoreCache", func() {
+		var dir string
+
+		snapshotSettings := func() *cf.Settings {
+			settings := testhelper.CCSettings(ccServer.URL(), 50, 2)
+			settings.CF.CacheRefresh.FullResetInterval = time.Hour
+			settings.CF.CacheSnapshot = cf.CacheSnapshotConfig{
+				File:     filepath.Join(dir, "cache.json"),
+				Interval: time.Minute,
+				MaxAge:   time.Hour,
+			}
+			return settings
+		}
+
+		BeforeEach(func() {
+			dir, err = ioutil.TempDir("", "cache-snapshot")
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("restores the cache from the snapshot and refreshes it in the background", func() {
+			client, err = cf.NewClient(snapshotSettings())
+			Expect(err).ShouldNot(HaveOccurred())
+			setupCCRoutes(broker1)
+			Expect(client.ResetCache(ctx)).To(Succeed())
+			Expect(client.SaveCacheSnapshot(ctx)).To(Succeed())
+
+			clearRequests()
+			client, err = cf.NewClient(snapshotSettings())
+			Expect(err).ShouldNot(HaveOccurred())
+			client.RestoreCache(ctx)
+
+			Expect(getPlanGUIDS()).To(ConsistOf([]string{
+				"broker1-service1-plan1-guid",
+				"broker1-service2-plan1-guid",
+			}))
+			Eventually(func() *http.Request { return brokersRequest }).ShouldNot(BeNil())
+			Expect(brokersRequest.URL.Query()).To(HaveKey(cf.CCQueryParams.UpdatedAtsAfter))
+		})
+
+		It("ignores a corrupted snapshot", func() {
+			Expect(ioutil.WriteFile(filepath.Join(dir, "cache.json"), []byte("{"), 0600)).To(Succeed())
+			client, err = cf.NewClient(snapshotSettings())
+			Expect(err).ShouldNot(HaveOccurred())
+
+			client.RestoreCache(ctx)
+
+			Expect(getPlanGUIDS()).To(BeEmpty())
+			Consistently(func() *http.Request { return brokersRequest }).Should(BeNil())
+		})
+
+		It("ignores a snapshot written with another proxy instance and reloads the cache", func() {
+			client, err = cf.NewClient(snapshotSettings())
+			Expect(err).ShouldNot(HaveOccurred())
+			setupCCRoutes(broker1)
+			Expect(client.ResetCache(ctx)).To(Succeed())
+			Expect(client.SaveCacheSnapshot(ctx)).To(Succeed())
+
+			clearRequests()
+			settings := snapshotSettings()
+			settings.CF.ProxyInstance = "other-proxy"
+			client, err = cf.NewClient(settings)
+			Expect(err).ShouldNot(HaveOccurred())
+			client.RestoreCache(ctx)
+
+			Expect(getPlanGUIDS()).To(BeEmpty())
+			Consistently(func() *http.Request { return brokersRequest }).Should(BeNil())
+
+			Expect(client.ResetCache(ctx)).To(Succeed())
+			Expect(brokersRequest.URL.Query()).ToNot(HaveKey(cf.CCQueryParams.UpdatedAtsAfter))
+		})
+	})
+
+	Describe("StartCacheSnapshots", func() {
+		var dir string
+
+		BeforeEach(func() {
+			dir, err = ioutil.TempDir("", "cache-snapshot")
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("writes no snapshots by default", func() {
+			Expect(cf.DefaultSettings().CF.CacheSnapshot.File).To(BeEmpty())
+
+			snapshotsCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			Eventually(client.StartCacheSnapshots(snapshotsCtx)).Should(BeClosed())
+		})
+
+		It("writes the last snapshot before the returned channel is closed", func() {
+			settings := testhelper.CCSettings(ccServer.URL(), 50, 2)
+			settings.CF.CacheSnapshot = cf.CacheSnapshotConfig{
+				File:     filepath.Join(dir, "cache.json"),
+				Interval: time.Hour,
+			}
+			client, err = cf.NewClient(settings)
+			Expect(err).ShouldNot(HaveOccurred())
+			setupCCRoutes(broker1)
+			Expect(client.ResetCache(ctx)).To(Succeed())
+
+			snapshotsCtx, cancel := context.WithCancel(ctx)
+			done := client.StartCacheSnapshots(snapshotsCtx)
+			Consistently(done).ShouldNot(BeClosed())
+			cancel()
+			Eventually(done).Should(BeClosed())
+
+			snapshot, err := cf.LoadSnapshot(settings.CF.CacheSnapshot.File, 0)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(snapshot).ToNot(BeNil())
+			Expect(snapshot.Plans).To(HaveLen(2))
+		})
 	})
 
 	Describe("ResetBroker", func() {
@@ -316,8 +637,9 @@ var _ = Describe("Cache", func() {
 			}))
 
 			broker1.plans = append(broker1.plans, cf.CCServicePlan{
-				GUID: "broker1-service1-plan9-guid",
-				Name: "broker1-service1-plan9",
+				GUID:          "broker1-service1-plan9-guid",
+				Name:          "broker1-service1-plan9",
+				BrokerCatalog: cf.CCBrokerCatalog{ID: "broker1-service1-plan9-catalog-id"},
 				Relationships: cf.CCServicePlanRelationships{
 					ServiceOffering: cf.CCRelationship{
 						Data: cf.CCData{
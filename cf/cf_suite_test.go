@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/Peripli/service-broker-proxy-cf/cf"
 	"github.com/Peripli/service-broker-proxy/pkg/platform"
+	"github.com/Peripli/service-broker-proxy/pkg/sbproxy"
 	"github.com/Peripli/service-broker-proxy/pkg/sbproxy/reconcile"
 	"github.com/Peripli/service-manager/test/testutil"
 	"github.com/gofrs/uuid"
@@ -14,6 +15,8 @@ import (
 	"github.com/sirupsen/logrus"
 	"net/http"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -53,6 +56,19 @@ var unknownErrorResponse = cf.CCErrorResponse{
 	Errors: []cf.CCError{unknownError},
 }
 
+// managedBrokerMetadata returns the metadata stamped by the test clients on the brokers they register
+func managedBrokerMetadata() *cf.CCMetadata {
+	return &cf.CCMetadata{
+		Labels:      map[string]string{cf.ManagedBrokerLabel: "true"},
+		Annotations: map[string]string{cf.ServiceManagerURLAnnotation: "http://10.0.2.2"},
+	}
+}
+
+// smBrokerURL returns the URL of the proxy of the test clients for the Service Manager broker with the given ID
+func smBrokerURL(brokerID string) string {
+	return "http://10.0.2.2" + sbproxy.APIPrefix + "/" + brokerID
+}
+
 func generateCFOrganizations(count int) []*cf.CCOrganization {
 	organizations := make([]*cf.CCOrganization, 0)
 	for i := 0; i < count; i++ {
@@ -79,6 +95,7 @@ func generateCFBrokers(count int) []*cf.CCServiceBroker {
 		brokers = append(brokers, &cf.CCServiceBroker{
 			GUID: brokerGuid,
 			Name: reconcile.DefaultProxyBrokerPrefix + brokerName + "-" + brokerGuid,
+			URL:  smBrokerURL(brokerGuid),
 		})
 	}
 	return brokers
@@ -378,12 +395,37 @@ func setCCPlansResponse(server *ghttp.Server, cfPlans map[string][]*cf.CCService
 		server.RouteToHandler(http.MethodGet, "/v3/service_plans", parallelRequestsChecker(badRequestHandler))
 		return
 	}
-	server.RouteToHandler(http.MethodGet, "/v3/service_plans", parallelRequestsChecker(func(rw http.ResponseWriter, req *http.Request) {
+	server.RouteToHandler(http.MethodGet, "/v3/service_plans", parallelRequestsChecker(ccPlansHandler(cfPlans, nil)))
+}
+
+// ccPlansHandler lists the plans, the plans visible in the organizations filtered by are taken from cfVisibilities
+func ccPlansHandler(cfPlans map[string][]*cf.CCServicePlan, cfVisibilities map[string]*cf.ServicePlanVisibilitiesResponse) http.HandlerFunc {
+	visibleInOrganizations := func(plan *cf.CCServicePlan, orgFilter map[string]bool) bool {
+		if orgFilter == nil || plan.VisibilityType == cf.VisibilityType.PUBLIC {
+			return true
+		}
+		if visibilities, found := cfVisibilities[plan.GUID]; found {
+			for _, org := range visibilities.Organizations {
+				if orgFilter[org.Guid] {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	return func(rw http.ResponseWriter, req *http.Request) {
 		filter := parseFilterQuery(req.URL.Query().Get(cf.CCQueryParams.ServiceOfferingGuids))
+		planFilter := parseFilterQuery(req.URL.Query().Get(cf.CCQueryParams.GUIDs))
+		orgFilter := parseFilterQuery(req.URL.Query().Get(cf.CCQueryParams.OrganizationGuids))
+		visibilityTypeFilter := parseFilterQuery(req.URL.Query().Get(cf.CCQueryParams.VisibilityTypes))
 		servicePlans := make([]cf.CCServicePlan, 0, len(filter))
 		for _, plans := range cfPlans {
 			for _, plan := range plans {
-				if filter == nil || filter[plan.Relationships.ServiceOffering.Data.GUID] {
+				if (filter == nil || filter[plan.Relationships.ServiceOffering.Data.GUID]) &&
+					(planFilter == nil || planFilter[plan.GUID]) &&
+					visibleInOrganizations(plan, orgFilter) &&
+					(visibilityTypeFilter == nil || visibilityTypeFilter[string(plan.VisibilityType)]) {
 					servicePlans = append(servicePlans, *plan)
 				}
 			}
@@ -396,6 +438,35 @@ func setCCPlansResponse(server *ghttp.Server, cfPlans map[string][]*cf.CCService
 			Resources: servicePlans,
 		}
 		writeJSONResponse(servicePlanResponse, rw)
+	}
+}
+
+func setCCServiceInstancesResponse(server *ghttp.Server, cfServiceInstances []*cf.CCServiceInstance) {
+	if cfServiceInstances == nil {
+		server.RouteToHandler(http.MethodGet, "/v3/service_instances", parallelRequestsChecker(badRequestHandler))
+		return
+	}
+	server.RouteToHandler(http.MethodGet, "/v3/service_instances", parallelRequestsChecker(func(rw http.ResponseWriter, req *http.Request) {
+		filter := parseFilterQuery(req.URL.Query().Get(cf.CCQueryParams.ServicePlanGuids))
+		result := make([]cf.CCServiceInstance, 0, len(cfServiceInstances))
+		for _, serviceInstance := range cfServiceInstances {
+			if filter == nil || filter[serviceInstance.Relationships.ServicePlan.Data.GUID] {
+				result = append(result, *serviceInstance)
+			}
+		}
+		// only the first page is returned, the tests list fewer instances than a page
+		totalResults := len(result)
+		if perPage, err := strconv.Atoi(req.URL.Query().Get(cf.CCQueryParams.PageSize)); err == nil && perPage < len(result) {
+			result = result[:perPage]
+		}
+		serviceInstancesResponse := cf.CCListServiceInstancesResponse{
+			Pagination: cf.CCPagination{
+				TotalResults: totalResults,
+				TotalPages:   1,
+			},
+			Resources: result,
+		}
+		writeJSONResponse(serviceInstancesResponse, rw)
 	}))
 }
 
@@ -414,6 +485,65 @@ func setCCVisibilitiesGetResponse(server *ghttp.Server, cfVisibilitiesByPlanId m
 	}))
 }
 
+func setCCPlanOrganizationsResponse(server *ghttp.Server, cfVisibilitiesByPlanId map[string]*cf.ServicePlanVisibilitiesResponse) {
+	if cfVisibilitiesByPlanId == nil {
+		server.RouteToHandler(http.MethodGet, "/v3/organizations", parallelRequestsChecker(badRequestHandler))
+		return
+	}
+	server.RouteToHandler(http.MethodGet, "/v3/organizations", parallelRequestsChecker(func(rw http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		filter := parseFilterQuery(query.Get(cf.CCQueryParams.ServicePlanGuids))
+		Expect(filter).ToNot(BeEmpty())
+
+		var result []cf.CCOrganization
+		listed := make(map[string]bool)
+		for planGUID := range filter {
+			visibilities, found := cfVisibilitiesByPlanId[planGUID]
+			if !found || visibilities.Type != string(cf.VisibilityType.ORGANIZATION) {
+				continue
+			}
+			for _, org := range visibilities.Organizations {
+				if !listed[org.Guid] {
+					listed[org.Guid] = true
+					result = append(result, cf.CCOrganization{GUID: org.Guid, Name: org.Name})
+				}
+			}
+		}
+		// the pages have to be consistent
+		sort.Slice(result, func(i, j int) bool { return result[i].GUID < result[j].GUID })
+
+		pageSize, err := strconv.Atoi(query.Get(cf.CCQueryParams.PageSize))
+		Expect(err).ToNot(HaveOccurred())
+		page := 1
+		if query.Get("page") != "" {
+			page, err = strconv.Atoi(query.Get("page"))
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		start := min((page-1)*pageSize, len(result))
+		end := min(page*pageSize, len(result))
+		resp := cf.CCListOrganizationsResponse{
+			Pagination: cf.CCPagination{
+				TotalResults: len(result),
+				TotalPages:   (len(result) + pageSize - 1) / pageSize,
+			},
+			Resources: result[start:end],
+		}
+		if end < len(result) {
+			query.Set("page", strconv.Itoa(page+1))
+			resp.Pagination.Next.Href = req.URL.Path + "?" + query.Encode()
+		}
+		writeJSONResponse(resp, rw)
+	}))
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 func setCCVisibilitiesUpdateResponse(server *ghttp.Server, cfPlans map[string][]*cf.CCServicePlan, simulateError bool) {
 	path := regexp.MustCompile(`/v3/service_plans/(?P<guid>[A-Za-z0-9_-]+)/visibility`)
 	if cfPlans == nil || simulateError {
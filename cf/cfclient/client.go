@@ -33,19 +33,34 @@ import (
 	"golang.org/x/oauth2/clientcredentials"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Peripli/service-manager/pkg/log"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
+// VcapRequestIDHeader is the header identifying a request in the logs of Cloud Controller
+const VcapRequestIDHeader = "X-Vcap-Request-Id"
+
 // Client used to communicate with Cloud Foundry
 type Client struct {
 	Config   Config
 	Endpoint Endpoints
+
+	rateLimiter *rateLimiter
+
+	// baseHttpClient is the HTTP client from the configuration, it is used to obtain tokens
+	baseHttpClient *http.Client
+	// authMutex guards the authenticated HTTP client in the configuration while it is replaced
+	authMutex         sync.RWMutex
+	reauthentications int64
 }
 
 type Endpoints struct {
@@ -63,18 +78,31 @@ type EndpointUrl struct {
 
 // Config is used to configure the creation of a client
 type Config struct {
-	ApiAddress          string `json:"api_url"`
-	Username            string `json:"user"`
-	Password            string `json:"password"`
-	ClientID            string `json:"client_id"`
-	ClientSecret        string `json:"client_secret"`
-	SkipSslValidation   bool   `json:"skip_ssl_validation"`
+	ApiAddress          string    `json:"api_url"`
+	Username            string    `json:"user"`
+	Password            string    `json:"password"`
+	ClientID            string    `json:"client_id"`
+	ClientSecret        string    `json:"client_secret"`
+	SkipSslValidation   bool      `json:"skip_ssl_validation"`
+	TLS                 TLSConfig `json:"tls" mapstructure:"tls"`
 	HttpClient          *http.Client
 	Token               string `json:"auth_token"`
 	TokenSource         oauth2.TokenSource
 	tokenSourceDeadline *time.Time
-	UserAgent           string `json:"user_agent"`
-	Origin              string `json:"-"`
+	UserAgent           string          `json:"user_agent"`
+	Origin              string          `json:"-"`
+	Retry               RetryConfig     `json:"retry"`
+	RateLimit           RateLimitConfig `json:"rate_limit" mapstructure:"rate_limit"`
+}
+
+// RetryConfig configures the retries of idempotent requests which failed with a transient error
+type RetryConfig struct {
+	// MaxRetries is the maximum number of retries of a request, 0 disables retries
+	MaxRetries int `json:"max_retries" mapstructure:"max_retries"`
+	// InitialInterval is the backoff before the first retry, it is doubled for every subsequent retry
+	InitialInterval time.Duration `json:"initial_interval" mapstructure:"initial_interval"`
+	// MaxInterval caps the backoff between two retries
+	MaxInterval time.Duration `json:"max_interval" mapstructure:"max_interval"`
 }
 
 type LoginHint struct {
@@ -83,11 +111,15 @@ type LoginHint struct {
 
 // Request is used to help build up a request
 type Request struct {
-	method string
-	url    string
-	params url.Values
-	body   io.Reader
-	obj    interface{}
+	method     string
+	url        string
+	params     url.Values
+	header     http.Header
+	body       io.Reader
+	payload    []byte
+	obj        interface{}
+	ctx        context.Context
+	idempotent bool
 }
 
 // NewClient returns a new client
@@ -119,18 +151,25 @@ func NewClient(config *Config) (client *Client, err error) {
 		config.HttpClient = defConfig.HttpClient
 	}
 
-	if config.HttpClient.Transport == nil {
-		config.HttpClient.Transport = shallowDefaultTransport()
+	// the HTTP client and its transport can be shared, e.g. http.DefaultClient,
+	// so the TLS options are applied to copies of them
+	httpClient := *config.HttpClient
+	if httpClient.Transport == nil {
+		httpClient.Transport = shallowDefaultTransport()
 	}
 
 	var tp *http.Transport
 
-	switch t := config.HttpClient.Transport.(type) {
+	switch t := httpClient.Transport.(type) {
 	case *http.Transport:
-		tp = t
+		tp = t.Clone()
+		httpClient.Transport = tp
 	case *oauth2.Transport:
 		if bt, ok := t.Base.(*http.Transport); ok {
-			tp = bt
+			tp = bt.Clone()
+			oauthTransport := *t
+			oauthTransport.Base = tp
+			httpClient.Transport = &oauthTransport
 		}
 	}
 
@@ -139,12 +178,20 @@ func NewClient(config *Config) (client *Client, err error) {
 			tp.TLSClientConfig = &tls.Config{}
 		}
 		tp.TLSClientConfig.InsecureSkipVerify = config.SkipSslValidation
+		if err := config.TLS.apply(tp.TLSClientConfig); err != nil {
+			return nil, err
+		}
+	} else if config.TLS != (TLSConfig{}) {
+		return nil, errors.New("TLS options can be applied only to HTTP clients using an *http.Transport")
 	}
+	config.HttpClient = &httpClient
 
 	config.ApiAddress = strings.TrimRight(config.ApiAddress, "/")
 
 	client = &Client{
-		Config: *config,
+		Config:         *config,
+		rateLimiter:    newRateLimiter(),
+		baseHttpClient: config.HttpClient,
 	}
 
 	if err := client.refreshEndpoint(); err != nil {
@@ -164,6 +211,16 @@ func DefaultConfig() *Config {
 		SkipSslValidation: false,
 		HttpClient:        http.DefaultClient,
 		UserAgent:         "SM-CF-client/1.0",
+		Retry: RetryConfig{
+			MaxRetries:      3,
+			InitialInterval: 500 * time.Millisecond,
+			MaxInterval:     5 * time.Second,
+		},
+		RateLimit: RateLimitConfig{
+			Threshold:  10,
+			MaxRetries: 3,
+			MaxWait:    time.Minute,
+		},
 	}
 }
 
@@ -178,6 +235,7 @@ func (c *Client) NewRequest(method, path string) *Request {
 		method: method,
 		url:    requestUrl,
 		params: make(map[string][]string),
+		header: make(http.Header),
 	}
 	return r
 }
@@ -190,36 +248,181 @@ func (c *Client) NewRequestWithBody(method, path string, body io.Reader) *Reques
 	return r
 }
 
-// DoRequest runs a request with our client
+// WithContext sets the context of the request. Cancelling the context aborts the request.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	r.ctx = ctx
+	return r
+}
+
+// Header returns the headers sent with the request in addition to the ones set by the client
+func (r *Request) Header() http.Header {
+	return r.header
+}
+
+// Idempotent marks the request as safe to be retried even if its method is not idempotent by definition
+func (r *Request) Idempotent() *Request {
+	r.idempotent = true
+	return r
+}
+
+// Reauthentications returns how many times the client had to authenticate again
+// because its token was rejected or could not be refreshed
+func (c *Client) Reauthentications() int64 {
+	return atomic.LoadInt64(&c.reauthentications)
+}
+
+// DoRequest runs a request with our client. Idempotent requests failing with a transient error
+// are retried according to the retry configuration of the client. Requests rejected by the rate limiting
+// of Cloud Controller are retried once the rate limit allows it. Requests rejected because of an invalid token
+// are retried once after the client authenticated again, unless the client uses a static token
+// which cannot be obtained again. Responses with an error status are returned
+// as CloudFoundryError, or as CloudFoundryHTTPError along with the response if their body could not be parsed.
+// The correlation ID of the logger in the context of the request
+// is sent to Cloud Controller as request ID.
 func (c *Client) DoRequest(r *Request) (*http.Response, error) {
-	req, err := r.toHTTP()
+	retries, throttledRetries := 0, 0
+	reauthenticated := false
+	for {
+		req, err := r.toHTTP()
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("User-Agent", c.Config.UserAgent)
+		// lets Cloud Controller log the request with the correlation ID of the proxy logs
+		if correlationID := log.CorrelationIDFromContext(req.Context()); correlationID != "" && req.Header.Get(VcapRequestIDHeader) == "" {
+			req.Header.Set(VcapRequestIDHeader, correlationID)
+		}
+		if req.Body != nil && req.Header.Get("Content-type") == "" {
+			req.Header.Set("Content-type", "application/json")
+		}
+
+		if err := c.rateLimiter.wait(req.Context(), c.Config.RateLimit); err != nil {
+			return nil, err
+		}
+
+		httpClient := c.httpClient()
+		resp, err := httpClient.Do(req)
+		if resp != nil {
+			c.rateLimiter.update(resp.Header)
+		}
+
+		if !reauthenticated && c.canReauthenticate() && isAuthenticationFailure(resp, err) {
+			discardBody(resp)
+			if err := c.reauthenticate(httpClient); err != nil {
+				return nil, errors.Wrap(err, "Could not authenticate again after the token was rejected")
+			}
+			reauthenticated = true
+			continue
+		}
+
+		if resp != nil && resp.StatusCode == http.StatusTooManyRequests && throttledRetries < c.Config.RateLimit.MaxRetries {
+			// the actual waiting is done before the request is sent again
+			c.rateLimiter.throttle(retryAfter(resp.Header))
+			discardBody(resp)
+			throttledRetries++
+			continue
+		}
+
+		if retries < c.Config.Retry.MaxRetries && r.retryable() && isTransientFailure(req.Context(), resp, err) {
+			discardBody(resp)
+			if err := sleep(req.Context(), c.Config.Retry.backoff(retries)); err != nil {
+				return nil, err
+			}
+			retries++
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode >= http.StatusBadRequest {
+			return c.handleError(resp)
+		}
+
+		return resp, nil
+	}
+}
+
+func discardBody(resp *http.Response) {
+	if resp != nil {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+}
+
+// isAuthenticationFailure reports whether the request failed because the token of the client is no longer valid
+func isAuthenticationFailure(resp *http.Response, err error) bool {
 	if err != nil {
-		return nil, err
+		// the token could not be refreshed, e.g. because the refresh token expired or was revoked
+		var retrieveErr *oauth2.RetrieveError
+		return errors.As(err, &retrieveErr)
 	}
 
-	req.Header.Set("User-Agent", c.Config.UserAgent)
-	if req.Body != nil && req.Header.Get("Content-type") == "" {
-		req.Header.Set("Content-type", "application/json")
+	return resp.StatusCode == http.StatusUnauthorized
+}
+
+func (r *Request) retryable() bool {
+	switch r.method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	default:
+		return r.idempotent
 	}
+}
 
-	resp, err := c.Config.HttpClient.Do(req)
+// isTransientFailure reports whether the request failed with an error which is likely to go away when retried
+func isTransientFailure(ctx context.Context, resp *http.Response, err error) bool {
 	if err != nil {
-		return nil, err
+		// errors caused by cancellation of the request should not be retried
+		return ctx.Err() == nil
 	}
 
-	if resp.StatusCode >= http.StatusBadRequest {
-		return c.handleError(resp)
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
 	}
+}
 
-	return resp, nil
+// backoff returns the jittered exponential backoff before the given retry attempt
+func (rc RetryConfig) backoff(attempt int) time.Duration {
+	interval := rc.InitialInterval
+	for i := 0; i < attempt; i++ {
+		interval *= 2
+		if rc.MaxInterval > 0 && interval >= rc.MaxInterval {
+			break
+		}
+	}
+	if rc.MaxInterval > 0 && interval > rc.MaxInterval {
+		interval = rc.MaxInterval
+	}
+	if interval <= 0 {
+		return 0
+	}
+
+	// wait at least half of the interval, the rest is randomized to spread retries of parallel requests
+	half := interval / 2
+	return half + time.Duration(rand.Int63n(int64(interval-half)+1))
 }
 
-func (c *Client) refreshEndpoint() error {
-	// we want to keep the Timeout value from config.HttpClient
-	timeout := c.Config.HttpClient.Timeout
+// sleep waits for the given duration or until the context is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
 
+func (c *Client) refreshEndpoint() error {
 	ctx := context.Background()
-	ctx = context.WithValue(ctx, oauth2.HTTPClient, c.Config.HttpClient)
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, c.baseHttpClient)
 
 	endpoint, err := getInfo(c.Config.ApiAddress, oauth2.NewClient(ctx, nil))
 
@@ -227,26 +430,77 @@ func (c *Client) refreshEndpoint() error {
 		return errors.Wrap(err, "Could not get endpoints from the root call")
 	}
 
+	if err := c.authenticate(endpoint); err != nil {
+		return err
+	}
+
+	c.Endpoint = *endpoint
+	return nil
+}
+
+// authenticate runs the configured grant and makes the client use the obtained token
+func (c *Client) authenticate(endpoint *Endpoints) error {
+	// we want to keep the Timeout value from config.HttpClient
+	timeout := c.baseHttpClient.Timeout
+
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, c.baseHttpClient)
+
+	var err error
+	config := c.Config
 	switch {
-	case c.Config.Token != "":
-		c.Config = getUserTokenAuth(ctx, c.Config, endpoint)
-	case c.Config.ClientID != "":
-		c.Config = getClientAuth(ctx, c.Config, endpoint)
+	case config.Token != "":
+		config = getUserTokenAuth(ctx, config, endpoint)
+	case config.ClientID != "":
+		config = getClientAuth(ctx, config, endpoint)
 	default:
-		c.Config, err = getUserAuth(ctx, c.Config, endpoint)
+		config, err = getUserAuth(ctx, config, endpoint)
 		if err != nil {
 			return err
 		}
 	}
 	// make sure original Timeout value will be used
-	if c.Config.HttpClient.Timeout != timeout {
-		c.Config.HttpClient.Timeout = timeout
+	if config.HttpClient.Timeout != timeout {
+		config.HttpClient.Timeout = timeout
 	}
 
-	c.Endpoint = *endpoint
+	c.Config.HttpClient = config.HttpClient
+	c.Config.TokenSource = config.TokenSource
+	c.Config.tokenSourceDeadline = config.tokenSourceDeadline
+	return nil
+}
+
+// canReauthenticate reports whether the grant of the client can obtain a new token.
+// A static token is sent as configured, so authenticating again would not change it.
+func (c *Client) canReauthenticate() bool {
+	return c.Config.Token == ""
+}
+
+// reauthenticate authenticates the client again unless another request already did it
+// after the given HTTP client failed to authenticate
+func (c *Client) reauthenticate(failedClient *http.Client) error {
+	c.authMutex.Lock()
+	defer c.authMutex.Unlock()
+
+	if c.Config.HttpClient != failedClient {
+		return nil
+	}
+
+	if err := c.authenticate(&c.Endpoint); err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&c.reauthentications, 1)
 	return nil
 }
 
+func (c *Client) httpClient() *http.Client {
+	c.authMutex.RLock()
+	defer c.authMutex.RUnlock()
+
+	return c.Config.HttpClient
+}
+
 // getUserTokenAuth initializes client credentials from existing bearer token.
 func getUserTokenAuth(ctx context.Context, config Config, endpoints *Endpoints) Config {
 	authConfig := &oauth2.Config{
@@ -372,8 +626,34 @@ func (r *Request) toHTTP() (*http.Request, error) {
 		r.body = b
 	}
 
+	// Buffer the body so that the request can be replayed when retried
+	if r.body != nil && r.payload == nil {
+		payload, err := ioutil.ReadAll(r.body)
+		if err != nil {
+			return nil, err
+		}
+		r.payload = payload
+	}
+
+	var body io.Reader
+	if r.payload != nil {
+		body = bytes.NewReader(r.payload)
+	}
+
+	ctx := r.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
 	// Create the HTTP Request
-	return http.NewRequest(r.method, r.url, r.body)
+	req, err := http.NewRequestWithContext(ctx, r.method, r.url, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range r.header {
+		req.Header[key] = values
+	}
+	return req, nil
 }
 
 func (c *Client) handleError(resp *http.Response) (*http.Response, error) {
@@ -396,5 +676,9 @@ func (c *Client) handleError(resp *http.Response) (*http.Response, error) {
 			Body:       body,
 		}
 	}
-	return nil, CloudFoundryToHttpError(cfErrors)
+
+	cfErr := CloudFoundryToHttpError(cfErrors)
+	cfErr.StatusCode = resp.StatusCode
+	cfErr.RequestID = resp.Header.Get(VcapRequestIDHeader)
+	return nil, cfErr
 }
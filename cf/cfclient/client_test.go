@@ -4,16 +4,20 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/Peripli/service-broker-proxy-cf/cf"
 	"github.com/Peripli/service-broker-proxy-cf/cf/cfclient"
 	"github.com/Peripli/service-broker-proxy-cf/cf/internal"
+	"github.com/Peripli/service-manager/pkg/log"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
 	"golang.org/x/oauth2"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 )
 
 var (
@@ -27,6 +31,16 @@ var (
 	err          error
 )
 
+func requestsTo(path string) int {
+	count := 0
+	for _, request := range ccServer.ReceivedRequests() {
+		if request.URL.Path == path {
+			count++
+		}
+	}
+	return count
+}
+
 var _ = Describe("Client", func() {
 	BeforeEach(func() {
 		ccServer = testhelper.FakeCCServer(false)
@@ -48,6 +62,8 @@ var _ = Describe("Client", func() {
 			Expect(config.SkipSslValidation).To(BeFalse())
 			Expect(config.Token).To(Equal(""))
 			Expect(config.UserAgent).To(Equal("SM-CF-client/1.0"))
+			Expect(config.Retry.MaxRetries).To(Equal(3))
+			Expect(config.RateLimit.MaxRetries).To(Equal(3))
 
 		})
 	})
@@ -153,6 +169,16 @@ var _ = Describe("Client", func() {
 
 					testhelper.AssertCFError(err, responseErr.Errors[0])
 				})
+
+				It("returns the status code of the response with the error", func() {
+					request := client.NewRequest(http.MethodGet, requestPath)
+					response, err := client.DoRequest(request)
+					Expect(response).To(BeNil())
+
+					var cfErr cfclient.CloudFoundryError
+					Expect(errors.As(err, &cfErr)).To(BeTrue())
+					Expect(cfErr.StatusCode).To(Equal(http.StatusInternalServerError))
+				})
 			})
 
 			Context("when the request is successful", func() {
@@ -186,6 +212,359 @@ var _ = Describe("Client", func() {
 			})
 		})
 
+		Describe("when the request fails with a transient error", func() {
+			BeforeEach(func() {
+				client.Config.Retry = cfclient.RetryConfig{
+					MaxRetries:      2,
+					InitialInterval: time.Millisecond,
+					MaxInterval:     2 * time.Millisecond,
+				}
+			})
+
+			Context("when the request is idempotent", func() {
+				It("retries the request until it succeeds", func() {
+					ccServer.AppendHandlers(
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest(http.MethodGet, requestPath),
+							ghttp.RespondWith(http.StatusServiceUnavailable, nil),
+						),
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest(http.MethodGet, requestPath),
+							ghttp.RespondWith(http.StatusBadGateway, nil),
+						),
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest(http.MethodGet, requestPath),
+							ghttp.RespondWith(http.StatusOK, "{}"),
+						),
+					)
+
+					res, err := client.DoRequest(client.NewRequest(http.MethodGet, requestPath))
+
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(res.StatusCode).To(Equal(http.StatusOK))
+				})
+
+				It("returns an error when the retries are exhausted", func() {
+					for i := 0; i < 3; i++ {
+						ccServer.AppendHandlers(
+							ghttp.CombineHandlers(
+								ghttp.VerifyRequest(http.MethodGet, requestPath),
+								ghttp.RespondWith(http.StatusGatewayTimeout, nil),
+							),
+						)
+					}
+
+					_, err := client.DoRequest(client.NewRequest(http.MethodGet, requestPath))
+
+					Expect(err).To(MatchError(cfclient.CloudFoundryHTTPError{
+						StatusCode: http.StatusGatewayTimeout,
+						Status:     "504 Gateway Timeout",
+						Body:       []byte{},
+					}))
+					Expect(requestsTo(requestPath)).To(Equal(3))
+				})
+
+				It("replays the request body", func() {
+					for _, statusCode := range []int{http.StatusServiceUnavailable, http.StatusOK} {
+						ccServer.AppendHandlers(
+							ghttp.CombineHandlers(
+								ghttp.VerifyRequest(http.MethodPatch, requestPath),
+								ghttp.VerifyJSON(`{"type":"public"}`),
+								ghttp.RespondWith(statusCode, nil),
+							),
+						)
+					}
+
+					request := client.NewRequestWithBody(http.MethodPatch, requestPath, strings.NewReader(`{"type":"public"}`))
+					res, err := client.DoRequest(request.Idempotent())
+
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(res.StatusCode).To(Equal(http.StatusOK))
+				})
+			})
+
+			Context("when the request is not idempotent", func() {
+				It("does not retry the request", func() {
+					ccServer.AppendHandlers(
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest(http.MethodPost, requestPath),
+							ghttp.RespondWith(http.StatusServiceUnavailable, nil),
+						),
+					)
+
+					_, err := client.DoRequest(client.NewRequest(http.MethodPost, requestPath))
+
+					Expect(err).To(HaveOccurred())
+					Expect(requestsTo(requestPath)).To(Equal(1))
+				})
+			})
+
+			Context("when the status code is not transient", func() {
+				It("does not retry the request", func() {
+					ccServer.AppendHandlers(
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest(http.MethodGet, requestPath),
+							ghttp.RespondWith(http.StatusNotFound, nil),
+						),
+					)
+
+					_, err := client.DoRequest(client.NewRequest(http.MethodGet, requestPath))
+
+					Expect(err).To(HaveOccurred())
+				})
+			})
+		})
+
+		Describe("when the request is rate limited", func() {
+			BeforeEach(func() {
+				client.Config.RateLimit = cfclient.RateLimitConfig{
+					Threshold:  0,
+					MaxRetries: 1,
+					MaxWait:    5 * time.Second,
+				}
+			})
+
+			It("retries the request after the time requested by Cloud Controller", func() {
+				ccServer.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest(http.MethodPost, requestPath),
+						ghttp.RespondWith(http.StatusTooManyRequests, nil, http.Header{"Retry-After": []string{"1"}}),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest(http.MethodPost, requestPath),
+						ghttp.VerifyJSON(`{"name":"test"}`),
+						ghttp.RespondWith(http.StatusCreated, "{}"),
+					),
+				)
+
+				start := time.Now()
+				request := client.NewRequestWithBody(http.MethodPost, requestPath, strings.NewReader(`{"name":"test"}`))
+				res, err := client.DoRequest(request)
+
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(res.StatusCode).To(Equal(http.StatusCreated))
+				Expect(time.Since(start)).To(BeNumerically(">=", time.Second))
+			})
+
+			It("returns an error when the retries are exhausted", func() {
+				for i := 0; i < 2; i++ {
+					ccServer.AppendHandlers(
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest(http.MethodGet, requestPath),
+							ghttp.RespondWith(http.StatusTooManyRequests, nil, http.Header{"Retry-After": []string{"0"}}),
+						),
+					)
+				}
+
+				_, err := client.DoRequest(client.NewRequest(http.MethodGet, requestPath))
+
+				Expect(err).To(MatchError(cfclient.CloudFoundryHTTPError{
+					StatusCode: http.StatusTooManyRequests,
+					Status:     "429 Too Many Requests",
+					Body:       []byte{},
+				}))
+				Expect(requestsTo(requestPath)).To(Equal(2))
+			})
+
+			It("delays the following requests until the rate limit is reset", func() {
+				reset := time.Now().Add(2 * time.Second).Unix()
+				ccServer.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest(http.MethodGet, requestPath),
+						ghttp.RespondWith(http.StatusOK, "{}", http.Header{
+							"X-RateLimit-Remaining": []string{"0"},
+							"X-RateLimit-Reset":     []string{fmt.Sprint(reset)},
+						}),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest(http.MethodGet, requestPath),
+						ghttp.RespondWith(http.StatusOK, "{}"),
+					),
+				)
+
+				_, err := client.DoRequest(client.NewRequest(http.MethodGet, requestPath))
+				Expect(err).ShouldNot(HaveOccurred())
+
+				_, err = client.DoRequest(client.NewRequest(http.MethodGet, requestPath))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(time.Now().Unix()).To(BeNumerically(">=", reset))
+			})
+
+			It("spreads the remaining requests until the rate limit is reset", func() {
+				client.Config.RateLimit.Threshold = 10
+				reset := time.Now().Add(4 * time.Second).Unix()
+				ccServer.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest(http.MethodGet, requestPath),
+						ghttp.RespondWith(http.StatusOK, "{}", http.Header{
+							"X-RateLimit-Remaining": []string{"3"},
+							"X-RateLimit-Reset":     []string{fmt.Sprint(reset)},
+						}),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest(http.MethodGet, requestPath),
+						ghttp.RespondWith(http.StatusOK, "{}"),
+					),
+				)
+
+				_, err := client.DoRequest(client.NewRequest(http.MethodGet, requestPath))
+				Expect(err).ShouldNot(HaveOccurred())
+
+				start := time.Now()
+				_, err = client.DoRequest(client.NewRequest(http.MethodGet, requestPath))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(time.Since(start)).To(BeNumerically(">=", 500*time.Millisecond))
+				Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+			})
+
+			It("does not wait longer than the maximum wait time", func() {
+				client.Config.RateLimit.MaxWait = 100 * time.Millisecond
+				ccServer.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest(http.MethodGet, requestPath),
+						ghttp.RespondWith(http.StatusOK, "{}", http.Header{
+							"X-RateLimit-Remaining": []string{"0"},
+							"X-RateLimit-Reset":     []string{fmt.Sprint(time.Now().Add(time.Hour).Unix())},
+						}),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest(http.MethodGet, requestPath),
+						ghttp.RespondWith(http.StatusOK, "{}"),
+					),
+				)
+
+				_, err := client.DoRequest(client.NewRequest(http.MethodGet, requestPath))
+				Expect(err).ShouldNot(HaveOccurred())
+
+				start := time.Now()
+				_, err = client.DoRequest(client.NewRequest(http.MethodGet, requestPath))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			})
+		})
+
+		Describe("when the token is rejected", func() {
+			It("authenticates again and retries the request", func() {
+				ccServer.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest(http.MethodPost, requestPath),
+						ghttp.RespondWith(http.StatusUnauthorized, `{"errors":[{"code":1000,"title":"CF-InvalidAuthToken","detail":"Invalid Auth Token"}]}`),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest(http.MethodPost, requestPath),
+						ghttp.VerifyJSON(`{"name":"test"}`),
+						ghttp.RespondWith(http.StatusCreated, "{}"),
+					),
+				)
+				tokenRequests := requestsTo("/oauth/token")
+
+				request := client.NewRequestWithBody(http.MethodPost, requestPath, strings.NewReader(`{"name":"test"}`))
+				res, err := client.DoRequest(request)
+
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(res.StatusCode).To(Equal(http.StatusCreated))
+				Expect(requestsTo("/oauth/token")).To(Equal(tokenRequests + 1))
+				Expect(client.Reauthentications()).To(Equal(int64(1)))
+			})
+
+			It("returns an error if the token is rejected again", func() {
+				for i := 0; i < 2; i++ {
+					ccServer.AppendHandlers(
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest(http.MethodGet, requestPath),
+							ghttp.RespondWith(http.StatusUnauthorized, ""),
+						),
+					)
+				}
+
+				_, err := client.DoRequest(client.NewRequest(http.MethodGet, requestPath))
+
+				Expect(err).To(MatchError(cfclient.CloudFoundryHTTPError{
+					StatusCode: http.StatusUnauthorized,
+					Status:     "401 Unauthorized",
+					Body:       []byte{},
+				}))
+				Expect(requestsTo(requestPath)).To(Equal(2))
+				Expect(client.Reauthentications()).To(Equal(int64(1)))
+			})
+
+			It("returns an error if the client cannot authenticate again", func() {
+				ccServer.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest(http.MethodGet, requestPath),
+						ghttp.RespondWith(http.StatusUnauthorized, ""),
+					),
+				)
+				ccServer.RouteToHandler(http.MethodPost, "/oauth/token",
+					ghttp.RespondWith(http.StatusUnauthorized, `{"error":"unauthorized"}`))
+
+				_, err := client.DoRequest(client.NewRequest(http.MethodGet, requestPath))
+
+				Expect(err).To(MatchError(ContainSubstring("Could not authenticate again")))
+				Expect(requestsTo(requestPath)).To(Equal(1))
+				Expect(client.Reauthentications()).To(Equal(int64(0)))
+			})
+
+			It("returns the error without retrying if the client uses a static token", func() {
+				config := cfclient.DefaultConfig()
+				config.ApiAddress = ccServer.URL()
+				config.Token = "static-token"
+				client, err = cfclient.NewClient(config)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				ccServer.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest(http.MethodGet, requestPath),
+						ghttp.RespondWith(http.StatusUnauthorized, ""),
+					),
+				)
+				tokenRequests := requestsTo("/oauth/token")
+
+				_, err := client.DoRequest(client.NewRequest(http.MethodGet, requestPath))
+
+				Expect(err).To(MatchError(cfclient.CloudFoundryHTTPError{
+					StatusCode: http.StatusUnauthorized,
+					Status:     "401 Unauthorized",
+					Body:       []byte{},
+				}))
+				Expect(requestsTo(requestPath)).To(Equal(1))
+				Expect(requestsTo("/oauth/token")).To(Equal(tokenRequests))
+				Expect(client.Reauthentications()).To(Equal(int64(0)))
+			})
+		})
+
+		Describe("when the request context has a correlation ID", func() {
+			It("sends it as request ID to Cloud Controller", func() {
+				ccServer.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest(http.MethodGet, requestPath),
+						ghttp.VerifyHeaderKV(cfclient.VcapRequestIDHeader, "correlation-id"),
+						ghttp.RespondWith(http.StatusOK, "{}"),
+					),
+				)
+
+				requestCtx := log.ContextWithLogger(ctx, log.C(ctx).WithField(log.FieldCorrelationID, "correlation-id"))
+				_, err := client.DoRequest(client.NewRequest(http.MethodGet, requestPath).WithContext(requestCtx))
+
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+		})
+
+		Describe("when the request context is cancelled", func() {
+			It("does not send the request and returns an error", func() {
+				cancelledCtx, cancel := context.WithCancel(ctx)
+				cancel()
+				receivedRequests := len(ccServer.ReceivedRequests())
+
+				request := client.NewRequest(http.MethodGet, requestPath).WithContext(cancelledCtx)
+				_, err := client.DoRequest(request)
+
+				Expect(err).To(HaveOccurred())
+				Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+				Expect(ccServer.ReceivedRequests()).To(HaveLen(receivedRequests))
+			})
+		})
+
 		Describe("when a request contains body", func() {
 			requestBody := struct {
 				Name      string `json:"name"`
@@ -6,6 +6,9 @@ type CloudFoundryError struct {
 	Code   int    `json:"code"`
 	Title  string `json:"title"`
 	Detail string `json:"detail"`
+	// StatusCode and RequestID are taken from the error response of Cloud Controller
+	StatusCode int    `json:"-"`
+	RequestID  string `json:"-"`
 }
 
 type CloudFoundryErrors struct {
@@ -21,16 +24,16 @@ type CloudFoundryHTTPError struct {
 func CloudFoundryToHttpError(cfErrors CloudFoundryErrors) CloudFoundryError {
 	if len(cfErrors.Errors) == 0 {
 		return CloudFoundryError{
-			0,
-			"GO-Client-No-Errors",
-			"No Errors in error response from V3",
+			Code:   0,
+			Title:  "GO-Client-No-Errors",
+			Detail: "No Errors in error response from V3",
 		}
 	}
 
 	return CloudFoundryError{
-		cfErrors.Errors[0].Code,
-		cfErrors.Errors[0].Title,
-		cfErrors.Errors[0].Detail,
+		Code:   cfErrors.Errors[0].Code,
+		Title:  cfErrors.Errors[0].Title,
+		Detail: cfErrors.Errors[0].Detail,
 	}
 }
 
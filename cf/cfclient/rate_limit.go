@@ -0,0 +1,123 @@
+package cfclient
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultThrottleInterval is used when a request is rate limited but Cloud Controller did not say for how long
+	defaultThrottleInterval = time.Second
+)
+
+// RateLimitConfig configures how the client deals with the rate limiting of Cloud Controller
+type RateLimitConfig struct {
+	// Threshold is the number of remaining requests at which the remaining requests are spread evenly
+	// until the rate limit is reset. Requests wait for the reset when no requests remain.
+	Threshold int `json:"threshold" mapstructure:"threshold"`
+	// MaxRetries is the maximum number of retries of a request rejected with 429 Too Many Requests
+	MaxRetries int `json:"max_retries" mapstructure:"max_retries"`
+	// MaxWait caps how long a request waits for the rate limit to be reset, 0 means no limit
+	MaxWait time.Duration `json:"max_wait" mapstructure:"max_wait"`
+}
+
+// rateLimiter tracks the rate limit reported by Cloud Controller and delays
+// the requests of all goroutines using the client when the limit is (almost) reached
+type rateLimiter struct {
+	mutex sync.Mutex
+
+	// remaining is the number of requests left until reset, negative if unknown
+	remaining int
+	reset     time.Time
+	// next is the time at which the next request spread until the reset may be sent
+	next time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{remaining: -1}
+}
+
+// update records the rate limit state from the headers of a Cloud Controller response
+func (l *rateLimiter) update(header http.Header) {
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.remaining = remaining
+	l.reset = time.Unix(reset, 0)
+}
+
+// throttle blocks all requests for the given duration
+func (l *rateLimiter) throttle(d time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	until := time.Now().Add(d)
+	if until.After(l.reset) {
+		l.reset = until
+	}
+	l.remaining = 0
+}
+
+// delay returns how long a request should wait before it is sent
+func (l *rateLimiter) delay(config RateLimitConfig) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.remaining < 0 || l.remaining > config.Threshold {
+		return 0
+	}
+
+	now := time.Now()
+	d := l.reset.Sub(now)
+	if d <= 0 {
+		return 0
+	}
+	if l.remaining > 0 {
+		// spread the remaining requests evenly, so that they do not run out long before the reset
+		next := now
+		if l.next.After(next) {
+			next = l.next
+		}
+		l.next = next.Add(d / time.Duration(l.remaining+1))
+		l.remaining--
+		d = l.next.Sub(now)
+	}
+	if config.MaxWait > 0 && d > config.MaxWait {
+		return config.MaxWait
+	}
+	return d
+}
+
+// wait blocks until the request is allowed to be sent or the context is done
+func (l *rateLimiter) wait(ctx context.Context, config RateLimitConfig) error {
+	if d := l.delay(config); d > 0 {
+		return sleep(ctx, d)
+	}
+	return nil
+}
+
+// retryAfter returns how long Cloud Controller asked the client to wait before retrying a rate limited request
+func retryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	if reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		return time.Until(time.Unix(reset, 0))
+	}
+	return defaultThrottleInterval
+}
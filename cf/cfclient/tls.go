@@ -0,0 +1,100 @@
+package cfclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig configures the TLS connections to Cloud Controller and UAA
+type TLSConfig struct {
+	// CACertFile is the path to a PEM bundle of CA certificates trusted in addition to the system ones
+	CACertFile string `json:"ca_cert_file" mapstructure:"ca_cert_file"`
+	// CACert is a PEM bundle of CA certificates trusted in addition to the system ones
+	CACert string `json:"ca_cert" mapstructure:"ca_cert"`
+	// ClientCertFile and ClientKeyFile are the paths to the PEM encoded client certificate and key used for mutual TLS
+	ClientCertFile string `json:"client_cert_file" mapstructure:"client_cert_file"`
+	ClientKeyFile  string `json:"client_key_file" mapstructure:"client_key_file"`
+	// ClientCert and ClientKey are the PEM encoded client certificate and key used for mutual TLS
+	ClientCert string `json:"client_cert" mapstructure:"client_cert"`
+	ClientKey  string `json:"client_key" mapstructure:"client_key"`
+	// MinVersion is the minimum accepted TLS version, one of 1.0, 1.1, 1.2 and 1.3
+	MinVersion string `json:"min_version" mapstructure:"min_version"`
+}
+
+// Validate validates the TLS configuration without loading the referenced files
+func (tc TLSConfig) Validate() error {
+	if tc.MinVersion != "" {
+		if _, ok := tlsVersions[tc.MinVersion]; !ok {
+			return fmt.Errorf("unsupported TLS min_version %s, supported versions are 1.0, 1.1, 1.2 and 1.3", tc.MinVersion)
+		}
+	}
+	if tc.CACertFile != "" && tc.CACert != "" {
+		return errors.New("only one of TLS ca_cert_file and ca_cert can be provided")
+	}
+	if (tc.ClientCertFile != "" || tc.ClientKeyFile != "") && (tc.ClientCert != "" || tc.ClientKey != "") {
+		return errors.New("only one of TLS client_cert_file/client_key_file and client_cert/client_key can be provided")
+	}
+	if (tc.ClientCertFile == "") != (tc.ClientKeyFile == "") || (tc.ClientCert == "") != (tc.ClientKey == "") {
+		return errors.New("TLS client certificate and key must be provided together")
+	}
+	return nil
+}
+
+// apply loads the configured certificates into the given TLS configuration
+func (tc TLSConfig) apply(tlsConfig *tls.Config) error {
+	if err := tc.Validate(); err != nil {
+		return err
+	}
+
+	if tc.MinVersion != "" {
+		tlsConfig.MinVersion = tlsVersions[tc.MinVersion]
+	}
+
+	caCert := []byte(tc.CACert)
+	if tc.CACertFile != "" {
+		var err error
+		if caCert, err = ioutil.ReadFile(tc.CACertFile); err != nil {
+			return errors.Wrap(err, "Could not read TLS CA certificate file")
+		}
+	}
+	if len(caCert) != 0 {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil || rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(caCert) {
+			return errors.New("Could not parse any TLS CA certificate")
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	var (
+		certificate tls.Certificate
+		err         error
+	)
+	switch {
+	case tc.ClientCertFile != "":
+		certificate, err = tls.LoadX509KeyPair(tc.ClientCertFile, tc.ClientKeyFile)
+	case tc.ClientCert != "":
+		certificate, err = tls.X509KeyPair([]byte(tc.ClientCert), []byte(tc.ClientKey))
+	default:
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Could not load TLS client certificate")
+	}
+	tlsConfig.Certificates = []tls.Certificate{certificate}
+
+	return nil
+}
@@ -0,0 +1,203 @@
+package cfclient_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Peripli/service-broker-proxy-cf/cf/cfclient"
+	"github.com/Peripli/service-broker-proxy-cf/cf/internal"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func generateClientCertificate() (certPEM, keyPEM []byte, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ShouldNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "service-broker-proxy"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ShouldNot(HaveOccurred())
+	cert, err = x509.ParseCertificate(der)
+	Expect(err).ShouldNot(HaveOccurred())
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).ShouldNot(HaveOccurred())
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, cert
+}
+
+var _ = Describe("TLS", func() {
+	var (
+		serverTLSConfig *tls.Config
+		config          *cfclient.Config
+		serverCAPEM     string
+	)
+
+	BeforeEach(func() {
+		serverTLSConfig = &tls.Config{}
+		config = cfclient.DefaultConfig()
+		// use a dedicated HTTP client, the default one is shared by the tests
+		config.HttpClient = &http.Client{Timeout: 5 * time.Second}
+	})
+
+	JustBeforeEach(func() {
+		ccServer = testhelper.FakeCCTLSServer(false, serverTLSConfig)
+		config.ApiAddress = ccServer.URL()
+		serverCAPEM = string(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: ccServer.HTTPTestServer.Certificate().Raw,
+		}))
+	})
+
+	AfterEach(func() {
+		ccServer.Close()
+		ccServer = nil
+	})
+
+	Context("when the CA of the server is not trusted", func() {
+		It("fails to create the client", func() {
+			_, err := cfclient.NewClient(config)
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+
+	Context("when the CA of the server is provided as PEM", func() {
+		It("creates the client", func() {
+			config.TLS.CACert = serverCAPEM
+			_, err := cfclient.NewClient(config)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Context("when the CA of the server is provided as a file", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "cfclient-tls")
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("creates the client", func() {
+			config.TLS.CACertFile = filepath.Join(dir, "ca.pem")
+			Expect(ioutil.WriteFile(config.TLS.CACertFile, []byte(serverCAPEM), 0600)).To(Succeed())
+
+			_, err := cfclient.NewClient(config)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("returns an error if the file does not exist", func() {
+			config.TLS.CACertFile = filepath.Join(dir, "missing.pem")
+
+			_, err := cfclient.NewClient(config)
+			Expect(err).To(MatchError(ContainSubstring("Could not read TLS CA certificate file")))
+		})
+	})
+
+	Context("when the HTTP client is shared", func() {
+		It("does not change its transport", func() {
+			sharedTransport := &http.Transport{}
+			sharedClient := &http.Client{Timeout: 5 * time.Second, Transport: sharedTransport}
+			config.HttpClient = sharedClient
+			config.TLS.CACert = serverCAPEM
+
+			_, err := cfclient.NewClient(config)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(sharedClient.Transport).To(BeIdenticalTo(sharedTransport))
+
+			otherConfig := cfclient.DefaultConfig()
+			otherConfig.ApiAddress = ccServer.URL()
+			otherConfig.HttpClient = sharedClient
+			_, err = cfclient.NewClient(otherConfig)
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+
+	Context("when the CA certificate is invalid", func() {
+		It("returns an error", func() {
+			config.TLS.CACert = "invalid"
+			_, err := cfclient.NewClient(config)
+			Expect(err).To(MatchError(ContainSubstring("Could not parse any TLS CA certificate")))
+		})
+	})
+
+	Context("when the server requires a client certificate", func() {
+		var certPEM, keyPEM []byte
+
+		BeforeEach(func() {
+			var cert *x509.Certificate
+			certPEM, keyPEM, cert = generateClientCertificate()
+
+			clientCAs := x509.NewCertPool()
+			clientCAs.AddCert(cert)
+			serverTLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			serverTLSConfig.ClientCAs = clientCAs
+		})
+
+		JustBeforeEach(func() {
+			config.TLS.CACert = serverCAPEM
+		})
+
+		It("creates the client if a certificate is configured", func() {
+			config.TLS.ClientCert = string(certPEM)
+			config.TLS.ClientKey = string(keyPEM)
+
+			_, err := cfclient.NewClient(config)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("fails to create the client if no certificate is configured", func() {
+			_, err := cfclient.NewClient(config)
+			Expect(err).Should(HaveOccurred())
+		})
+
+		It("returns an error if the key does not match the certificate", func() {
+			_, otherKeyPEM, _ := generateClientCertificate()
+			config.TLS.ClientCert = string(certPEM)
+			config.TLS.ClientKey = string(otherKeyPEM)
+
+			_, err := cfclient.NewClient(config)
+			Expect(err).To(MatchError(ContainSubstring("Could not load TLS client certificate")))
+		})
+	})
+
+	Context("when the server does not support the minimum TLS version", func() {
+		BeforeEach(func() {
+			serverTLSConfig.MaxVersion = tls.VersionTLS12
+		})
+
+		It("fails to create the client", func() {
+			config.TLS.CACert = serverCAPEM
+			config.TLS.MinVersion = "1.3"
+
+			_, err := cfclient.NewClient(config)
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+})
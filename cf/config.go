@@ -3,6 +3,7 @@ package cf
 
 import (
 	"fmt"
+	"regexp"
 	"time"
 
 	"errors"
@@ -14,6 +15,9 @@ import (
 	"github.com/spf13/pflag"
 )
 
+// labelValuePattern matches the values of metadata labels accepted by Cloud Controller
+var labelValuePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9._-]{0,61}[a-zA-Z0-9])?$`)
+
 // Config type holds config info for building the cf client
 type Config struct {
 	*ClientConfiguration `mapstructure:"client"`
@@ -21,23 +25,84 @@ type Config struct {
 	// CFClientProvider delays the creation of the creation of the CF client as it does remote calls during its creation which should be delayed
 	// until the application is ran.
 	CFClientProvider func(*cfclient.Config) (*cfclient.Client, error) `mapstructure:"-"`
+
+	// JobStoreProvider creates the store in which the pending jobs are persisted. The jobs are kept in memory only if it is missing.
+	JobStoreProvider func(*ClientConfiguration) (JobStore, error) `mapstructure:"-"`
+
+	// DryRun records the CF mutations in a plan exposed at DryRunPlanURL instead of executing them
+	DryRun bool `mapstructure:"dry_run"`
 }
 
 // ClientConfiguration holds cf client configurations
 type ClientConfiguration struct {
 	cfclient.Config `mapstructure:",squash"`
 
-	PageSize        int `mapstructure:"page_size"`
-	ChunkSize       int `mapstructure:"chunk_size"`
-	JobPollTimeout  int `mapstructure:"job_poll_timeout"`
+	PageSize       int `mapstructure:"page_size"`
+	ChunkSize      int `mapstructure:"chunk_size"`
+	JobPollTimeout int `mapstructure:"job_poll_timeout"`
+	// JobPollInterval is the interval in seconds between two polls of a job if JobPollMaxInterval is not set
 	JobPollInterval int `mapstructure:"job_poll_interval"`
+	// JobPollMaxInterval enables backing off the polling of jobs. If it is set, a job is polled again
+	// after JobPollInitialInterval and the interval is doubled after every poll up to JobPollMaxInterval seconds.
+	JobPollMaxInterval int `mapstructure:"job_poll_max_interval"`
+	// JobPollInitialInterval is the interval before the second poll of a job if JobPollMaxInterval is set
+	JobPollInitialInterval time.Duration `mapstructure:"job_poll_initial_interval"`
+	// BulkVisibilities enables loading the visibilities of many plans with a few paginated requests.
+	// Cloud Controllers not supporting it are detected and the visibilities are loaded per plan instead.
+	BulkVisibilities bool `mapstructure:"bulk_visibilities"`
+	// SensitiveFields are JSON paths redacted from the logged request bodies in addition to DefaultSensitiveFields
+	SensitiveFields []string `mapstructure:"sensitive_fields"`
+	// JobStoreFile is the file in which the pending broker jobs are persisted to be resumed after a restart.
+	// The jobs are kept in memory only if it is empty.
+	JobStoreFile string `mapstructure:"job_store_file"`
+	// AdoptExistingBrokers enables taking over brokers registered in CF with the name of a broker registered
+	// by Service Manager, if they are registered with the same URL or with a URL of the proxy
+	AdoptExistingBrokers bool `mapstructure:"adopt_existing_brokers"`
+	// ProxyInstance identifies the proxy in the metadata labels of the brokers it registers. Brokers labeled with
+	// another proxy instance are not managed by the proxy.
+	ProxyInstance string `mapstructure:"proxy_instance"`
+	// BrokerNameTemplate is the text/template of the names of the brokers registered in CF, e.g. sm-{{.Name}}-{{.Env}}.
+	// It must contain {{.Name}}, the name of the broker in Service Manager, exactly once. The names are kept if it is empty.
+	BrokerNameTemplate string `mapstructure:"broker_name_template"`
+	// BrokerNameEnv is the environment used as {{.Env}} in the broker name template
+	BrokerNameEnv string `mapstructure:"broker_name_env"`
+	// BrokerDeletionPolicy is the handling of the deletion of brokers which still have service instances:
+	// fail, revoke_visibilities of the plans and keep the broker, or force the deletion without checking the instances.
+	// The deletion fails if it is empty.
+	BrokerDeletionPolicy BrokerDeletionPolicyValue `mapstructure:"broker_deletion_policy"`
+	// CacheRefresh configures the incremental refreshes of the cached brokers, service offerings and plans
+	CacheRefresh CacheRefreshConfig `mapstructure:"cache_refresh"`
+	// CacheSnapshot configures the snapshots of the cache restored on startup
+	CacheSnapshot CacheSnapshotConfig `mapstructure:"cache_snapshot"`
+}
+
+// CacheRefreshConfig configures how the cache is refreshed on every resync
+type CacheRefreshConfig struct {
+	// FullResetInterval is the interval between two full reloads of the cache. In between only the data
+	// changed since the last refresh is loaded. The cache is fully reloaded on every refresh if it is 0.
+	FullResetInterval time.Duration `mapstructure:"full_reset_interval"`
+	// DeletionCheckInterval is the interval between two listings of the GUIDs of all brokers, service offerings
+	// and plans which detect the data deleted in CF during incremental refreshes
+	DeletionCheckInterval time.Duration `mapstructure:"deletion_check_interval"`
+}
+
+// CacheSnapshotConfig configures the snapshots of the cache which are restored on startup,
+// so that the plans can be resolved before the cache is loaded from CF
+type CacheSnapshotConfig struct {
+	// File is the file in which the snapshots are written. It is empty by default, which disables the snapshots.
+	File string `mapstructure:"file"`
+	// Interval is the interval between two snapshots
+	Interval time.Duration `mapstructure:"interval"`
+	// MaxAge is the age after which a snapshot is not restored anymore, snapshots do not expire if it is 0
+	MaxAge time.Duration `mapstructure:"max_age"`
 }
 
 // Settings type wraps the CF client configuration
 type Settings struct {
 	sbproxy.Settings `mapstructure:",squash"`
 
-	CF *Config `mapstructure:"cf"`
+	CF      *Config          `mapstructure:"cf"`
+	Tracing *TracingSettings `mapstructure:"tracing"`
 }
 
 // DefaultSettings returns the default application settings
@@ -45,6 +110,7 @@ func DefaultSettings() *Settings {
 	return &Settings{
 		Settings: *sbproxy.DefaultSettings(),
 		CF:       DefaultCFConfiguration(),
+		Tracing:  DefaultTracingSettings(),
 	}
 }
 
@@ -53,6 +119,11 @@ func (s *Settings) Validate() error {
 	if err := s.CF.Validate(); err != nil {
 		return err
 	}
+	if s.Tracing != nil {
+		if err := s.Tracing.Validate(); err != nil {
+			return err
+		}
+	}
 
 	return s.Settings.Validate()
 }
@@ -65,13 +136,26 @@ func DefaultCFConfiguration() *Config {
 
 	return &Config{
 		ClientConfiguration: &ClientConfiguration{
-			Config:          *cfClientConfig,
-			PageSize:        100,
-			ChunkSize:       10,
-			JobPollTimeout:  1800,
-			JobPollInterval: 2,
+			Config:                 *cfClientConfig,
+			PageSize:               100,
+			ChunkSize:              10,
+			JobPollTimeout:         1800,
+			JobPollInterval:        2,
+			JobPollMaxInterval:     0,
+			JobPollInitialInterval: 200 * time.Millisecond,
+			BulkVisibilities:       true,
+			BrokerDeletionPolicy:   BrokerDeletionPolicy.FAIL,
+			CacheRefresh: CacheRefreshConfig{
+				FullResetInterval:     time.Hour,
+				DeletionCheckInterval: 5 * time.Minute,
+			},
+			CacheSnapshot: CacheSnapshotConfig{
+				Interval: time.Minute,
+				MaxAge:   time.Hour,
+			},
 		},
 		CFClientProvider: cfclient.NewClient,
+		JobStoreProvider: NewJobStore,
 	}
 }
 
@@ -91,6 +175,30 @@ func (c *Config) Validate() error {
 	if c.PageSize <= 0 || c.PageSize > 500 {
 		return errors.New("CF PageSize must be between 1 and 500 inclusive")
 	}
+	if c.JobPollMaxInterval > 0 && (c.JobPollInitialInterval <= 0 || c.JobPollInitialInterval > time.Duration(c.JobPollMaxInterval)*time.Second) {
+		return errors.New("CF job_poll_initial_interval must be positive and not greater than job_poll_max_interval")
+	}
+	if c.ProxyInstance != "" && !labelValuePattern.MatchString(c.ProxyInstance) {
+		return errors.New("CF proxy_instance must be a valid label value of at most 63 alphanumeric characters, '-', '_' or '.'")
+	}
+	if _, err := newBrokerNamer(c.BrokerNameTemplate, c.BrokerNameEnv); err != nil {
+		return fmt.Errorf("CF client configuration is invalid: %v", err)
+	}
+	switch c.BrokerDeletionPolicy {
+	case "", BrokerDeletionPolicy.FAIL, BrokerDeletionPolicy.REVOKE_VISIBILITIES, BrokerDeletionPolicy.FORCE:
+	default:
+		return fmt.Errorf("CF broker_deletion_policy must be one of %s, %s or %s", BrokerDeletionPolicy.FAIL,
+			BrokerDeletionPolicy.REVOKE_VISIBILITIES, BrokerDeletionPolicy.FORCE)
+	}
+	if c.CacheRefresh.FullResetInterval < 0 || c.CacheRefresh.DeletionCheckInterval < 0 {
+		return errors.New("CF cache_refresh full_reset_interval and deletion_check_interval must not be negative")
+	}
+	if c.CacheSnapshot.File != "" && c.CacheSnapshot.Interval <= 0 {
+		return errors.New("CF cache_snapshot interval must be positive")
+	}
+	if c.CacheSnapshot.MaxAge < 0 {
+		return errors.New("CF cache_snapshot max_age must not be negative")
+	}
 	if c.CFClientProvider == nil {
 		return errors.New("CF ClientCreateFunc missing")
 	}
@@ -100,6 +208,18 @@ func (c *Config) Validate() error {
 	if c.HttpClient != nil && c.HttpClient.Timeout == 0 {
 		return errors.New("CF client configuration timeout missing")
 	}
+	if c.Retry.MaxRetries < 0 {
+		return errors.New("CF client retry max_retries must not be negative")
+	}
+	if c.Retry.MaxRetries > 0 && (c.Retry.InitialInterval <= 0 || c.Retry.MaxInterval < c.Retry.InitialInterval) {
+		return errors.New("CF client retry initial_interval must be positive and not greater than max_interval")
+	}
+	if err := c.TLS.Validate(); err != nil {
+		return fmt.Errorf("CF client configuration is invalid: %v", err)
+	}
+	if c.RateLimit.Threshold < 0 || c.RateLimit.MaxRetries < 0 || c.RateLimit.MaxWait < 0 {
+		return errors.New("CF client rate_limit threshold, max_retries and max_wait must not be negative")
+	}
 	return nil
 }
 
@@ -108,6 +228,7 @@ func NewConfig(env env.Environment) (*Settings, error) {
 	cfSettings := &Settings{
 		Settings: *sbproxy.DefaultSettings(),
 		CF:       DefaultCFConfiguration(),
+		Tracing:  DefaultTracingSettings(),
 	}
 
 	if err := env.Unmarshal(cfSettings); err != nil {
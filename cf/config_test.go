@@ -7,6 +7,7 @@ import (
 	. "github.com/onsi/gomega"
 
 	"fmt"
+	"time"
 
 	"github.com/Peripli/service-broker-proxy-cf/cf"
 	"github.com/Peripli/service-manager/pkg/env/envfakes"
@@ -60,6 +61,93 @@ var _ = Describe("Config", func() {
 			})
 		})
 
+		Context("when retry max retries is negative", func() {
+			It("returns an error", func() {
+				settings.CF.Retry.MaxRetries = -1
+				assertErrorDuringValidate()
+			})
+		})
+
+		Context("when retry initial interval is greater than max interval", func() {
+			It("returns an error", func() {
+				settings.CF.Retry.InitialInterval = settings.CF.Retry.MaxInterval + 1
+				assertErrorDuringValidate()
+			})
+		})
+
+		Context("when rate limit max wait is negative", func() {
+			It("returns an error", func() {
+				settings.CF.RateLimit.MaxWait = -1
+				assertErrorDuringValidate()
+			})
+		})
+
+		Context("when job poll interval is zero", func() {
+			It("returns no error", func() {
+				settings.CF.JobPollInterval = 0
+				assertNoErrorDuringValidate()
+			})
+		})
+
+		Context("when the polling of jobs does not back off", func() {
+			It("does not validate the job poll initial interval", func() {
+				settings.CF.JobPollMaxInterval = 0
+				settings.CF.JobPollInitialInterval = 0
+				assertNoErrorDuringValidate()
+			})
+		})
+
+		Context("when job poll initial interval is greater than job poll max interval", func() {
+			It("returns an error", func() {
+				settings.CF.JobPollMaxInterval = 10
+				settings.CF.JobPollInitialInterval = time.Duration(settings.CF.JobPollMaxInterval)*time.Second + 1
+				assertErrorDuringValidate()
+			})
+		})
+
+		Context("when proxy instance is not a valid label value", func() {
+			It("returns an error", func() {
+				settings.CF.ProxyInstance = "proxy instance"
+				assertErrorDuringValidate()
+			})
+		})
+
+		Context("when broker name template does not contain the name", func() {
+			It("returns an error", func() {
+				settings.CF.BrokerNameTemplate = "sm-{{.Env}}"
+				assertErrorDuringValidate()
+			})
+		})
+
+		Context("when broker deletion policy is unknown", func() {
+			It("returns an error", func() {
+				settings.CF.BrokerDeletionPolicy = "ignore"
+				assertErrorDuringValidate()
+			})
+		})
+
+		Context("when TLS min version is not supported", func() {
+			It("returns an error", func() {
+				settings.CF.TLS.MinVersion = "1.4"
+				assertErrorDuringValidate()
+			})
+		})
+
+		Context("when TLS client certificate is provided without key", func() {
+			It("returns an error", func() {
+				settings.CF.TLS.ClientCertFile = "cert.pem"
+				assertErrorDuringValidate()
+			})
+		})
+
+		Context("when tracing is enabled without an endpoint", func() {
+			It("returns an error", func() {
+				settings.Tracing = cf.DefaultTracingSettings()
+				settings.Tracing.Enabled = true
+				assertErrorDuringValidate()
+			})
+		})
+
 		Context("when shutdown timeout is missing", func() {
 			It("returns an error", func() {
 				settings.CF = nil
@@ -0,0 +1,92 @@
+package cf
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Peripli/service-manager/pkg/log"
+)
+
+// maxDryRunActions limits the number of actions kept in the dry-run plan, the oldest actions are dropped first
+const maxDryRunActions = 10000
+
+type DryRunOperationValue string
+
+// DryRunOperation is the CF mutation recorded in dry-run mode.
+var DryRunOperation = struct {
+	CREATE_BROKER                       DryRunOperationValue
+	UPDATE_BROKER                       DryRunOperationValue
+	DELETE_BROKER                       DryRunOperationValue
+	ADD_ORGANIZATION_VISIBILITIES       DryRunOperationValue
+	REPLACE_ORGANIZATION_VISIBILITIES   DryRunOperationValue
+	DELETE_ORGANIZATION_VISIBILITIES    DryRunOperationValue
+	UPDATE_SERVICE_PLAN_VISIBILITY_TYPE DryRunOperationValue
+}{
+	CREATE_BROKER:                       "create_broker",
+	UPDATE_BROKER:                       "update_broker",
+	DELETE_BROKER:                       "delete_broker",
+	ADD_ORGANIZATION_VISIBILITIES:       "add_organization_visibilities",
+	REPLACE_ORGANIZATION_VISIBILITIES:   "replace_organization_visibilities",
+	DELETE_ORGANIZATION_VISIBILITIES:    "delete_organization_visibilities",
+	UPDATE_SERVICE_PLAN_VISIBILITY_TYPE: "update_service_plan_visibility_type",
+}
+
+// DryRunAction is a CF mutation which the proxy would have executed if it was not running in dry-run mode
+type DryRunAction struct {
+	Time              time.Time            `json:"time"`
+	Operation         DryRunOperationValue `json:"operation"`
+	BrokerGUID        string               `json:"broker_guid,omitempty"`
+	BrokerName        string               `json:"broker_name,omitempty"`
+	BrokerURL         string               `json:"broker_url,omitempty"`
+	PlanGUID          string               `json:"plan_guid,omitempty"`
+	VisibilityType    VisibilityTypeValue  `json:"visibility_type,omitempty"`
+	OrganizationGUIDs []string             `json:"organization_guids,omitempty"`
+}
+
+// DryRunPlan accumulates the CF mutations recorded in dry-run mode
+type DryRunPlan struct {
+	mutex   sync.Mutex
+	actions []DryRunAction
+}
+
+// NewDryRunPlan creates an empty dry-run plan
+func NewDryRunPlan() *DryRunPlan {
+	return &DryRunPlan{}
+}
+
+// Actions returns the recorded actions in the order they were recorded
+func (p *DryRunPlan) Actions() []DryRunAction {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	actions := make([]DryRunAction, len(p.actions))
+	copy(actions, p.actions)
+	return actions
+}
+
+// record adds the action to the plan instead of executing it
+func (p *DryRunPlan) record(ctx context.Context, action DryRunAction) {
+	action.Time = time.Now()
+	log.C(ctx).Infof("Dry run: skipping %s of broker with GUID %s, name %s and URL %s, plan with GUID %s, visibility type %s and organizations %v",
+		action.Operation, action.BrokerGUID, action.BrokerName, action.BrokerURL,
+		action.PlanGUID, action.VisibilityType, action.OrganizationGUIDs)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.actions) >= maxDryRunActions {
+		p.actions = p.actions[1:]
+	}
+	p.actions = append(p.actions, action)
+}
+
+// DryRunPlan returns the CF mutations recorded in dry-run mode
+func (pc *PlatformClient) DryRunPlan() *DryRunPlan {
+	return pc.dryRunPlan
+}
+
+// isDryRun reports whether the CF mutations are recorded instead of executed
+func (pc *PlatformClient) isDryRun() bool {
+	return pc.settings.CF.DryRun
+}
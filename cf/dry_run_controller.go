@@ -0,0 +1,47 @@
+package cf
+
+import (
+	"net/http"
+
+	"github.com/Peripli/service-manager/pkg/util"
+	"github.com/Peripli/service-manager/pkg/web"
+)
+
+// DryRunPlanURL is the path at which the CF mutations recorded in dry-run mode are exposed
+const DryRunPlanURL = "/dry_run/plan"
+
+// DryRunPlanResponse is the response listing the CF mutations recorded in dry-run mode
+type DryRunPlanResponse struct {
+	Actions []DryRunAction `json:"actions"`
+}
+
+// DryRunController exposes the CF mutations recorded in dry-run mode
+type DryRunController struct {
+	Plan *DryRunPlan
+}
+
+// NewDryRunController creates a controller exposing the dry-run plan of the given platform client
+func NewDryRunController(pc *PlatformClient) *DryRunController {
+	return &DryRunController{
+		Plan: pc.DryRunPlan(),
+	}
+}
+
+// Routes implements web.Controller.Routes
+func (c *DryRunController) Routes() []web.Route {
+	return []web.Route{
+		{
+			Endpoint: web.Endpoint{
+				Method: http.MethodGet,
+				Path:   DryRunPlanURL,
+			},
+			Handler: c.getPlan,
+		},
+	}
+}
+
+func (c *DryRunController) getPlan(_ *web.Request) (*web.Response, error) {
+	return util.NewJSONResponse(http.StatusOK, DryRunPlanResponse{
+		Actions: c.Plan.Actions(),
+	})
+}
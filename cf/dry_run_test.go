@@ -0,0 +1,125 @@
+package cf_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/Peripli/service-broker-proxy-cf/cf"
+	"github.com/Peripli/service-broker-proxy-cf/cf/internal"
+	"github.com/Peripli/service-broker-proxy/pkg/platform"
+	"github.com/Peripli/service-manager/pkg/web"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Dry run", func() {
+	var client *cf.PlatformClient
+
+	getPlan := func() cf.DryRunPlanResponse {
+		controller := cf.NewDryRunController(client)
+		routes := controller.Routes()
+		Expect(routes).To(HaveLen(1))
+		Expect(routes[0].Endpoint).To(Equal(web.Endpoint{Method: http.MethodGet, Path: cf.DryRunPlanURL}))
+
+		response, err := routes[0].Handler(&web.Request{Request: httptest.NewRequest(http.MethodGet, cf.DryRunPlanURL, nil)})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		var plan cf.DryRunPlanResponse
+		Expect(json.Unmarshal(response.Body, &plan)).To(Succeed())
+		return plan
+	}
+
+	BeforeEach(func() {
+		var err error
+		ctx = context.TODO()
+		parallelRequestsCounter = 0
+		maxAllowedParallelRequests = 3
+		ccServer = testhelper.FakeCCServer(false)
+		settings := testhelper.CCSettings(ccServer.URL(), maxAllowedParallelRequests, 2)
+		settings.CF.DryRun = true
+		client, err = cf.NewClient(settings)
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		ccServer.Close()
+	})
+
+	It("records the mutations instead of sending them to CC", func() {
+		requestsBefore := len(ccServer.ReceivedRequests())
+
+		broker, err := client.CreateBroker(ctx, &platform.CreateServiceBrokerRequest{
+			Name:      "new-broker",
+			BrokerURL: "http://10.0.2.2/v1/osb/new-broker-id",
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(broker.Name).To(Equal("new-broker"))
+
+		_, err = client.UpdateBroker(ctx, &platform.UpdateServiceBrokerRequest{
+			GUID:      "broker-guid",
+			Name:      "broker",
+			BrokerURL: "http://10.0.2.2/v1/osb/broker-id",
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(client.DeleteBroker(ctx, &platform.DeleteServiceBrokerRequest{GUID: "old-broker-guid", Name: "old-broker"})).To(Succeed())
+		Expect(client.AddOrganizationVisibilities(ctx, "plan-guid", []string{"org1"})).To(Succeed())
+		Expect(client.ReplaceOrganizationVisibilities(ctx, "plan-guid", []string{"org1", "org2"})).To(Succeed())
+		Expect(client.DeleteOrganizationVisibilities(ctx, "plan-guid", "org2")).To(Succeed())
+		Expect(client.UpdateServicePlanVisibilityType(ctx, "plan-guid", cf.VisibilityType.PUBLIC)).To(Succeed())
+
+		Expect(ccServer.ReceivedRequests()).To(HaveLen(requestsBefore))
+
+		actions := getPlan().Actions
+		Expect(actions).To(HaveLen(7))
+		Expect(actions[0].Operation).To(Equal(cf.DryRunOperation.CREATE_BROKER))
+		Expect(actions[0].BrokerName).To(Equal("new-broker"))
+		Expect(actions[1].Operation).To(Equal(cf.DryRunOperation.UPDATE_BROKER))
+		Expect(actions[1].BrokerGUID).To(Equal("broker-guid"))
+		Expect(actions[2].Operation).To(Equal(cf.DryRunOperation.DELETE_BROKER))
+		Expect(actions[2].BrokerGUID).To(Equal("old-broker-guid"))
+		Expect(actions[3].Operation).To(Equal(cf.DryRunOperation.ADD_ORGANIZATION_VISIBILITIES))
+		Expect(actions[3].OrganizationGUIDs).To(Equal([]string{"org1"}))
+		Expect(actions[4].Operation).To(Equal(cf.DryRunOperation.REPLACE_ORGANIZATION_VISIBILITIES))
+		Expect(actions[4].OrganizationGUIDs).To(Equal([]string{"org1", "org2"}))
+		Expect(actions[5].Operation).To(Equal(cf.DryRunOperation.DELETE_ORGANIZATION_VISIBILITIES))
+		Expect(actions[5].OrganizationGUIDs).To(Equal([]string{"org2"}))
+		Expect(actions[6].Operation).To(Equal(cf.DryRunOperation.UPDATE_SERVICE_PLAN_VISIBILITY_TYPE))
+		Expect(actions[6].VisibilityType).To(Equal(cf.VisibilityType.PUBLIC))
+	})
+
+	It("keeps the cached plans of the brokers", func() {
+		brokers := generateCFBrokers(1)
+		serviceOfferings := generateCFServiceOfferings(brokers, 1)
+		setCCBrokersResponse(ccServer, brokers)
+		setCCServiceOfferingsResponse(ccServer, serviceOfferings)
+		plans := generateCFPlans(serviceOfferings, 0, 1)
+		setCCPlansResponse(ccServer, plans)
+		setCCVisibilitiesGetResponse(ccServer, map[string]*cf.ServicePlanVisibilitiesResponse{
+			plans[serviceOfferings[brokers[0].GUID][0].GUID][0].GUID: {Type: string(cf.VisibilityType.PUBLIC)},
+		})
+		Expect(client.ResetCache(ctx)).To(Succeed())
+
+		broker := &platform.ServiceBroker{GUID: brokers[0].GUID, Name: brokers[0].Name, BrokerURL: brokers[0].URL}
+		requestsBefore := len(ccServer.ReceivedRequests())
+		Expect(client.ResetBroker(ctx, broker, false)).To(Succeed())
+		Expect(client.ResetBroker(ctx, broker, true)).To(Succeed())
+		Expect(ccServer.ReceivedRequests()).To(HaveLen(requestsBefore))
+
+		visibilities, err := client.GetVisibilitiesByBrokers(ctx, []string{broker.Name})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(visibilities).To(HaveLen(1))
+	})
+
+	It("still reads from CC", func() {
+		setCCBrokersResponse(ccServer, generateCFBrokers(2))
+
+		brokers, err := client.GetBrokers(ctx)
+
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(brokers).To(HaveLen(2))
+		Expect(getPlan().Actions).To(BeEmpty())
+	})
+})
@@ -59,6 +59,7 @@ var _ = Describe("Client FetchCatalog", func() {
 					Password: brokerPassword,
 				},
 			},
+			Metadata: managedBrokerMetadata(),
 		}
 
 		ccServer.AppendHandlers(
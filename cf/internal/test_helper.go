@@ -1,6 +1,7 @@
 package testhelper
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"github.com/Peripli/service-broker-proxy-cf/cf"
 	"github.com/Peripli/service-broker-proxy-cf/cf/cfclient"
@@ -9,10 +10,22 @@ import (
 	"github.com/onsi/gomega/ghttp"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 func FakeCCServer(allowUnhandled bool) *ghttp.Server {
-	ccServer := ghttp.NewServer()
+	return fakeCCServer(ghttp.NewServer(), allowUnhandled)
+}
+
+// FakeCCTLSServer starts a fake CC server serving HTTPS with the given TLS configuration
+func FakeCCTLSServer(allowUnhandled bool, tlsConfig *tls.Config) *ghttp.Server {
+	ccServer := ghttp.NewUnstartedServer()
+	ccServer.HTTPTestServer.TLS = tlsConfig
+	ccServer.HTTPTestServer.StartTLS()
+	return fakeCCServer(ccServer, allowUnhandled)
+}
+
+func fakeCCServer(ccServer *ghttp.Server, allowUnhandled bool) *ghttp.Server {
 	serverUrl := ccServer.URL()
 
 	v3RootCallResponse, err := json.Marshal(&cfclient.Endpoints{
@@ -66,16 +79,32 @@ func CCClientWithThrottling(
 	maxAllowedParallelRequests int,
 	jobPollTimeout int,
 ) (*cf.Settings, *cf.PlatformClient) {
+	settings := CCSettings(URL, maxAllowedParallelRequests, jobPollTimeout)
+
+	client, err := cf.NewClient(settings)
+	Expect(err).ShouldNot(HaveOccurred())
+	Expect(client).ShouldNot(BeNil())
+	return settings, client
+}
+
+// CCSettings returns valid proxy settings for a CF client connecting to the given URL
+func CCSettings(
+	URL string,
+	maxAllowedParallelRequests int,
+	jobPollTimeout int,
+) *cf.Settings {
 	cfConfig := cfclient.Config{
 		ApiAddress: URL,
 	}
 	config := &cf.Config{
 		ClientConfiguration: &cf.ClientConfiguration{
-			Config:          cfConfig,
-			JobPollTimeout:  jobPollTimeout,
-			JobPollInterval: 1,
-			PageSize:        100,
-			ChunkSize:       10,
+			Config:                 cfConfig,
+			JobPollTimeout:         jobPollTimeout,
+			JobPollInterval:        1,
+			JobPollMaxInterval:     1,
+			JobPollInitialInterval: 100 * time.Millisecond,
+			PageSize:               100,
+			ChunkSize:              10,
 		},
 		CFClientProvider: cfclient.NewClient,
 	}
@@ -89,9 +118,5 @@ func CCClientWithThrottling(
 	settings.Sm.URL = "http://10.0.2.2"
 	settings.Sm.User = "user"
 	settings.Sm.Password = "password"
-
-	client, err := cf.NewClient(settings)
-	Expect(err).ShouldNot(HaveOccurred())
-	Expect(client).ShouldNot(BeNil())
-	return settings, client
+	return settings
 }
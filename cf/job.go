@@ -2,9 +2,12 @@ package cf
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/Peripli/service-broker-proxy/pkg/sbproxy/reconcile"
 	"github.com/Peripli/service-manager/pkg/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
 	"strings"
 	"time"
@@ -39,13 +42,16 @@ var JobFailure = struct {
 	STATUS JobFailureValue
 	// TIMEOUT is when the job polling timeout has been occurred.
 	TIMEOUT JobFailureValue
+	// CANCELLED is when the context of the job polling is done before the job finished.
+	CANCELLED JobFailureValue
 	// UNKNOWN any other unknown reason
 	UNKNOWN JobFailureValue
 }{
-	REQUEST: "REQUEST",
-	STATUS:  "STATUS",
-	TIMEOUT: "TIMEOUT",
-	UNKNOWN: "UNKNOWN",
+	REQUEST:   "REQUEST",
+	STATUS:    "STATUS",
+	TIMEOUT:   "TIMEOUT",
+	CANCELLED: "CANCELLED",
+	UNKNOWN:   "UNKNOWN",
 }
 
 type Job struct {
@@ -79,30 +85,85 @@ type JobErrorDetails struct {
 	Title string `json:"title"`
 }
 
+// JobFailedError is the error of a job which finished with the status FAILED. It carries all details
+// reported by Cloud Controller, e.g. the catalog validation errors of a broker.
+type JobFailedError struct {
+	// JobGUID is the GUID of the failed job.
+	JobGUID string
+	// Operation is the broker operation executed by the job, it is empty for other jobs.
+	Operation JobOperationValue
+	// Errors are the errors reported by the job.
+	Errors []JobErrorDetails
+	// Warnings are the warnings emitted by the job during its processing.
+	Warnings Warnings
+}
+
+// Description returns a readable description of the errors reported by the job
+func (e *JobFailedError) Description() string {
+	if len(e.Errors) == 0 {
+		return "no error details reported by Cloud Controller"
+	}
+
+	descriptions := make([]string, 0, len(e.Errors))
+	for _, details := range e.Errors {
+		descriptions = append(descriptions, fmt.Sprintf("%s (%s, code %d)", details.Detail, details.Title, details.Code))
+	}
+	return strings.Join(descriptions, "; ")
+}
+
+func (e *JobFailedError) Error() string {
+	message := fmt.Sprintf("the job with GUID %s is failed with the error: %s", e.JobGUID, e.Description())
+	if e.Operation != "" {
+		message = fmt.Sprintf("%s operation failed: %s", e.Operation, message)
+	}
+	if len(e.Warnings) > 0 {
+		message = fmt.Sprintf("%s (warnings: %s)", message, strings.Join(e.Warnings, ", "))
+	}
+	return message
+}
+
 // PollJob - keep polling the given job until the job has terminated, an
-// error is encountered, or config.OverallPollingTimeout is reached. In the
-// last case, a JobTimeoutError is returned.
+// error is encountered, the context is done or config.OverallPollingTimeout is reached.
+// The job is polled every config.JobPollInterval seconds. If config.JobPollMaxInterval is set,
+// it is polled again after config.JobPollInitialInterval instead and the interval is doubled
+// after every poll up to config.JobPollMaxInterval seconds. A job which finished with the status
+// FAILED is reported with a JobFailedError.
 func (pc *PlatformClient) PollJob(ctx context.Context, jobURL string) (Warnings, *JobError) {
+	startTime := time.Now()
+	warnings, jobErr := pc.pollJob(ctx, jobURL)
+	pc.metrics.observeJob(jobErr, time.Since(startTime))
+
+	return warnings, jobErr
+}
+
+func (pc *PlatformClient) pollJob(ctx context.Context, jobURL string) (Warnings, *JobError) {
 	var (
 		err      error
 		warnings Warnings
 		job      Job
 	)
 
-	jobPollTimeout := float64(pc.settings.CF.JobPollTimeout)
-	startTime := time.Now()
-	for time.Now().Sub(startTime).Seconds() < jobPollTimeout {
-		_, err = pc.MakeRequest(PlatformClientRequest{
-			CTX:          ctx,
-			URL:          jobURL,
-			Method:       http.MethodGet,
-			ResponseBody: &job,
-		})
+	pollCtx, cancel := context.WithTimeout(ctx, time.Duration(pc.settings.CF.JobPollTimeout)*time.Second)
+	defer cancel()
+
+	interval := time.Duration(pc.settings.CF.JobPollInterval) * time.Second
+	maxInterval := time.Duration(pc.settings.CF.JobPollMaxInterval) * time.Second
+	if maxInterval > 0 {
+		interval = pc.settings.CF.JobPollInitialInterval
+	}
+	for attempt := 1; ; attempt++ {
+		err = pc.getJob(pollCtx, jobURL, attempt, &job)
 
+		// every response of the job lists all its warnings so far
+		warnings = nil
 		for _, warning := range job.Warnings {
 			warnings = append(warnings, warning.Detail)
 		}
 
+		if pollCtx.Err() != nil {
+			break
+		}
+
 		if err != nil {
 			return warnings, &JobError{
 				FailureStatus: JobFailure.REQUEST,
@@ -116,12 +177,30 @@ func (pc *PlatformClient) PollJob(ctx context.Context, jobURL string) (Warnings,
 		case JobState.FAILED:
 			return warnings, &JobError{
 				FailureStatus: JobFailure.STATUS,
-				Error: fmt.Errorf("the job with GUID %s is failed with the error: %v",
-					job.GUID, job.RawErrors),
+				Error: &JobFailedError{
+					JobGUID:  job.GUID,
+					Errors:   job.RawErrors,
+					Warnings: warnings,
+				},
 			}
 		}
 
-		time.Sleep(time.Duration(pc.settings.CF.JobPollInterval) * time.Second)
+		if !waitForNextPoll(pollCtx, interval) {
+			break
+		}
+		if maxInterval == 0 {
+			continue
+		}
+		if interval *= 2; interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+
+	if ctx.Err() != nil {
+		return warnings, &JobError{
+			FailureStatus: JobFailure.CANCELLED,
+			Error:         fmt.Errorf("the polling of the job %s is cancelled: %v", jobURL, ctx.Err()),
+		}
 	}
 
 	return warnings, &JobError{
@@ -131,6 +210,37 @@ func (pc *PlatformClient) PollJob(ctx context.Context, jobURL string) (Warnings,
 	}
 }
 
+// waitForNextPoll waits for the given interval, it returns false if the context is done before
+func waitForNextPoll(ctx context.Context, interval time.Duration) bool {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// getJob loads the current state of the job, every attempt is traced separately
+func (pc *PlatformClient) getJob(ctx context.Context, jobURL string, attempt int, job *Job) (err error) {
+	ctx, span := startSpan(ctx, "PollJob", trace.WithAttributes(
+		attribute.String("cf.job.url", jobURL),
+		attribute.Int("cf.job.attempt", attempt)))
+	defer func() { endSpan(span, err) }()
+
+	_, err = pc.MakeRequest(PlatformClientRequest{
+		CTX:          ctx,
+		URL:          jobURL,
+		Method:       http.MethodGet,
+		ResponseBody: job,
+	})
+	span.SetAttributes(attribute.String("cf.job.state", string(job.State)))
+
+	return err
+}
+
 func (pc *PlatformClient) ScheduleJobPolling(ctx context.Context, jobUrl string) *JobError {
 	jobError := make(chan *JobError, 1)
 	scheduler := reconcile.NewScheduler(ctx, pc.settings.Reconcile.MaxParallelRequests)
@@ -162,3 +272,133 @@ func (pc *PlatformClient) ScheduleJobPolling(ctx context.Context, jobUrl string)
 
 	return nil
 }
+
+// resumedJob is a job left pending by a previous run of the proxy which is being polled again
+type resumedJob struct {
+	PendingJob
+	done chan struct{}
+	err  *JobError
+}
+
+// ResumeJobs resumes in the background the polling of the jobs which were pending when the proxy stopped,
+// and reports the outcome of their broker operations. Operations on the same brokers wait for them to finish.
+func (pc *PlatformClient) ResumeJobs(ctx context.Context) error {
+	jobs, err := pc.jobStore.List()
+	if err != nil {
+		return fmt.Errorf("could not load pending jobs: %v", err)
+	}
+
+	log.C(ctx).Infof("Resuming %d pending jobs", len(jobs))
+	for _, job := range jobs {
+		job := &resumedJob{
+			PendingJob: job,
+			done:       make(chan struct{}),
+		}
+		pc.resumedJobsMutex.Lock()
+		pc.resumedJobs[job.URL] = job
+		pc.resumedJobsMutex.Unlock()
+
+		go pc.resumeJob(ctx, job)
+	}
+
+	return nil
+}
+
+func (pc *PlatformClient) resumeJob(ctx context.Context, job *resumedJob) {
+	logger := log.C(ctx)
+	defer func() {
+		pc.resumedJobsMutex.Lock()
+		delete(pc.resumedJobs, job.URL)
+		pc.resumedJobsMutex.Unlock()
+		close(job.done)
+	}()
+
+	logger.Infof("Resume polling job url: %s, for %s operation of broker with name %s started at %s",
+		job.URL, job.Operation, job.BrokerName, job.StartedAt)
+	job.err = pc.ScheduleJobPolling(ctx, job.URL)
+	setJobOperation(job.err, job.Operation)
+	if ctx.Err() != nil {
+		// the job is resumed again on the next start
+		logger.Infof("Stopped polling job url: %s: %v", job.URL, ctx.Err())
+		return
+	}
+	pc.untrackJob(ctx, job.URL)
+
+	if job.err != nil {
+		logger.Errorf("Resumed %s operation of broker with name %s failed: %v",
+			job.Operation, job.BrokerName, job.err.Error)
+		return
+	}
+	if job.Operation == JobOperation.CREATE_BROKER {
+		broker, err := pc.GetBrokerByName(ctx, job.BrokerName)
+		if err != nil {
+			logger.Errorf("Resumed %s operation of broker with name %s completed, but the broker could not be retrieved: %v",
+				job.Operation, job.BrokerName, err)
+			return
+		}
+		job.BrokerGUID = broker.GUID
+	}
+	logger.Infof("Resumed %s operation of broker with name %s and GUID %s completed",
+		job.Operation, job.BrokerName, job.BrokerGUID)
+}
+
+// awaitResumedJob waits for the resumed job matching the given predicate to finish.
+// It returns nil if no such job is being polled.
+func (pc *PlatformClient) awaitResumedJob(ctx context.Context, matches func(job PendingJob) bool) (*resumedJob, error) {
+	var found *resumedJob
+	pc.resumedJobsMutex.Lock()
+	for _, job := range pc.resumedJobs {
+		if matches(job.PendingJob) {
+			found = job
+			break
+		}
+	}
+	pc.resumedJobsMutex.Unlock()
+
+	if found == nil {
+		return nil, nil
+	}
+
+	log.C(ctx).Infof("Waiting for resumed job url: %s, for %s operation of broker with name %s",
+		found.URL, found.Operation, found.BrokerName)
+	select {
+	case <-found.done:
+		return found, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// trackJob persists the pending job, so that it is resumed if the proxy restarts while it is polled
+func (pc *PlatformClient) trackJob(ctx context.Context, job PendingJob) {
+	if err := pc.jobStore.Save(job); err != nil {
+		log.C(ctx).Warnf("Could not persist job url: %s, it will not be resumed after a restart: %v", job.URL, err)
+	}
+}
+
+// untrackJob removes the job from the persisted pending jobs once it is no longer polled
+func (pc *PlatformClient) untrackJob(ctx context.Context, jobURL string) {
+	if err := pc.jobStore.Delete(jobURL); err != nil {
+		log.C(ctx).Warnf("Could not remove persisted job url: %s: %v", jobURL, err)
+	}
+}
+
+// pollBrokerJob polls the job of a broker operation, keeping it persisted while it is pending
+func (pc *PlatformClient) pollBrokerJob(ctx context.Context, job PendingJob) *JobError {
+	pc.trackJob(ctx, job)
+	jobErr := pc.ScheduleJobPolling(ctx, job.URL)
+	if ctx.Err() == nil {
+		pc.untrackJob(ctx, job.URL)
+	}
+	setJobOperation(jobErr, job.Operation)
+
+	return jobErr
+}
+
+// setJobOperation records the broker operation executed by the job in the error of a failed job
+func setJobOperation(jobErr *JobError, operation JobOperationValue) {
+	var failedErr *JobFailedError
+	if jobErr != nil && errors.As(jobErr.Error, &failedErr) {
+		failedErr.Operation = operation
+	}
+}
@@ -0,0 +1,217 @@
+package cf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type JobOperationValue string
+
+// JobOperation is the broker operation an asynchronous job is executing.
+var JobOperation = struct {
+	// CREATE_BROKER is when the job registers a new broker.
+	CREATE_BROKER JobOperationValue
+	// UPDATE_BROKER is when the job updates a broker registration.
+	UPDATE_BROKER JobOperationValue
+	// DELETE_BROKER is when the job deletes a broker registration.
+	DELETE_BROKER JobOperationValue
+}{
+	CREATE_BROKER: "create_broker",
+	UPDATE_BROKER: "update_broker",
+	DELETE_BROKER: "delete_broker",
+}
+
+// PendingJob is an asynchronous Cloud Controller job which is still being polled by the proxy
+type PendingJob struct {
+	// URL is the path of the job in Cloud Controller.
+	URL string `json:"url"`
+	// Operation is the broker operation executed by the job.
+	Operation JobOperationValue `json:"operation"`
+	// BrokerGUID is the GUID of the broker, it is empty for brokers being created.
+	BrokerGUID string `json:"broker_guid,omitempty"`
+	// BrokerName is the name of the broker.
+	BrokerName string `json:"broker_name"`
+	// StartedAt is the time at which the operation started.
+	StartedAt time.Time `json:"started_at"`
+}
+
+// JobStore persists the pending jobs, so that they can be resumed after a restart of the proxy
+type JobStore interface {
+	// Save stores the job, replacing a job with the same URL
+	Save(job PendingJob) error
+	// Delete removes the job with the given URL
+	Delete(jobURL string) error
+	// List returns all stored jobs ordered by their start time
+	List() ([]PendingJob, error)
+}
+
+// NewJobStore creates the job store configured by the client configuration: a file based one if a
+// job store file is configured and an in-memory one otherwise
+func NewJobStore(config *ClientConfiguration) (JobStore, error) {
+	if config.JobStoreFile == "" {
+		return NewMemoryJobStore(), nil
+	}
+	return NewFileJobStore(config.JobStoreFile)
+}
+
+// memoryJobStore keeps the pending jobs in memory only, they are lost on restart
+type memoryJobStore struct {
+	mutex sync.Mutex
+	jobs  map[string]PendingJob
+}
+
+// NewMemoryJobStore creates a job store which does not persist the jobs
+func NewMemoryJobStore() JobStore {
+	return &memoryJobStore{jobs: make(map[string]PendingJob)}
+}
+
+func (s *memoryJobStore) Save(job PendingJob) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.jobs[job.URL] = job
+	return nil
+}
+
+func (s *memoryJobStore) Delete(jobURL string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.jobs, jobURL)
+	return nil
+}
+
+func (s *memoryJobStore) List() ([]PendingJob, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return sortedJobs(s.jobs), nil
+}
+
+// fileJobStore keeps the pending jobs in a JSON file
+type fileJobStore struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// NewFileJobStore creates a job store persisting the jobs in the file with the given path.
+// The file and its directory are created when the first job is saved.
+func NewFileJobStore(path string) (JobStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("job store file missing")
+	}
+	store := &fileJobStore{path: path}
+	if _, err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *fileJobStore) Save(job PendingJob) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	jobs, err := s.load()
+	if err != nil {
+		return err
+	}
+	jobs[job.URL] = job
+	return s.store(jobs)
+}
+
+func (s *fileJobStore) Delete(jobURL string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	jobs, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, found := jobs[jobURL]; !found {
+		return nil
+	}
+	delete(jobs, jobURL)
+	return s.store(jobs)
+}
+
+func (s *fileJobStore) List() ([]PendingJob, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	jobs, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return sortedJobs(jobs), nil
+}
+
+func (s *fileJobStore) load() (map[string]PendingJob, error) {
+	jobs := make(map[string]PendingJob)
+	content, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return jobs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read job store file %s: %v", s.path, err)
+	}
+
+	var storedJobs []PendingJob
+	if err := json.Unmarshal(content, &storedJobs); err != nil {
+		return nil, fmt.Errorf("could not parse job store file %s: %v", s.path, err)
+	}
+	for _, job := range storedJobs {
+		jobs[job.URL] = job
+	}
+	return jobs, nil
+}
+
+func (s *fileJobStore) store(jobs map[string]PendingJob) error {
+	content, err := json.Marshal(sortedJobs(jobs))
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(s.path, content); err != nil {
+		return fmt.Errorf("could not write job store file %s: %v", s.path, err)
+	}
+	return nil
+}
+
+// writeFileAtomically replaces the content of the file atomically, so that a crash does not leave a partially
+// written file. The directory of the file is created if it does not exist.
+func writeFileAtomically(path string, content []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tempFile, err := ioutil.TempFile(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.Write(content); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), path)
+}
+
+func sortedJobs(jobs map[string]PendingJob) []PendingJob {
+	result := make([]PendingJob, 0, len(jobs))
+	for _, job := range jobs {
+		result = append(result, job)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartedAt.Before(result[j].StartedAt)
+	})
+	return result
+}
@@ -0,0 +1,113 @@
+package cf_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Peripli/service-broker-proxy-cf/cf"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FileJobStore", func() {
+	var (
+		dir       string
+		storePath string
+		store     cf.JobStore
+		err       error
+		firstJob  cf.PendingJob
+		secondJob cf.PendingJob
+	)
+
+	BeforeEach(func() {
+		dir, err = ioutil.TempDir("", "job-store")
+		Expect(err).ShouldNot(HaveOccurred())
+		storePath = filepath.Join(dir, "jobs", "jobs.json")
+
+		store, err = cf.NewFileJobStore(storePath)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		startedAt := time.Now().UTC().Truncate(time.Second)
+		firstJob = cf.PendingJob{
+			URL:        "/v3/jobs/first",
+			Operation:  cf.JobOperation.CREATE_BROKER,
+			BrokerName: "first-broker",
+			StartedAt:  startedAt,
+		}
+		secondJob = cf.PendingJob{
+			URL:        "/v3/jobs/second",
+			Operation:  cf.JobOperation.DELETE_BROKER,
+			BrokerGUID: "second-broker-guid",
+			BrokerName: "second-broker",
+			StartedAt:  startedAt.Add(time.Second),
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	Context("when no job is saved", func() {
+		It("lists no jobs", func() {
+			jobs, err := store.List()
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(jobs).To(BeEmpty())
+		})
+	})
+
+	Context("when jobs are saved", func() {
+		BeforeEach(func() {
+			Expect(store.Save(secondJob)).To(Succeed())
+			Expect(store.Save(firstJob)).To(Succeed())
+		})
+
+		It("lists them ordered by start time", func() {
+			jobs, err := store.List()
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(jobs).To(Equal([]cf.PendingJob{firstJob, secondJob}))
+		})
+
+		It("keeps them for a new store using the same file", func() {
+			newStore, err := cf.NewFileJobStore(storePath)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			jobs, err := newStore.List()
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(jobs).To(Equal([]cf.PendingJob{firstJob, secondJob}))
+		})
+
+		It("does not list deleted jobs", func() {
+			Expect(store.Delete(firstJob.URL)).To(Succeed())
+			Expect(store.Delete("/v3/jobs/unknown")).To(Succeed())
+
+			jobs, err := store.List()
+
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(jobs).To(Equal([]cf.PendingJob{secondJob}))
+		})
+	})
+
+	Context("when the file is corrupted", func() {
+		It("returns an error", func() {
+			Expect(os.MkdirAll(filepath.Dir(storePath), 0700)).To(Succeed())
+			Expect(ioutil.WriteFile(storePath, []byte("{"), 0600)).To(Succeed())
+
+			_, err := cf.NewFileJobStore(storePath)
+
+			Expect(err).To(MatchError(ContainSubstring("could not parse job store file")))
+		})
+	})
+})
+
+var _ = Describe("NewJobStore", func() {
+	It("keeps the jobs in memory by default", func() {
+		store, err := cf.NewJobStore(cf.DefaultCFConfiguration().ClientConfiguration)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(store).To(Equal(cf.NewMemoryJobStore()))
+	})
+})
@@ -2,13 +2,17 @@ package cf_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/Peripli/service-broker-proxy-cf/cf"
 	"github.com/Peripli/service-broker-proxy-cf/cf/internal"
+	"github.com/Peripli/service-broker-proxy/pkg/platform"
 	"github.com/gofrs/uuid"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
+	"net/http"
+	"time"
 )
 
 var _ = Describe("job", func() {
@@ -64,6 +68,68 @@ var _ = Describe("job", func() {
 			})
 		})
 
+		Context("when the job completes shortly after it started", func() {
+			It("polls it again before the maximum interval elapsed", func() {
+				polls := 0
+				ccServer.RouteToHandler(http.MethodGet, fmt.Sprintf("/v3/jobs/%s", jobGUID.String()), func(rw http.ResponseWriter, req *http.Request) {
+					polls++
+					state := cf.JobState.PROCESSING
+					if polls > 1 {
+						state = cf.JobState.COMPLETE
+					}
+					writeJSONResponse(cf.Job{GUID: jobGUID.String(), State: state}, rw)
+				})
+
+				startTime := time.Now()
+				_, jobError = client.PollJob(ctx, fmt.Sprintf("/v3/jobs/%s", jobGUID.String()))
+
+				Expect(jobError).To(BeNil())
+				Expect(polls).To(Equal(2))
+				Expect(time.Since(startTime)).To(BeNumerically("<", time.Second))
+			})
+		})
+
+		Context("when the polling of jobs does not back off", func() {
+			It("polls the job every job poll interval", func() {
+				settings := testhelper.CCSettings(ccServer.URL(), maxAllowedParallelRequests, JobPollTimeout)
+				settings.CF.JobPollMaxInterval = 0
+				client, err = cf.NewClient(settings)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				polls := 0
+				ccServer.RouteToHandler(http.MethodGet, fmt.Sprintf("/v3/jobs/%s", jobGUID.String()), func(rw http.ResponseWriter, req *http.Request) {
+					polls++
+					state := cf.JobState.PROCESSING
+					if polls > 1 {
+						state = cf.JobState.COMPLETE
+					}
+					writeJSONResponse(cf.Job{GUID: jobGUID.String(), State: state}, rw)
+				})
+
+				startTime := time.Now()
+				_, jobError = client.PollJob(ctx, fmt.Sprintf("/v3/jobs/%s", jobGUID.String()))
+
+				Expect(jobError).To(BeNil())
+				Expect(polls).To(Equal(2))
+				Expect(time.Since(startTime)).To(BeNumerically(">=", time.Duration(settings.CF.JobPollInterval)*time.Second))
+			})
+		})
+
+		Context("when the context is cancelled", func() {
+			It("stops polling and returns a cancellation error", func() {
+				setCCJobResponse(ccServer, false, cf.JobState.PROCESSING)
+				cancelCtx, cancel := context.WithCancel(ctx)
+				time.AfterFunc(300*time.Millisecond, cancel)
+
+				startTime := time.Now()
+				_, jobError = client.PollJob(cancelCtx, fmt.Sprintf("/v3/jobs/%s", jobGUID.String()))
+
+				Expect(jobError.FailureStatus).To(Equal(cf.JobFailure.CANCELLED))
+				Expect(jobError.Error).To(MatchError(ContainSubstring("is cancelled")))
+				Expect(time.Since(startTime)).To(BeNumerically("<", time.Second))
+			})
+		})
+
 		Context("when the job failed", func() {
 			It("should return error", func() {
 				setCCJobResponse(ccServer, false, cf.JobState.FAILED)
@@ -75,6 +141,60 @@ var _ = Describe("job", func() {
 			})
 		})
 
+		Context("when the failed job reports errors and warnings", func() {
+			It("returns them in a JobFailedError", func() {
+				jobErrors := []cf.JobErrorDetails{
+					{Code: 270012, Title: "CF-ServiceBrokerCatalogInvalid", Detail: "Service broker catalog is invalid: plan ids must be unique"},
+					{Code: 10001, Title: "CF-UnknownError", Detail: "An unknown error occurred"},
+				}
+				ccServer.RouteToHandler(http.MethodGet, fmt.Sprintf("/v3/jobs/%s", jobGUID.String()), func(rw http.ResponseWriter, req *http.Request) {
+					writeJSONResponse(cf.Job{
+						GUID:      jobGUID.String(),
+						State:     cf.JobState.FAILED,
+						RawErrors: jobErrors,
+						Warnings:  []cf.JobWarning{{Detail: "catalog warning"}},
+					}, rw)
+				})
+
+				_, jobError = client.PollJob(ctx, fmt.Sprintf("/v3/jobs/%s", jobGUID.String()))
+
+				var failedErr *cf.JobFailedError
+				Expect(errors.As(jobError.Error, &failedErr)).To(BeTrue())
+				Expect(failedErr.JobGUID).To(Equal(jobGUID.String()))
+				Expect(failedErr.Errors).To(Equal(jobErrors))
+				Expect(failedErr.Warnings).To(Equal(cf.Warnings{"catalog warning"}))
+				Expect(failedErr.Description()).To(Equal(
+					"Service broker catalog is invalid: plan ids must be unique (CF-ServiceBrokerCatalogInvalid, code 270012); " +
+						"An unknown error occurred (CF-UnknownError, code 10001)"))
+			})
+		})
+
+		Context("when the job reports warnings in every poll", func() {
+			It("returns each warning once", func() {
+				polls := 0
+				ccServer.RouteToHandler(http.MethodGet, fmt.Sprintf("/v3/jobs/%s", jobGUID.String()), func(rw http.ResponseWriter, req *http.Request) {
+					polls++
+					job := cf.Job{
+						GUID:     jobGUID.String(),
+						State:    cf.JobState.PROCESSING,
+						Warnings: []cf.JobWarning{{Detail: "catalog warning"}},
+					}
+					if polls > 2 {
+						job.State = cf.JobState.FAILED
+						job.Warnings = append(job.Warnings, cf.JobWarning{Detail: "plan warning"})
+					}
+					writeJSONResponse(job, rw)
+				})
+
+				_, jobError = client.PollJob(ctx, fmt.Sprintf("/v3/jobs/%s", jobGUID.String()))
+
+				var failedErr *cf.JobFailedError
+				Expect(errors.As(jobError.Error, &failedErr)).To(BeTrue())
+				Expect(polls).To(Equal(3))
+				Expect(failedErr.Warnings).To(Equal(cf.Warnings{"catalog warning", "plan warning"}))
+			})
+		})
+
 		Context("when the get job request failed", func() {
 			It("should return error", func() {
 				setCCJobResponse(ccServer, true, cf.JobState.FAILED)
@@ -102,7 +222,103 @@ var _ = Describe("job", func() {
 
 				Expect(jobError.FailureStatus).To(Equal(cf.JobFailure.STATUS))
 				Expect(jobError.Error.Error()).To(Equal(
-					fmt.Sprintf("the job with GUID %s is failed with the error: []", jobGUID)))
+					fmt.Sprintf("the job with GUID %s is failed with the error: no error details reported by Cloud Controller", jobGUID)))
+			})
+		})
+	})
+
+	Describe("ResumeJobs", func() {
+		var (
+			jobStore   cf.JobStore
+			pendingJob cf.PendingJob
+			ccBroker   *cf.CCServiceBroker
+		)
+
+		BeforeEach(func() {
+			ccBroker = &cf.CCServiceBroker{
+				GUID: "resumed-broker-guid",
+				Name: "resumed-broker",
+				URL:  "http://10.0.2.2/v1/osb/resumed-broker",
+			}
+			pendingJob = cf.PendingJob{
+				URL:        fmt.Sprintf("/v3/jobs/%s", jobGUID.String()),
+				Operation:  cf.JobOperation.CREATE_BROKER,
+				BrokerName: ccBroker.Name,
+				StartedAt:  time.Now(),
+			}
+
+			jobStore = cf.NewMemoryJobStore()
+			Expect(jobStore.Save(pendingJob)).To(Succeed())
+
+			settings := testhelper.CCSettings(ccServer.URL(), maxAllowedParallelRequests, JobPollTimeout)
+			settings.CF.JobStoreProvider = func(*cf.ClientConfiguration) (cf.JobStore, error) {
+				return jobStore, nil
+			}
+			client, err = cf.NewClient(settings)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		pendingJobs := func() []cf.PendingJob {
+			jobs, err := jobStore.List()
+			Expect(err).ShouldNot(HaveOccurred())
+			return jobs
+		}
+
+		Context("when the pending job completes", func() {
+			BeforeEach(func() {
+				setCCJobResponse(ccServer, false, cf.JobState.COMPLETE)
+				setCCBrokersResponse(ccServer, []*cf.CCServiceBroker{ccBroker})
+			})
+
+			It("removes the job from the store", func() {
+				Expect(client.ResumeJobs(ctx)).To(Succeed())
+
+				Eventually(pendingJobs).Should(BeEmpty())
+			})
+
+			It("returns the broker created by the job instead of creating it again", func() {
+				Expect(client.ResumeJobs(ctx)).To(Succeed())
+
+				broker, err := client.CreateBroker(ctx, &platform.CreateServiceBrokerRequest{
+					Name:      ccBroker.Name,
+					BrokerURL: ccBroker.URL,
+				})
+
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(broker.GUID).To(Equal(ccBroker.GUID))
+				Expect(pendingJobs()).To(BeEmpty())
+			})
+		})
+
+		Context("when the pending job fails", func() {
+			It("removes the job from the store and reports the failure", func() {
+				setCCJobResponse(ccServer, false, cf.JobState.FAILED)
+
+				Expect(client.ResumeJobs(ctx)).To(Succeed())
+
+				Eventually(pendingJobs).Should(BeEmpty())
+				Eventually(logInterceptor.String).Should(ContainSubstring(
+					fmt.Sprintf("Resumed %s operation of broker with name %s failed", pendingJob.Operation, ccBroker.Name)))
+			})
+		})
+
+		Context("when a new broker job is polled", func() {
+			It("removes it from the store once it completed", func() {
+				setCCJobResponse(ccServer, false, cf.JobState.COMPLETE)
+				ccServer.RouteToHandler(http.MethodDelete, "/v3/service_brokers/"+ccBroker.GUID, func(rw http.ResponseWriter, req *http.Request) {
+					rw.Header().Set("Location", "/v3/jobs/delete-job")
+					rw.WriteHeader(http.StatusAccepted)
+				})
+				Expect(jobStore.Delete(pendingJob.URL)).To(Succeed())
+				setCCServiceOfferingsResponse(ccServer, map[string][]*cf.CCServiceOffering{})
+
+				err := client.DeleteBroker(ctx, &platform.DeleteServiceBrokerRequest{
+					GUID: ccBroker.GUID,
+					Name: ccBroker.Name,
+				})
+
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(pendingJobs()).To(BeEmpty())
 			})
 		})
 	})
@@ -0,0 +1,133 @@
+package cf
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Peripli/service-broker-proxy-cf/cf/cfclient"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "sbproxy"
+	metricsSubsystem = "cf"
+
+	// jobCompleted is the result label of successfully completed jobs
+	jobCompleted = "COMPLETE"
+	// requestFailed is the status label of requests which got no response from Cloud Controller
+	requestFailed = "error"
+)
+
+// Metrics holds the Prometheus collectors instrumenting the interactions of the proxy with Cloud Controller
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	jobDuration     *prometheus.HistogramVec
+}
+
+func newMetrics(client *cfclient.Client, planResolver *PlanResolver) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "requests_total",
+			Help:      "Number of requests sent to Cloud Controller",
+		}, []string{"method", "path", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "request_duration_seconds",
+			Help:      "Duration of the requests sent to Cloud Controller, including their retries",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "path", "status"}),
+		jobDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "job_duration_seconds",
+			Help:      "Duration of polling Cloud Controller jobs until they finished",
+			Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+		}, []string{"result"}),
+	}
+
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.jobDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "cached_brokers",
+			Help:      "Number of brokers in the cache of the proxy",
+		}, func() float64 {
+			brokers, _ := planResolver.Size()
+			return float64(brokers)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "cached_plans",
+			Help:      "Number of plans in the cache of the proxy",
+		}, func() float64 {
+			_, plans := planResolver.Size()
+			return float64(plans)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "reauthentications_total",
+			Help:      "Number of times the proxy authenticated again because its token was rejected",
+		}, func() float64 {
+			return float64(client.Reauthentications())
+		}),
+	)
+
+	return m
+}
+
+// Gatherer returns the gatherer collecting the metrics
+func (m *Metrics) Gatherer() prometheus.Gatherer {
+	return m.registry
+}
+
+func (m *Metrics) observeRequest(method, requestURL string, statusCode int, duration time.Duration) {
+	status := requestFailed
+	if statusCode != 0 {
+		status = strconv.Itoa(statusCode)
+	}
+	path := ccPathTemplate(requestURL)
+
+	m.requests.WithLabelValues(method, path, status).Inc()
+	m.requestDuration.WithLabelValues(method, path, status).Observe(duration.Seconds())
+}
+
+func (m *Metrics) observeJob(jobErr *JobError, duration time.Duration) {
+	result := jobCompleted
+	if jobErr != nil {
+		result = string(jobErr.FailureStatus)
+	}
+
+	m.jobDuration.WithLabelValues(result).Observe(duration.Seconds())
+}
+
+// ccPathTemplate returns the path of the given Cloud Controller URL with its GUIDs replaced by a placeholder,
+// e.g. /v3/service_plans/:guid/visibility, so that it can be used as a metric label
+func ccPathTemplate(requestURL string) string {
+	path := requestURL
+	if u, err := url.Parse(requestURL); err == nil {
+		path = u.Path
+	}
+
+	// the paths of Cloud Controller alternate between resource collections and GUIDs after the API version
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 2; i < len(segments); i += 2 {
+		segments[i] = ":guid"
+	}
+	return "/" + strings.Join(segments, "/")
+}
@@ -0,0 +1,60 @@
+package cf
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/Peripli/service-manager/pkg/web"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// MetricsURL is the path at which the metrics of the proxy are exposed
+const MetricsURL = "/metrics"
+
+// MetricsController exposes the collected metrics in the Prometheus exposition format
+type MetricsController struct {
+	Gatherer prometheus.Gatherer
+}
+
+// NewMetricsController creates a controller exposing the metrics of the given platform client
+func NewMetricsController(pc *PlatformClient) *MetricsController {
+	return &MetricsController{
+		Gatherer: pc.Metrics().Gatherer(),
+	}
+}
+
+// Routes implements web.Controller.Routes
+func (c *MetricsController) Routes() []web.Route {
+	return []web.Route{
+		{
+			Endpoint: web.Endpoint{
+				Method: http.MethodGet,
+				Path:   MetricsURL,
+			},
+			Handler: c.getMetrics,
+		},
+	}
+}
+
+func (c *MetricsController) getMetrics(r *web.Request) (*web.Response, error) {
+	metricFamilies, err := c.Gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	format := expfmt.Negotiate(r.Header)
+	buf := bytes.NewBuffer(nil)
+	encoder := expfmt.NewEncoder(buf, format)
+	for _, metricFamily := range metricFamilies {
+		if err := encoder.Encode(metricFamily); err != nil {
+			return nil, err
+		}
+	}
+
+	return &web.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{string(format)}},
+		Body:       buf.Bytes(),
+	}, nil
+}
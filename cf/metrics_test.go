@@ -0,0 +1,97 @@
+package cf_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/Peripli/service-broker-proxy-cf/cf"
+	"github.com/Peripli/service-broker-proxy-cf/cf/internal"
+	"github.com/Peripli/service-manager/pkg/web"
+	"github.com/gofrs/uuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	var (
+		client  *cf.PlatformClient
+		jobGUID uuid.UUID
+	)
+
+	getMetrics := func() string {
+		controller := cf.NewMetricsController(client)
+		routes := controller.Routes()
+		Expect(routes).To(HaveLen(1))
+		Expect(routes[0].Endpoint).To(Equal(web.Endpoint{Method: http.MethodGet, Path: cf.MetricsURL}))
+
+		response, err := routes[0].Handler(&web.Request{Request: httptest.NewRequest(http.MethodGet, cf.MetricsURL, nil)})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		return string(response.Body)
+	}
+
+	BeforeEach(func() {
+		var err error
+		ctx = context.TODO()
+		jobGUID, err = uuid.NewV4()
+		Expect(err).ShouldNot(HaveOccurred())
+
+		parallelRequestsCounter = 0
+		maxAllowedParallelRequests = 3
+		ccServer = testhelper.FakeCCServer(false)
+		_, client = testhelper.CCClientWithThrottling(ccServer.URL(), maxAllowedParallelRequests, 2)
+	})
+
+	AfterEach(func() {
+		if ccServer != nil {
+			ccServer.Close()
+			ccServer = nil
+		}
+	})
+
+	Context("when a job completes", func() {
+		It("counts the requests by path template and the job by result", func() {
+			setCCJobResponse(ccServer, false, cf.JobState.COMPLETE)
+			_, jobErr := client.PollJob(ctx, fmt.Sprintf("/v3/jobs/%s", jobGUID))
+			Expect(jobErr).To(BeNil())
+
+			metrics := getMetrics()
+			Expect(metrics).To(ContainSubstring(`sbproxy_cf_requests_total{method="GET",path="/v3/jobs/:guid",status="200"} 1`))
+			Expect(metrics).To(ContainSubstring(`sbproxy_cf_request_duration_seconds_count{method="GET",path="/v3/jobs/:guid",status="200"} 1`))
+			Expect(metrics).To(ContainSubstring(`sbproxy_cf_job_duration_seconds_count{result="COMPLETE"} 1`))
+		})
+	})
+
+	Context("when a request fails", func() {
+		It("labels the request with the status code of the response", func() {
+			setCCJobResponse(ccServer, true, cf.JobState.COMPLETE)
+			_, jobErr := client.PollJob(ctx, fmt.Sprintf("/v3/jobs/%s", jobGUID))
+			Expect(jobErr).ToNot(BeNil())
+
+			metrics := getMetrics()
+			Expect(metrics).To(ContainSubstring(`sbproxy_cf_requests_total{method="GET",path="/v3/jobs/:guid",status="500"} 1`))
+			Expect(metrics).To(ContainSubstring(`sbproxy_cf_job_duration_seconds_count{result="REQUEST"} 1`))
+		})
+	})
+
+	Context("when the cache is loaded", func() {
+		It("reports the number of cached brokers and plans", func() {
+			brokers := generateCFBrokers(2)
+			serviceOfferings := generateCFServiceOfferings(brokers, 2)
+			plans := generateCFPlans(serviceOfferings, 3, 1)
+			setCCBrokersResponse(ccServer, brokers)
+			setCCServiceOfferingsResponse(ccServer, serviceOfferings)
+			setCCPlansResponse(ccServer, plans)
+
+			Expect(client.ResetCache(ctx)).To(Succeed())
+
+			metrics := getMetrics()
+			Expect(metrics).To(ContainSubstring("sbproxy_cf_cached_brokers 2\n"))
+			Expect(metrics).To(ContainSubstring(fmt.Sprintf("sbproxy_cf_cached_plans %d\n", 2*2*(3+1))))
+			Expect(metrics).To(ContainSubstring(`sbproxy_cf_requests_total{method="GET",path="/v3/service_brokers",status="200"}`))
+			Expect(metrics).To(ContainSubstring("sbproxy_cf_reauthentications_total 0\n"))
+		})
+	})
+})
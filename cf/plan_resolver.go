@@ -3,6 +3,7 @@ package cf
 import (
 	"context"
 	"github.com/Peripli/service-broker-proxy/pkg/platform"
+	"time"
 
 	"github.com/Peripli/service-manager/pkg/log"
 	"sync"
@@ -14,31 +15,85 @@ type PlanData struct {
 	BrokerName    string
 	CatalogPlanID string
 	Public        bool
+	// VisibilityType is the visibility type of the plan in CF, Public is set if it is public
+	VisibilityType VisibilityTypeValue
 }
 
 // PlanMap maps plan GUID to PlanData
 type PlanMap map[string]PlanData
 
+// planKey locates a plan in the plans of the PlanResolver
+type planKey struct {
+	brokerGUID    string
+	catalogPlanID string
+}
+
+// CacheChanges are the changes of the data in CF since the last sync of a PlanResolver
+type CacheChanges struct {
+	// Brokers, ServiceOfferings and Plans were created or updated since the last sync. All the service offerings
+	// and plans of the Brokers are included, they replace the cached ones.
+	Brokers          []platform.ServiceBroker
+	ServiceOfferings []ServiceOffering
+	Plans            []ServicePlan
+	// UnmanagedBrokerGUIDs are the GUIDs of the brokers updated since the last sync which are not managed
+	// by Service Manager, the cached data of the ones which were managed before is dropped
+	UnmanagedBrokerGUIDs []string
+	// ExistingGUIDs contains the GUIDs of all brokers in CF and of the service offerings and plans of the
+	// cached brokers and of the Brokers, the cached data missing from it was deleted.
+	// It is nil if the deletions were not checked.
+	ExistingGUIDs map[string]bool
+}
+
 // PlanResolver provides functions for locating service plans based on data loaded from CF
 // It just stores the data and provides querying in a thread-safe way
 // It does not perform any data fetching
 type PlanResolver struct {
 	mutex sync.RWMutex
 
-	// brokerPlans maps broker name to its plans
-	brokerPlans map[string][]PlanData
+	// brokerPlans maps broker GUID and catalog plan ID to the plan
+	brokerPlans map[string]map[string]PlanData
+	// brokerGUIDs maps broker name to broker GUID
+	brokerGUIDs map[string]string
+	// planKeys maps plan GUID to the broker GUID and catalog plan ID of the plan in brokerPlans
+	planKeys map[string]planKey
+	// unindexedPlans are the GUIDs of the plans whose service offering or broker is not loaded yet
+	unindexedPlans map[string]bool
+
+	// brokers, serviceOfferings and plans map GUIDs to the data loaded from CF, the indexes above are kept up to date
+	// with them. They are kept to apply the changes loaded by incremental syncs.
+	brokers          map[string]platform.ServiceBroker
+	serviceOfferings map[string]ServiceOffering
+	plans            map[string]ServicePlan
+	// brokerServiceOfferings maps broker GUID to the GUIDs of its loaded service offerings and
+	// serviceOfferingPlans maps service offering GUID to the GUIDs of its loaded plans,
+	// so that the data of a broker is deleted without scanning the data of all brokers
+	brokerServiceOfferings map[string]map[string]bool
+	serviceOfferingPlans   map[string]map[string]bool
+
+	lastSync          time.Time
+	lastFullSync      time.Time
+	lastDeletionCheck time.Time
 }
 
 // NewPlanResolver constructs a new NewPlanResolver
 func NewPlanResolver() *PlanResolver {
 	return &PlanResolver{
-		brokerPlans: map[string][]PlanData{},
+		brokerPlans:            map[string]map[string]PlanData{},
+		brokerGUIDs:            map[string]string{},
+		planKeys:               map[string]planKey{},
+		unindexedPlans:         map[string]bool{},
+		brokers:                map[string]platform.ServiceBroker{},
+		serviceOfferings:       map[string]ServiceOffering{},
+		plans:                  map[string]ServicePlan{},
+		brokerServiceOfferings: map[string]map[string]bool{},
+		serviceOfferingPlans:   map[string]map[string]bool{},
 	}
 }
 
-// Reset replaces all the data
+// Reset replaces all the data with the data loaded from CF at the given sync time
 func (r *PlanResolver) Reset(
 	ctx context.Context,
+	syncTime time.Time,
 	brokers []platform.ServiceBroker,
 	serviceOfferings []ServiceOffering,
 	plans []ServicePlan,
@@ -46,61 +101,358 @@ func (r *PlanResolver) Reset(
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	logger := log.C(ctx)
+	r.clear(len(brokers), len(serviceOfferings), len(plans))
+	r.apply(ctx, brokers, serviceOfferings, plans)
 
-	r.brokerPlans = make(map[string][]PlanData, len(brokers))
+	r.lastSync = syncTime
+	r.lastFullSync = syncTime
+	r.lastDeletionCheck = syncTime
+}
 
-	brokerMap := make(map[string]*platform.ServiceBroker, len(brokers))
-	for i, broker := range brokers {
-		brokerMap[broker.GUID] = &brokers[i]
+// Update applies the changes loaded from CF since the last sync at the given sync time
+func (r *PlanResolver) Update(ctx context.Context, syncTime time.Time, changes CacheChanges) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, brokerGUID := range changes.UnmanagedBrokerGUIDs {
+		r.deleteBrokerGUID(brokerGUID)
+	}
+	// the service offerings and plans removed from the catalogs of the changed brokers are not listed anymore
+	for _, broker := range changes.Brokers {
+		r.deleteBrokerGUID(broker.GUID)
+	}
+	// the GUIDs are listed after the changes, so the changed data missing from them was deleted meanwhile
+	r.apply(ctx, changes.Brokers, changes.ServiceOfferings, changes.Plans)
+	if changes.ExistingGUIDs != nil {
+		for guid := range r.brokers {
+			if !changes.ExistingGUIDs[guid] {
+				r.deleteBrokerGUID(guid)
+			}
+		}
+		for guid := range r.serviceOfferings {
+			if !changes.ExistingGUIDs[guid] {
+				r.deleteServiceOffering(guid)
+			}
+		}
+		for guid, plan := range r.plans {
+			if !changes.ExistingGUIDs[guid] {
+				r.deletePlan(guid)
+			} else if _, found := r.serviceOfferings[plan.ServiceOfferingGuid]; !found {
+				r.unindexPlan(guid)
+				r.unindexedPlans[guid] = true
+			}
+		}
+		r.lastDeletionCheck = syncTime
 	}
 
-	serviceOfferingsMap := make(map[string]*ServiceOffering, len(serviceOfferings))
-	for i, serviceOffering := range serviceOfferings {
-		serviceOfferingsMap[serviceOffering.GUID] = &serviceOfferings[i]
+	// the service offerings and brokers of the plans not indexed so far may have been loaded now
+	for guid := range r.unindexedPlans {
+		if r.indexPlan(r.plans[guid]) {
+			delete(r.unindexedPlans, guid)
+		}
 	}
 
+	r.lastSync = syncTime
+}
+
+// Snapshot returns the data loaded from CF and the times at which it was synced
+func (r *PlanResolver) Snapshot() PlanResolverSnapshot {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	snapshot := PlanResolverSnapshot{
+		Version:           PlanResolverSnapshotVersion,
+		CreatedAt:         time.Now(),
+		LastSync:          r.lastSync,
+		LastFullSync:      r.lastFullSync,
+		LastDeletionCheck: r.lastDeletionCheck,
+		Brokers:           make([]platform.ServiceBroker, 0, len(r.brokers)),
+		ServiceOfferings:  make([]ServiceOffering, 0, len(r.serviceOfferings)),
+		Plans:             make([]ServicePlan, 0, len(r.plans)),
+	}
+	for _, broker := range r.brokers {
+		snapshot.Brokers = append(snapshot.Brokers, broker)
+	}
+	for _, serviceOffering := range r.serviceOfferings {
+		snapshot.ServiceOfferings = append(snapshot.ServiceOfferings, serviceOffering)
+	}
+	for _, plan := range r.plans {
+		snapshot.Plans = append(snapshot.Plans, plan)
+	}
+	return snapshot
+}
+
+// Restore replaces all the data with the data of the snapshot
+func (r *PlanResolver) Restore(ctx context.Context, snapshot PlanResolverSnapshot) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.clear(len(snapshot.Brokers), len(snapshot.ServiceOfferings), len(snapshot.Plans))
+	r.apply(ctx, snapshot.Brokers, snapshot.ServiceOfferings, snapshot.Plans)
+
+	r.lastSync = snapshot.LastSync
+	r.lastFullSync = snapshot.LastFullSync
+	r.lastDeletionCheck = snapshot.LastDeletionCheck
+}
+
+// BrokerGUIDs returns the GUIDs of the brokers loaded from CF
+func (r *PlanResolver) BrokerGUIDs() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	guids := make([]string, 0, len(r.brokers))
+	for guid := range r.brokers {
+		guids = append(guids, guid)
+	}
+	return guids
+}
+
+// SyncTimes returns the times of the last sync, of the last full sync and of the last check for deleted data.
+// They are zero if the data was never loaded.
+func (r *PlanResolver) SyncTimes() (lastSync, lastFullSync, lastDeletionCheck time.Time) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.lastSync, r.lastFullSync, r.lastDeletionCheck
+}
+
+// clear drops all the data and the indexes
+func (r *PlanResolver) clear(brokers, serviceOfferings, plans int) {
+	r.brokers = make(map[string]platform.ServiceBroker, brokers)
+	r.serviceOfferings = make(map[string]ServiceOffering, serviceOfferings)
+	r.plans = make(map[string]ServicePlan, plans)
+	r.brokerPlans = make(map[string]map[string]PlanData, brokers)
+	r.brokerGUIDs = make(map[string]string, brokers)
+	r.planKeys = make(map[string]planKey, plans)
+	r.unindexedPlans = map[string]bool{}
+	r.brokerServiceOfferings = make(map[string]map[string]bool, brokers)
+	r.serviceOfferingPlans = make(map[string]map[string]bool, serviceOfferings)
+}
+
+// apply stores the data loaded from CF and indexes the given brokers and plans
+func (r *PlanResolver) apply(ctx context.Context, brokers []platform.ServiceBroker, serviceOfferings []ServiceOffering, plans []ServicePlan) {
+	logger := log.C(ctx)
+
+	for _, broker := range brokers {
+		r.setBroker(broker)
+	}
+	for _, serviceOffering := range serviceOfferings {
+		r.setServiceOffering(serviceOffering)
+	}
 	for _, plan := range plans {
-		serviceOffering := serviceOfferingsMap[plan.ServiceOfferingGuid]
-		if serviceOffering == nil {
+		r.setPlan(plan)
+		if r.indexPlan(plan) {
+			delete(r.unindexedPlans, plan.GUID)
+			continue
+		}
+		r.unindexedPlans[plan.GUID] = true
+		serviceOffering, found := r.serviceOfferings[plan.ServiceOfferingGuid]
+		if !found {
 			logger.Errorf("Service Offering with GUID %s not found for plan with GUID %s",
 				plan.ServiceOfferingGuid, plan.GUID)
 			continue
 		}
-		broker := brokerMap[serviceOffering.ServiceBrokerGuid]
-		if broker == nil {
-			logger.Errorf("Service broker with GUID %s not found for service with GUID %s",
-				serviceOffering.ServiceBrokerGuid, serviceOffering.GUID)
-			continue
+		logger.Errorf("Service broker with GUID %s not found for service with GUID %s",
+			serviceOffering.ServiceBrokerGuid, serviceOffering.GUID)
+	}
+}
+
+// setBroker stores the broker, indexes it by its name and updates the broker name of its indexed plans
+func (r *PlanResolver) setBroker(broker platform.ServiceBroker) {
+	if previous, found := r.brokers[broker.GUID]; found && r.brokerGUIDs[previous.Name] == broker.GUID {
+		delete(r.brokerGUIDs, previous.Name)
+	}
+	r.brokers[broker.GUID] = broker
+	r.brokerGUIDs[broker.Name] = broker.GUID
+
+	plans := r.brokerPlans[broker.GUID]
+	for catalogPlanID, plan := range plans {
+		if plan.BrokerName != broker.Name {
+			plan.BrokerName = broker.Name
+			plans[catalogPlanID] = plan
 		}
-		r.brokerPlans[broker.Name] = append(r.brokerPlans[broker.Name], PlanData{
-			GUID:          plan.GUID,
-			BrokerName:    broker.Name,
-			CatalogPlanID: plan.CatalogPlanId,
-			Public:        plan.Public,
-		})
 	}
 }
 
+// setServiceOffering stores the service offering and adds it to the service offerings of its broker
+func (r *PlanResolver) setServiceOffering(serviceOffering ServiceOffering) {
+	if previous, found := r.serviceOfferings[serviceOffering.GUID]; found {
+		removeFromSet(r.brokerServiceOfferings, previous.ServiceBrokerGuid, serviceOffering.GUID)
+	}
+	r.serviceOfferings[serviceOffering.GUID] = serviceOffering
+	addToSet(r.brokerServiceOfferings, serviceOffering.ServiceBrokerGuid, serviceOffering.GUID)
+}
+
+// deleteServiceOffering deletes the service offering with the given GUID, its plans are kept
+func (r *PlanResolver) deleteServiceOffering(serviceOfferingGUID string) {
+	if serviceOffering, found := r.serviceOfferings[serviceOfferingGUID]; found {
+		removeFromSet(r.brokerServiceOfferings, serviceOffering.ServiceBrokerGuid, serviceOfferingGUID)
+	}
+	delete(r.serviceOfferings, serviceOfferingGUID)
+}
+
+// setPlan stores the plan and adds it to the plans of its service offering
+func (r *PlanResolver) setPlan(plan ServicePlan) {
+	if previous, found := r.plans[plan.GUID]; found {
+		removeFromSet(r.serviceOfferingPlans, previous.ServiceOfferingGuid, plan.GUID)
+	}
+	r.plans[plan.GUID] = plan
+	addToSet(r.serviceOfferingPlans, plan.ServiceOfferingGuid, plan.GUID)
+}
+
+func addToSet(sets map[string]map[string]bool, key, guid string) {
+	set, found := sets[key]
+	if !found {
+		set = make(map[string]bool)
+		sets[key] = set
+	}
+	set[guid] = true
+}
+
+func removeFromSet(sets map[string]map[string]bool, key, guid string) {
+	set := sets[key]
+	delete(set, guid)
+	if len(set) == 0 {
+		delete(sets, key)
+	}
+}
+
+// indexPlan indexes the plan by its broker and catalog plan ID and by its GUID, replacing its previous entries.
+// It reports false if the service offering or the broker of the plan is not loaded.
+func (r *PlanResolver) indexPlan(plan ServicePlan) bool {
+	r.unindexPlan(plan.GUID)
+
+	serviceOffering, found := r.serviceOfferings[plan.ServiceOfferingGuid]
+	if !found {
+		return false
+	}
+	broker, found := r.brokers[serviceOffering.ServiceBrokerGuid]
+	if !found {
+		return false
+	}
+
+	plans, found := r.brokerPlans[broker.GUID]
+	if !found {
+		plans = make(map[string]PlanData)
+		r.brokerPlans[broker.GUID] = plans
+	}
+	plans[plan.CatalogPlanId] = PlanData{
+		GUID:           plan.GUID,
+		BrokerName:     broker.Name,
+		CatalogPlanID:  plan.CatalogPlanId,
+		Public:         plan.Public,
+		VisibilityType: plan.VisibilityType,
+	}
+	r.planKeys[plan.GUID] = planKey{brokerGUID: broker.GUID, catalogPlanID: plan.CatalogPlanId}
+	return true
+}
+
+// unindexPlan removes the plan with the given GUID from the indexes
+func (r *PlanResolver) unindexPlan(planGUID string) {
+	key, found := r.planKeys[planGUID]
+	if !found {
+		return
+	}
+	delete(r.planKeys, planGUID)
+
+	plans := r.brokerPlans[key.brokerGUID]
+	if plan, found := plans[key.catalogPlanID]; found && plan.GUID == planGUID {
+		delete(plans, key.catalogPlanID)
+	}
+	if len(plans) == 0 {
+		delete(r.brokerPlans, key.brokerGUID)
+	}
+}
+
+// deletePlan deletes the plan with the given GUID
+func (r *PlanResolver) deletePlan(planGUID string) {
+	r.unindexPlan(planGUID)
+	delete(r.unindexedPlans, planGUID)
+	if plan, found := r.plans[planGUID]; found {
+		removeFromSet(r.serviceOfferingPlans, plan.ServiceOfferingGuid, planGUID)
+	}
+	delete(r.plans, planGUID)
+}
+
 // ResetBroker replaces the data for a particular broker
-func (r *PlanResolver) ResetBroker(brokerName string, plans []ServicePlan) {
+func (r *PlanResolver) ResetBroker(
+	ctx context.Context,
+	broker platform.ServiceBroker,
+	serviceOfferings []ServiceOffering,
+	plans []ServicePlan,
+) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	r.deleteBroker(brokerName)
+	r.deleteBroker(broker.Name)
+	r.deleteBrokerGUID(broker.GUID)
 
+	serviceOfferingGUIDs := make(map[string]bool, len(serviceOfferings))
+	for _, serviceOffering := range serviceOfferings {
+		serviceOfferingGUIDs[serviceOffering.GUID] = true
+	}
+	var brokerPlans []ServicePlan
 	for _, plan := range plans {
-		r.brokerPlans[brokerName] = append(r.brokerPlans[brokerName], PlanData{
-			GUID:          plan.GUID,
-			BrokerName:    brokerName,
-			CatalogPlanID: plan.CatalogPlanId,
-			Public:        plan.Public,
-		})
+		if serviceOfferingGUIDs[plan.ServiceOfferingGuid] {
+			brokerPlans = append(brokerPlans, plan)
+		}
 	}
+
+	r.apply(ctx, []platform.ServiceBroker{broker}, serviceOfferings, brokerPlans)
 }
 
+// deleteBroker deletes the broker with the given name together with its service offerings and plans
 func (r *PlanResolver) deleteBroker(brokerName string) {
-	delete(r.brokerPlans, brokerName)
+	if brokerGUID, found := r.brokerGUIDs[brokerName]; found {
+		r.deleteBrokerGUID(brokerGUID)
+	}
+}
+
+// deleteBrokerGUID deletes the broker with the given GUID together with its service offerings and plans
+func (r *PlanResolver) deleteBrokerGUID(brokerGUID string) {
+	if broker, found := r.brokers[brokerGUID]; found && r.brokerGUIDs[broker.Name] == brokerGUID {
+		delete(r.brokerGUIDs, broker.Name)
+	}
+	delete(r.brokers, brokerGUID)
+	for serviceOfferingGUID := range r.brokerServiceOfferings[brokerGUID] {
+		for planGUID := range r.serviceOfferingPlans[serviceOfferingGUID] {
+			r.deletePlan(planGUID)
+		}
+		r.deleteServiceOffering(serviceOfferingGUID)
+	}
+}
+
+// RenameBroker moves the data of the broker with the given GUID to the given name, so that its plans are
+// found by the new name without reloading them
+func (r *PlanResolver) RenameBroker(brokerGUID, brokerName string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	broker, found := r.brokers[brokerGUID]
+	if !found || broker.Name == brokerName {
+		return
+	}
+
+	broker.Name = brokerName
+	r.setBroker(broker)
+}
+
+// BrokerName returns the name of the broker with the given GUID
+func (r *PlanResolver) BrokerName(brokerGUID string) (string, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	broker, found := r.brokers[brokerGUID]
+	return broker.Name, found
+}
+
+// BrokerGUID returns the GUID of the broker with the given name
+func (r *PlanResolver) BrokerGUID(brokerName string) (string, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	brokerGUID, found := r.brokerGUIDs[brokerName]
+	return brokerGUID, found
 }
 
 // DeleteBroker deletes the data for a particular broker
@@ -116,12 +468,21 @@ func (r *PlanResolver) GetPlan(catalogPlanID, brokerName string) (PlanData, bool
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 
-	for _, plan := range r.brokerPlans[brokerName] {
-		if plan.CatalogPlanID == catalogPlanID {
-			return plan, true
-		}
+	plan, found := r.brokerPlans[r.brokerGUIDs[brokerName]][catalogPlanID]
+	return plan, found
+}
+
+// GetPlanByGUID returns the plan with the given GUID in CF
+func (r *PlanResolver) GetPlanByGUID(planGUID string) (PlanData, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	key, found := r.planKeys[planGUID]
+	if !found {
+		return PlanData{}, false
 	}
-	return PlanData{}, false
+	plan, found := r.brokerPlans[key.brokerGUID][key.catalogPlanID]
+	return plan, found
 }
 
 // GetBrokerPlans returns all the plans from brokers with given names
@@ -131,23 +492,61 @@ func (r *PlanResolver) GetBrokerPlans(brokerNames []string) PlanMap {
 
 	plans := PlanMap{}
 	for _, brokerName := range brokerNames {
-		for _, plan := range r.brokerPlans[brokerName] {
+		brokerGUID, found := r.brokerGUIDs[brokerName]
+		if !found {
+			continue
+		}
+		for _, plan := range r.brokerPlans[brokerGUID] {
 			plans[plan.GUID] = plan
 		}
 	}
 	return plans
 }
 
-// UpdatePlan updates the public property of the given plan
+// Size returns the number of cached brokers and plans
+func (r *PlanResolver) Size() (brokers int, plans int) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return len(r.brokers), len(r.planKeys)
+}
+
+// UpdatePlan updates the public property of the given plan.
+// Use UpdatePlanVisibilityType to keep the visibility type of the plan up to date as well.
 func (r *PlanResolver) UpdatePlan(catalogPlanID, brokerName string, public bool) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	plans := r.brokerPlans[brokerName]
-	for i, plan := range plans {
-		if plan.CatalogPlanID == catalogPlanID {
-			plans[i].Public = public
-			return
-		}
+	r.updatePlan(catalogPlanID, brokerName, func(plan *ServicePlan) {
+		plan.Public = public
+	})
+}
+
+// UpdatePlanVisibilityType updates the visibility type and the public property of the given plan
+func (r *PlanResolver) UpdatePlanVisibilityType(catalogPlanID, brokerName string, visibilityType VisibilityTypeValue) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.updatePlan(catalogPlanID, brokerName, func(plan *ServicePlan) {
+		plan.VisibilityType = visibilityType
+		plan.Public = visibilityType == VisibilityType.PUBLIC
+	})
+}
+
+// updatePlan updates the plan loaded from CF, so that the update is kept when the indexes are rebuilt,
+// and the indexed plan
+func (r *PlanResolver) updatePlan(catalogPlanID, brokerName string, update func(*ServicePlan)) {
+	brokerGUID := r.brokerGUIDs[brokerName]
+	indexedPlan, found := r.brokerPlans[brokerGUID][catalogPlanID]
+	if !found {
+		return
 	}
+
+	plan := r.plans[indexedPlan.GUID]
+	update(&plan)
+	r.plans[indexedPlan.GUID] = plan
+
+	indexedPlan.Public = plan.Public
+	indexedPlan.VisibilityType = plan.VisibilityType
+	r.brokerPlans[brokerGUID][catalogPlanID] = indexedPlan
 }
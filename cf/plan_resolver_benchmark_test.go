@@ -0,0 +1,242 @@
+package cf_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Peripli/service-broker-proxy-cf/cf"
+	"github.com/Peripli/service-broker-proxy/pkg/platform"
+)
+
+// planResolverBenchmarkSizes are the numbers of plans of the broker in the benchmarks.
+// The time per operation of the indexed lookups does not depend on them.
+var planResolverBenchmarkSizes = []int{10, 100, 1000, 10000}
+
+// planResolverBenchmarkBrokers are the numbers of cached brokers in the benchmarks of the changes of one broker.
+// The time per operation of the changes does not depend on them.
+var planResolverBenchmarkBrokers = []int{10, 100, 1000}
+
+// planResolverBenchmarkBrokerPlans is the number of plans of every broker in the benchmarks of the changes of one broker
+const planResolverBenchmarkBrokerPlans = 100
+
+func newBenchmarkData(brokersCount, plansCount int) ([]platform.ServiceBroker, []cf.ServiceOffering, []cf.ServicePlan) {
+	brokers := make([]platform.ServiceBroker, 0, brokersCount)
+	serviceOfferings := make([]cf.ServiceOffering, 0, brokersCount)
+	plans := make([]cf.ServicePlan, 0, brokersCount*plansCount)
+	for b := 0; b < brokersCount; b++ {
+		broker := platform.ServiceBroker{GUID: fmt.Sprintf("broker-guid-%d", b), Name: fmt.Sprintf("broker-%d", b)}
+		serviceOffering := cf.ServiceOffering{GUID: fmt.Sprintf("service-guid-%d", b), ServiceBrokerGuid: broker.GUID}
+		for i := 0; i < plansCount; i++ {
+			plans = append(plans, cf.ServicePlan{
+				GUID:                fmt.Sprintf("plan-guid-%d-%d", b, i),
+				CatalogPlanId:       fmt.Sprintf("plan-catalog-id-%d", i),
+				ServiceOfferingGuid: serviceOffering.GUID,
+			})
+		}
+		brokers = append(brokers, broker)
+		serviceOfferings = append(serviceOfferings, serviceOffering)
+	}
+	return brokers, serviceOfferings, plans
+}
+
+func newBenchmarkPlanResolver(plansCount int) *cf.PlanResolver {
+	brokers, serviceOfferings, plans := newBenchmarkData(1, plansCount)
+	resolver := cf.NewPlanResolver()
+	resolver.Reset(context.Background(), time.Now(), brokers, serviceOfferings, plans)
+	return resolver
+}
+
+// scanPlanResolver looks up and resets the plans the way the resolver did before it indexed them:
+// by scanning the plans of the broker and by replacing the plans of the broker
+type scanPlanResolver struct {
+	mutex       sync.RWMutex
+	brokerPlans map[string][]cf.PlanData
+}
+
+func newBenchmarkScanPlanResolver(plansCount int) *scanPlanResolver {
+	_, _, plans := newBenchmarkData(1, plansCount)
+	resolver := &scanPlanResolver{brokerPlans: map[string][]cf.PlanData{}}
+	for _, plan := range plans {
+		resolver.brokerPlans["broker-0"] = append(resolver.brokerPlans["broker-0"], cf.PlanData{
+			GUID:          plan.GUID,
+			BrokerName:    "broker-0",
+			CatalogPlanID: plan.CatalogPlanId,
+		})
+	}
+	return resolver
+}
+
+func (r *scanPlanResolver) ResetBroker(brokerName string, plans []cf.ServicePlan) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.brokerPlans, brokerName)
+	for _, plan := range plans {
+		r.brokerPlans[brokerName] = append(r.brokerPlans[brokerName], cf.PlanData{
+			GUID:          plan.GUID,
+			BrokerName:    brokerName,
+			CatalogPlanID: plan.CatalogPlanId,
+			Public:        plan.Public,
+		})
+	}
+}
+
+func (r *scanPlanResolver) GetPlan(catalogPlanID, brokerName string) (cf.PlanData, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, plan := range r.brokerPlans[brokerName] {
+		if plan.CatalogPlanID == catalogPlanID {
+			return plan, true
+		}
+	}
+	return cf.PlanData{}, false
+}
+
+func (r *scanPlanResolver) GetPlanByGUID(planGUID string) (cf.PlanData, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, plans := range r.brokerPlans {
+		for _, plan := range plans {
+			if plan.GUID == planGUID {
+				return plan, true
+			}
+		}
+	}
+	return cf.PlanData{}, false
+}
+
+func (r *scanPlanResolver) UpdatePlanVisibilityType(catalogPlanID, brokerName string, visibilityType cf.VisibilityTypeValue) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	plans := r.brokerPlans[brokerName]
+	for i, plan := range plans {
+		if plan.CatalogPlanID == catalogPlanID {
+			plans[i].VisibilityType = visibilityType
+			plans[i].Public = visibilityType == cf.VisibilityType.PUBLIC
+			return
+		}
+	}
+}
+
+func BenchmarkPlanResolverGetPlan(b *testing.B) {
+	for _, size := range planResolverBenchmarkSizes {
+		catalogPlanID := fmt.Sprintf("plan-catalog-id-%d", size-1)
+		b.Run(fmt.Sprintf("indexed/plans=%d", size), func(b *testing.B) {
+			resolver := newBenchmarkPlanResolver(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, found := resolver.GetPlan(catalogPlanID, "broker-0"); !found {
+					b.Fatalf("plan %s not found", catalogPlanID)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("scan/plans=%d", size), func(b *testing.B) {
+			resolver := newBenchmarkScanPlanResolver(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, found := resolver.GetPlan(catalogPlanID, "broker-0"); !found {
+					b.Fatalf("plan %s not found", catalogPlanID)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPlanResolverGetPlanByGUID(b *testing.B) {
+	for _, size := range planResolverBenchmarkSizes {
+		planGUID := fmt.Sprintf("plan-guid-0-%d", size-1)
+		b.Run(fmt.Sprintf("indexed/plans=%d", size), func(b *testing.B) {
+			resolver := newBenchmarkPlanResolver(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, found := resolver.GetPlanByGUID(planGUID); !found {
+					b.Fatalf("plan %s not found", planGUID)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("scan/plans=%d", size), func(b *testing.B) {
+			resolver := newBenchmarkScanPlanResolver(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, found := resolver.GetPlanByGUID(planGUID); !found {
+					b.Fatalf("plan %s not found", planGUID)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPlanResolverUpdatePlanVisibilityType(b *testing.B) {
+	for _, size := range planResolverBenchmarkSizes {
+		catalogPlanID := fmt.Sprintf("plan-catalog-id-%d", size-1)
+		b.Run(fmt.Sprintf("indexed/plans=%d", size), func(b *testing.B) {
+			resolver := newBenchmarkPlanResolver(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resolver.UpdatePlanVisibilityType(catalogPlanID, "broker-0", cf.VisibilityType.PUBLIC)
+			}
+		})
+		b.Run(fmt.Sprintf("scan/plans=%d", size), func(b *testing.B) {
+			resolver := newBenchmarkScanPlanResolver(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resolver.UpdatePlanVisibilityType(catalogPlanID, "broker-0", cf.VisibilityType.PUBLIC)
+			}
+		})
+	}
+}
+
+// BenchmarkPlanResolverResetBroker compares resetting one of many brokers with replacing the plans of the broker,
+// which is what resetting a broker did before the service offerings and plans were kept for the incremental syncs
+func BenchmarkPlanResolverResetBroker(b *testing.B) {
+	for _, brokersCount := range planResolverBenchmarkBrokers {
+		ctx := context.Background()
+		brokers, serviceOfferings, plans := newBenchmarkData(brokersCount, planResolverBenchmarkBrokerPlans)
+		brokerPlans := plans[:planResolverBenchmarkBrokerPlans]
+		b.Run(fmt.Sprintf("indexed/brokers=%d", brokersCount), func(b *testing.B) {
+			resolver := cf.NewPlanResolver()
+			resolver.Reset(ctx, time.Now(), brokers, serviceOfferings, plans)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resolver.ResetBroker(ctx, brokers[0], serviceOfferings[:1], brokerPlans)
+			}
+		})
+		b.Run(fmt.Sprintf("scan/brokers=%d", brokersCount), func(b *testing.B) {
+			resolver := &scanPlanResolver{brokerPlans: map[string][]cf.PlanData{}}
+			for i, broker := range brokers {
+				resolver.ResetBroker(broker.Name, plans[i*planResolverBenchmarkBrokerPlans:(i+1)*planResolverBenchmarkBrokerPlans])
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resolver.ResetBroker(brokers[0].Name, brokerPlans)
+			}
+		})
+	}
+}
+
+// BenchmarkPlanResolverUpdate measures applying the changes of one of many brokers
+func BenchmarkPlanResolverUpdate(b *testing.B) {
+	for _, brokersCount := range planResolverBenchmarkBrokers {
+		ctx := context.Background()
+		brokers, serviceOfferings, plans := newBenchmarkData(brokersCount, planResolverBenchmarkBrokerPlans)
+		changes := cf.CacheChanges{
+			Brokers:          brokers[:1],
+			ServiceOfferings: serviceOfferings[:1],
+			Plans:            plans[:planResolverBenchmarkBrokerPlans],
+		}
+		b.Run(fmt.Sprintf("indexed/brokers=%d", brokersCount), func(b *testing.B) {
+			resolver := cf.NewPlanResolver()
+			resolver.Reset(ctx, time.Now(), brokers, serviceOfferings, plans)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resolver.Update(ctx, time.Now(), changes)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/Peripli/service-broker-proxy/pkg/platform"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"time"
 )
 
 var _ = Describe("PlanResolver", func() {
@@ -31,7 +32,7 @@ var _ = Describe("PlanResolver", func() {
 			allServiceOfferings = append(allServiceOfferings, b.serviceOfferings...)
 			allPlans = append(allPlans, b.plans...)
 		}
-		resolver.Reset(ctx, allBrokers, allServiceOfferings, allPlans)
+		resolver.Reset(ctx, time.Now(), allBrokers, allServiceOfferings, allPlans)
 	}
 
 	BeforeEach(func() {
@@ -171,7 +172,9 @@ var _ = Describe("PlanResolver", func() {
 			}))
 
 			resolver.ResetBroker(
-				broker1.broker.Name,
+				ctx,
+				broker1.broker,
+				broker1.serviceOfferings,
 				[]cf.ServicePlan{
 					{GUID: "b1-s1-p2-id", Name: "b1-s1-p2", ServiceOfferingGuid: "b1-s1-id", CatalogPlanId: "s1-p2-cid"},
 				},
@@ -187,6 +190,213 @@ var _ = Describe("PlanResolver", func() {
 		})
 	})
 
+	Describe("GetPlanByGUID", func() {
+		BeforeEach(func() {
+			resetResolver(broker1, broker2)
+		})
+
+		It("returns the plan with the given GUID", func() {
+			plan, found := resolver.GetPlanByGUID("b2-s1-p2-id")
+			Expect(found).To(BeTrue())
+			Expect(plan).To(Equal(cf.PlanData{
+				GUID: "b2-s1-p2-id", BrokerName: "b2", CatalogPlanID: "s1-p2-cid", Public: false}))
+		})
+
+		It("returns no plan for an unknown GUID", func() {
+			_, found := resolver.GetPlanByGUID("unknown-id")
+			Expect(found).To(BeFalse())
+		})
+	})
+
+	Describe("Update", func() {
+		var syncTime time.Time
+
+		BeforeEach(func() {
+			resetResolver(broker1)
+			syncTime = time.Now()
+		})
+
+		It("applies the updated data", func() {
+			resolver.Update(ctx, syncTime, cf.CacheChanges{
+				Brokers:          []platform.ServiceBroker{broker2.broker},
+				ServiceOfferings: broker2.serviceOfferings,
+				Plans: append(broker2.plans,
+					cf.ServicePlan{GUID: "b1-s1-p1-id", Name: "b1-s1-p1", ServiceOfferingGuid: "b1-s1-id", CatalogPlanId: "s1-p1-cid", Public: true}),
+			})
+
+			Expect(resolver.GetBrokerPlans([]string{"b1", "b2"})).To(Equal(cf.PlanMap{
+				"b1-s1-p1-id": cf.PlanData{
+					GUID: "b1-s1-p1-id", BrokerName: "b1", CatalogPlanID: "s1-p1-cid", Public: true},
+				"b2-s1-p1-id": cf.PlanData{
+					GUID: "b2-s1-p1-id", BrokerName: "b2", CatalogPlanID: "s1-p1-cid", Public: true},
+				"b2-s1-p2-id": cf.PlanData{
+					GUID: "b2-s1-p2-id", BrokerName: "b2", CatalogPlanID: "s1-p2-cid", Public: false},
+			}))
+
+			lastSync, lastFullSync, lastDeletionCheck := resolver.SyncTimes()
+			Expect(lastSync).To(Equal(syncTime))
+			Expect(lastFullSync).To(BeTemporally("<", syncTime))
+			Expect(lastDeletionCheck).To(Equal(lastFullSync))
+		})
+
+		It("keeps the plans of a renamed broker", func() {
+			renamedBroker := broker1.broker
+			renamedBroker.Name = "b1-renamed"
+			resolver.Update(ctx, syncTime, cf.CacheChanges{
+				Brokers:          []platform.ServiceBroker{renamedBroker},
+				ServiceOfferings: broker1.serviceOfferings,
+				Plans:            broker1.plans,
+			})
+
+			_, found := resolver.GetPlan("s1-p1-cid", "b1")
+			Expect(found).To(BeFalse())
+			plan, found := resolver.GetPlan("s1-p1-cid", "b1-renamed")
+			Expect(found).To(BeTrue())
+			Expect(plan).To(Equal(cf.PlanData{
+				GUID: "b1-s1-p1-id", BrokerName: "b1-renamed", CatalogPlanID: "s1-p1-cid", Public: false}))
+		})
+
+		It("replaces the service offerings and plans of the updated brokers", func() {
+			resolver.Update(ctx, syncTime, cf.CacheChanges{
+				Brokers:          []platform.ServiceBroker{broker1.broker},
+				ServiceOfferings: broker1.serviceOfferings,
+				Plans: []cf.ServicePlan{
+					{GUID: "b1-s1-p2-id", Name: "b1-s1-p2", ServiceOfferingGuid: "b1-s1-id", CatalogPlanId: "s1-p2-cid"},
+				},
+			})
+
+			Expect(resolver.GetBrokerPlans([]string{"b1"})).To(Equal(cf.PlanMap{
+				"b1-s1-p2-id": cf.PlanData{
+					GUID: "b1-s1-p2-id", BrokerName: "b1", CatalogPlanID: "s1-p2-cid", Public: false},
+			}))
+		})
+
+		It("deletes the data missing from the existing GUIDs", func() {
+			resolver.Update(ctx, syncTime, cf.CacheChanges{
+				Brokers:          []platform.ServiceBroker{broker2.broker},
+				ServiceOfferings: broker2.serviceOfferings,
+				Plans:            broker2.plans,
+				ExistingGUIDs: map[string]bool{
+					"b2-id": true, "b2-s1-id": true, "b2-s1-p2-id": true,
+				},
+			})
+
+			Expect(resolver.GetBrokerPlans([]string{"b1", "b2"})).To(Equal(cf.PlanMap{
+				"b2-s1-p2-id": cf.PlanData{
+					GUID: "b2-s1-p2-id", BrokerName: "b2", CatalogPlanID: "s1-p2-cid", Public: false},
+			}))
+
+			_, _, lastDeletionCheck := resolver.SyncTimes()
+			Expect(lastDeletionCheck).To(Equal(syncTime))
+		})
+
+		It("indexes the plans loaded before their service offering", func() {
+			resolver.Update(ctx, syncTime, cf.CacheChanges{
+				Brokers: []platform.ServiceBroker{broker2.broker},
+				Plans:   broker2.plans,
+			})
+			Expect(resolver.GetBrokerPlans([]string{"b2"})).To(BeEmpty())
+
+			resolver.Update(ctx, syncTime, cf.CacheChanges{
+				ServiceOfferings: broker2.serviceOfferings,
+			})
+			Expect(resolver.GetBrokerPlans([]string{"b2"})).To(Equal(cf.PlanMap{
+				"b2-s1-p1-id": cf.PlanData{
+					GUID: "b2-s1-p1-id", BrokerName: "b2", CatalogPlanID: "s1-p1-cid", Public: true},
+				"b2-s1-p2-id": cf.PlanData{
+					GUID: "b2-s1-p2-id", BrokerName: "b2", CatalogPlanID: "s1-p2-cid", Public: false},
+			}))
+		})
+
+		It("replaces the index entry of a plan whose catalog ID changed", func() {
+			plan := broker1.plans[0]
+			plan.CatalogPlanId = "s1-p2-cid"
+			resolver.Update(ctx, syncTime, cf.CacheChanges{
+				Plans: []cf.ServicePlan{plan},
+			})
+
+			_, found := resolver.GetPlan("s1-p1-cid", "b1")
+			Expect(found).To(BeFalse())
+			Expect(resolver.GetBrokerPlans([]string{"b1"})).To(Equal(cf.PlanMap{
+				"b1-s1-p1-id": cf.PlanData{
+					GUID: "b1-s1-p1-id", BrokerName: "b1", CatalogPlanID: "s1-p2-cid", Public: false},
+			}))
+		})
+	})
+
+	Describe("Size", func() {
+		It("counts the brokers without plans", func() {
+			broker2.plans = nil
+			resetResolver(broker1, broker2)
+
+			brokers, plans := resolver.Size()
+			Expect(brokers).To(Equal(2))
+			Expect(plans).To(Equal(1))
+		})
+	})
+
+	Describe("RenameBroker", func() {
+		BeforeEach(func() {
+			resetResolver(broker1, broker2)
+		})
+
+		It("moves the plans of the broker to the new name", func() {
+			resolver.RenameBroker("b1-id", "b1-renamed")
+
+			_, found := resolver.GetPlan("s1-p1-cid", "b1")
+			Expect(found).To(BeFalse())
+			Expect(resolver.GetBrokerPlans([]string{"b1-renamed"})).To(Equal(cf.PlanMap{
+				"b1-s1-p1-id": cf.PlanData{
+					GUID: "b1-s1-p1-id", BrokerName: "b1-renamed", CatalogPlanID: "s1-p1-cid", Public: false},
+			}))
+
+			name, found := resolver.BrokerName("b1-id")
+			Expect(found).To(BeTrue())
+			Expect(name).To(Equal("b1-renamed"))
+			guid, found := resolver.BrokerGUID("b1-renamed")
+			Expect(found).To(BeTrue())
+			Expect(guid).To(Equal("b1-id"))
+			_, found = resolver.BrokerGUID("b1")
+			Expect(found).To(BeFalse())
+		})
+
+		It("keeps the data when the broker is updated afterwards", func() {
+			resolver.RenameBroker("b1-id", "b1-renamed")
+			resolver.UpdatePlanVisibilityType("s1-p1-cid", "b1-renamed", cf.VisibilityType.PUBLIC)
+
+			plan, found := resolver.GetPlan("s1-p1-cid", "b1-renamed")
+			Expect(found).To(BeTrue())
+			Expect(plan).To(Equal(cf.PlanData{
+				GUID: "b1-s1-p1-id", BrokerName: "b1-renamed", CatalogPlanID: "s1-p1-cid", Public: true, VisibilityType: cf.VisibilityType.PUBLIC}))
+		})
+
+		It("ignores unknown brokers", func() {
+			resolver.RenameBroker("unknown-id", "b1")
+
+			guid, found := resolver.BrokerGUID("b1")
+			Expect(found).To(BeTrue())
+			Expect(guid).To(Equal("b1-id"))
+		})
+	})
+
+	Describe("Snapshot", func() {
+		It("restores the data and the sync times", func() {
+			resetResolver(broker1, broker2)
+			resolver.UpdatePlanVisibilityType("s1-p1-cid", "b1", cf.VisibilityType.ADMIN)
+			snapshot := resolver.Snapshot()
+			Expect(snapshot.Version).To(Equal(cf.PlanResolverSnapshotVersion))
+
+			restoredResolver := cf.NewPlanResolver()
+			restoredResolver.Restore(ctx, snapshot)
+
+			Expect(restoredResolver.GetBrokerPlans([]string{"b1", "b2"})).To(Equal(resolver.GetBrokerPlans([]string{"b1", "b2"})))
+			lastSync, lastFullSync, lastDeletionCheck := restoredResolver.SyncTimes()
+			Expect(lastSync).To(Equal(snapshot.LastSync))
+			Expect(lastFullSync).To(Equal(snapshot.LastFullSync))
+			Expect(lastDeletionCheck).To(Equal(snapshot.LastDeletionCheck))
+		})
+	})
+
 	Describe("DeleteBroker", func() {
 		It("deletes the data for one broker", func() {
 			resetResolver(broker1, broker2)
@@ -206,6 +416,31 @@ var _ = Describe("PlanResolver", func() {
 				"b2-s1-p2-id": cf.PlanData{
 					GUID: "b2-s1-p2-id", BrokerName: "b2", CatalogPlanID: "s1-p2-cid", Public: false},
 			}))
+
+			snapshot := resolver.Snapshot()
+			Expect(snapshot.Brokers).To(ConsistOf(broker2.broker))
+			Expect(snapshot.ServiceOfferings).To(ConsistOf(broker2.serviceOfferings))
+			Expect(snapshot.Plans).To(ConsistOf(broker2.plans))
+		})
+
+		It("keeps the plans of other brokers whose service offering is not loaded yet", func() {
+			resetResolver(broker1)
+			resolver.Update(ctx, time.Now(), cf.CacheChanges{
+				Brokers: []platform.ServiceBroker{broker2.broker},
+				Plans:   broker2.plans,
+			})
+
+			resolver.DeleteBroker(broker1.broker.Name)
+			resolver.Update(ctx, time.Now(), cf.CacheChanges{
+				ServiceOfferings: broker2.serviceOfferings,
+			})
+
+			Expect(resolver.GetBrokerPlans([]string{"b1", "b2"})).To(Equal(cf.PlanMap{
+				"b2-s1-p1-id": cf.PlanData{
+					GUID: "b2-s1-p1-id", BrokerName: "b2", CatalogPlanID: "s1-p1-cid", Public: true},
+				"b2-s1-p2-id": cf.PlanData{
+					GUID: "b2-s1-p2-id", BrokerName: "b2", CatalogPlanID: "s1-p2-cid", Public: false},
+			}))
 		})
 	})
 
@@ -236,4 +471,22 @@ var _ = Describe("PlanResolver", func() {
 			}))
 		})
 	})
+
+	Describe("UpdatePlanVisibilityType", func() {
+		It("updates the visibility type and the public property of the plan", func() {
+			resetResolver(broker2)
+
+			resolver.UpdatePlanVisibilityType("s1-p1-cid", "b2", cf.VisibilityType.ADMIN)
+			plan, found := resolver.GetPlan("s1-p1-cid", "b2")
+			Expect(found).To(BeTrue())
+			Expect(plan).To(Equal(cf.PlanData{
+				GUID: "b2-s1-p1-id", BrokerName: "b2", CatalogPlanID: "s1-p1-cid", Public: false, VisibilityType: cf.VisibilityType.ADMIN}))
+
+			resolver.UpdatePlanVisibilityType("s1-p2-cid", "b2", cf.VisibilityType.PUBLIC)
+			plan, found = resolver.GetPlan("s1-p2-cid", "b2")
+			Expect(found).To(BeTrue())
+			Expect(plan).To(Equal(cf.PlanData{
+				GUID: "b2-s1-p2-id", BrokerName: "b2", CatalogPlanID: "s1-p2-cid", Public: true, VisibilityType: cf.VisibilityType.PUBLIC}))
+		})
+	})
 })
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/Peripli/service-broker-proxy-cf/cf/cfclient"
 	"github.com/Peripli/service-broker-proxy/pkg/platform"
@@ -11,6 +12,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // PlatformClient provides an implementation of the service-broker-proxy/pkg/cf/Client interface.
@@ -19,6 +25,22 @@ type PlatformClient struct {
 	client       *cfclient.Client
 	settings     *Settings
 	planResolver *PlanResolver
+	redactor     *redactor
+	metrics      *Metrics
+	jobStore     JobStore
+	knownBrokers *knownBrokers
+	brokerNamer  *brokerNamer
+	dryRunPlan   *DryRunPlan
+
+	// resumedJobs are the jobs of a previous run of the proxy which are polled again, by job URL
+	resumedJobs      map[string]*resumedJob
+	resumedJobsMutex sync.Mutex
+
+	// cacheMutex serializes the refreshes of the cache
+	cacheMutex sync.Mutex
+
+	// bulkVisibilitiesUnsupported is set once Cloud Controller turns out not to support loading visibilities in bulk
+	bulkVisibilitiesUnsupported int32
 }
 
 // PlatformClientRequest provides generic request to CF API
@@ -29,6 +51,8 @@ type PlatformClientRequest struct {
 	QueryParams  url.Values
 	RequestBody  interface{}
 	ResponseBody interface{}
+	// Idempotent marks a request with a non-idempotent method as safe to be retried on transient failures
+	Idempotent bool
 }
 
 // PlatformClientResponse provides async job url (if response status was 202) and the status code
@@ -75,6 +99,15 @@ type CCErrorResponse struct {
 	Errors []CCError `json:"errors"`
 }
 
+// ccNotFoundErrorCode is the code of the error returned by Cloud Controller for unknown endpoints
+const ccNotFoundErrorCode = 10000
+
+// ccBadQueryParameterErrorCode is the code of the error returned by Cloud Controller for unsupported query parameters
+const ccBadQueryParameterErrorCode = 10005
+
+// ccUnprocessableEntityErrorCode is the code of the error returned by Cloud Controller for invalid requests, e.g. name conflicts
+const ccUnprocessableEntityErrorCode = 10008
+
 // CCQueryParams CF API query params
 var CCQueryParams = struct {
 	PageSize             string
@@ -82,12 +115,25 @@ var CCQueryParams = struct {
 	ServiceBrokerGuids   string
 	ServiceOfferingGuids string
 	GUIDs                string
+	ServicePlanGuids     string
+	OrganizationGuids    string
+	VisibilityTypes      string
+	UpdatedAtsAfter      string
 }{
 	PageSize:             "per_page",
 	Names:                "names",
 	ServiceBrokerGuids:   "service_broker_guids",
 	ServiceOfferingGuids: "service_offering_guids",
 	GUIDs:                "guids",
+	ServicePlanGuids:     "service_plan_guids",
+	OrganizationGuids:    "organization_guids",
+	VisibilityTypes:      "visibility_types",
+	UpdatedAtsAfter:      "updated_ats[gt]",
+}
+
+// Metrics returns the metrics collected about the interactions with Cloud Controller
+func (pc *PlatformClient) Metrics() *Metrics {
+	return pc.metrics
 }
 
 // Broker returns platform client which can perform platform broker operations
@@ -120,21 +166,37 @@ func (pc *PlatformClient) MakeRequest(req PlatformClientRequest) (*PlatformClien
 		if err != nil {
 			return nil, err
 		}
-		request = pc.client.NewRequestWithBody(req.Method, req.URL, buf)
-		logger.Infof("sending request to %s with request body %v", req.URL, req.RequestBody)
+		request = pc.client.NewRequestWithBody(req.Method, req.URL, buf).WithContext(req.CTX)
+		logger.Infof("sending request to %s with request body %s", req.URL, pc.redactor.redact(req.RequestBody))
 	} else {
-		request = pc.client.NewRequest(req.Method, req.URL)
+		request = pc.client.NewRequest(req.Method, req.URL).WithContext(req.CTX)
 		logger.Infof("sending request to %s", req.URL)
 	}
 
+	if req.Idempotent {
+		request.Idempotent()
+	}
+
+	spanCtx, span := startSpan(req.CTX, fmt.Sprintf("CC %s %s", req.Method, ccPathTemplate(req.URL)),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPMethodKey.String(req.Method), semconv.HTTPURLKey.String(req.URL)))
+	injectTraceContext(spanCtx, request.Header())
+
+	startTime := time.Now()
 	response, err := pc.client.DoRequest(request)
+	statusCode, requestID := ccResponseStatus(response, err)
+	if statusCode != 0 {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(statusCode))
+	}
+	pc.metrics.observeRequest(req.Method, req.URL, statusCode, time.Since(startTime))
+	endSpan(span, err)
 	if err != nil {
-		logger.Errorf("error sending request url %s with the body %v: %v", req.URL, req.RequestBody, err)
+		logger.Errorf("error sending request %s %s (CC request ID %s): %v", req.Method, req.URL, requestID, err)
 		return nil, err
 	}
 
 	if response.StatusCode >= http.StatusBadRequest {
-		logger.Errorf("error response from %s with request body %v: %v", req.URL, req.RequestBody, response)
+		logger.Errorf("error response from %s %s (CC request ID %s): %s", req.Method, req.URL, requestID, response.Status)
 		return nil, fmt.Errorf("CF API %s %s returned status code %d", req.Method, req.URL, response.StatusCode)
 	}
 
@@ -167,6 +229,45 @@ func (pc *PlatformClient) MakeRequest(req PlatformClientRequest) (*PlatformClien
 	return result, nil
 }
 
+// ccResponseStatus returns the status code and the request ID of the response of Cloud Controller,
+// the cfclient returns no response for the error responses it could parse, so they are taken from the error instead
+func ccResponseStatus(response *http.Response, err error) (int, string) {
+	statusCode, requestID := 0, ""
+	var cfErr cfclient.CloudFoundryError
+	if response != nil {
+		statusCode, requestID = response.StatusCode, response.Header.Get(cfclient.VcapRequestIDHeader)
+	} else if errors.As(err, &cfErr) {
+		statusCode, requestID = cfErr.StatusCode, cfErr.RequestID
+	}
+	if requestID == "" {
+		requestID = "-"
+	}
+	return statusCode, requestID
+}
+
+// isNotFoundError reports whether the request failed because Cloud Controller does not know the requested endpoint
+func isNotFoundError(err error) bool {
+	var httpErr cfclient.CloudFoundryHTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == http.StatusNotFound
+	}
+
+	var cfErr cfclient.CloudFoundryError
+	return errors.As(err, &cfErr) && cfErr.Code == ccNotFoundErrorCode
+}
+
+// isBadQueryParameterError reports whether Cloud Controller rejected the request because it does not support one of its filters
+func isBadQueryParameterError(err error) bool {
+	var cfErr cfclient.CloudFoundryError
+	return errors.As(err, &cfErr) && cfErr.Code == ccBadQueryParameterErrorCode
+}
+
+// isUnprocessableEntityError reports whether Cloud Controller rejected the request as invalid
+func isUnprocessableEntityError(err error) bool {
+	var cfErr cfclient.CloudFoundryError
+	return errors.As(err, &cfErr) && cfErr.Code == ccUnprocessableEntityErrorCode
+}
+
 // NewClient creates a new CF client from the specified configuration.
 func NewClient(config *Settings) (*PlatformClient, error) {
 	if err := config.Validate(); err != nil {
@@ -177,9 +278,29 @@ func NewClient(config *Settings) (*PlatformClient, error) {
 		return nil, err
 	}
 
+	jobStore := NewMemoryJobStore()
+	if config.CF.JobStoreProvider != nil {
+		if jobStore, err = config.CF.JobStoreProvider(config.CF.ClientConfiguration); err != nil {
+			return nil, err
+		}
+	}
+
+	brokerNamer, err := newBrokerNamer(config.CF.BrokerNameTemplate, config.CF.BrokerNameEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	planResolver := NewPlanResolver()
 	return &PlatformClient{
 		client:       cfClient,
 		settings:     config,
-		planResolver: NewPlanResolver(),
+		planResolver: planResolver,
+		redactor:     newRedactor(config.CF.SensitiveFields),
+		metrics:      newMetrics(cfClient, planResolver),
+		jobStore:     jobStore,
+		knownBrokers: newKnownBrokers(),
+		brokerNamer:  brokerNamer,
+		dryRunPlan:   NewDryRunPlan(),
+		resumedJobs:  make(map[string]*resumedJob),
 	}, nil
 }
@@ -2,10 +2,12 @@ package cf_test
 
 import (
 	"context"
+	"errors"
 	"github.com/Peripli/service-broker-proxy-cf/cf"
 	"github.com/Peripli/service-broker-proxy-cf/cf/cfclient"
 	"github.com/Peripli/service-broker-proxy-cf/cf/internal"
 	"github.com/Peripli/service-broker-proxy/pkg/sbproxy"
+	"github.com/Peripli/service-manager/pkg/log"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
@@ -145,6 +147,24 @@ var _ = Describe("Client", func() {
 			})
 		})
 
+		Describe("when the request context is cancelled", func() {
+			It("aborts the request and returns an error", func() {
+				cancelledCtx, cancel := context.WithCancel(ctx)
+				cancel()
+				receivedRequests := len(ccServer.ReceivedRequests())
+
+				_, err := cl.MakeRequest(cf.PlatformClientRequest{
+					CTX:    cancelledCtx,
+					URL:    requestPath,
+					Method: http.MethodGet,
+				})
+
+				Expect(err).To(HaveOccurred())
+				Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+				Expect(ccServer.ReceivedRequests()).To(HaveLen(receivedRequests))
+			})
+		})
+
 		Describe("when a request contains body", func() {
 			requestBody := struct {
 				Name      string `json:"name"`
@@ -197,5 +217,128 @@ var _ = Describe("Client", func() {
 				})
 			})
 		})
+
+		Describe("when the context has a correlation ID", func() {
+			const correlationID = "proxy-correlation-id"
+
+			BeforeEach(func() {
+				var err error
+				ctx, err = log.Configure(context.Background(), &log.Settings{
+					Level:  "debug",
+					Format: "text",
+					Output: "ginkgowriter",
+				})
+				Expect(err).ShouldNot(HaveOccurred())
+				ctx = log.ContextWithLogger(ctx, log.C(ctx).WithField(log.FieldCorrelationID, correlationID))
+			})
+
+			It("sends it as request ID and logs the request ID of Cloud Controller on errors", func() {
+				ccServer.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest(http.MethodGet, requestPath),
+						ghttp.VerifyHeaderKV(cfclient.VcapRequestIDHeader, correlationID),
+						ghttp.RespondWith(http.StatusBadRequest, `{"errors":[]}`, http.Header{
+							cfclient.VcapRequestIDHeader: []string{correlationID + "::cc-request-id"},
+						}),
+					),
+				)
+
+				_, err := cl.MakeRequest(cf.PlatformClientRequest{
+					CTX:    ctx,
+					URL:    requestPath,
+					Method: http.MethodGet,
+				})
+
+				Expect(err).To(HaveOccurred())
+				Expect(logInterceptor.String()).To(ContainSubstring("CC request ID " + correlationID + "::cc-request-id"))
+			})
+		})
+
+		Describe("when a request body contains sensitive fields", func() {
+			const (
+				brokerSecret = "broker-secret-value"
+				tokenSecret  = "token-secret-value"
+				apiKeySecret = "api-key-secret-value"
+			)
+
+			var requestBody map[string]interface{}
+
+			BeforeEach(func() {
+				settings := testhelper.CCSettings(ccServer.URL(), 50, 2)
+				settings.CF.SensitiveFields = []string{"metadata.api_key"}
+
+				var err error
+				cl, err = cf.NewClient(settings)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				ctx, err = log.Configure(context.Background(), &log.Settings{
+					Level:  "debug",
+					Format: "text",
+					Output: "ginkgowriter",
+				})
+				Expect(err).ShouldNot(HaveOccurred())
+
+				requestBody = map[string]interface{}{
+					"name": "test-broker",
+					"authentication": cf.CCAuthentication{
+						Type: cf.AuthenticationType.BASIC,
+						Credentials: cf.CCCredentials{
+							Username: "admin",
+							Password: brokerSecret,
+						},
+					},
+					"nested":   []map[string]string{{"Access_Token": tokenSecret}},
+					"metadata": map[string]string{"api_key": apiKeySecret},
+				}
+			})
+
+			assertSecretsAreRedacted := func() {
+				logs := logInterceptor.String()
+				Expect(logs).To(ContainSubstring("test-broker"))
+				Expect(logs).To(ContainSubstring(cf.RedactedValue))
+				Expect(logs).NotTo(ContainSubstring(brokerSecret))
+				Expect(logs).NotTo(ContainSubstring(tokenSecret))
+				Expect(logs).NotTo(ContainSubstring(apiKeySecret))
+			}
+
+			It("redacts them from the logged request body", func() {
+				ccServer.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest(http.MethodPost, requestPath),
+						ghttp.RespondWith(http.StatusOK, "{}"),
+					),
+				)
+
+				_, err := cl.MakeRequest(cf.PlatformClientRequest{
+					CTX:         ctx,
+					URL:         requestPath,
+					Method:      http.MethodPost,
+					RequestBody: requestBody,
+				})
+
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(ccServer.ReceivedRequests()).NotTo(BeEmpty())
+				assertSecretsAreRedacted()
+			})
+
+			It("redacts them when the request fails", func() {
+				ccServer.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest(http.MethodPost, requestPath),
+						ghttp.RespondWith(http.StatusBadRequest, `{"errors":[]}`),
+					),
+				)
+
+				_, err := cl.MakeRequest(cf.PlatformClientRequest{
+					CTX:         ctx,
+					URL:         requestPath,
+					Method:      http.MethodPost,
+					RequestBody: requestBody,
+				})
+
+				Expect(err).To(HaveOccurred())
+				assertSecretsAreRedacted()
+			})
+		})
 	})
 })
@@ -0,0 +1,97 @@
+package cf
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// RedactedValue replaces the values of sensitive fields in the log output
+const RedactedValue = "[REDACTED]"
+
+// DefaultSensitiveFields are the JSON paths which are always redacted from the logged request bodies
+var DefaultSensitiveFields = []string{
+	"authentication.credentials",
+	"password",
+	"token",
+	"access_token",
+	"refresh_token",
+	"client_secret",
+}
+
+// redactor masks the sensitive fields of the values which are logged.
+// A field is sensitive if the dot separated path of its keys ends with one of the configured paths,
+// i.e. "password" matches a password field at any depth while "authentication.credentials" matches
+// only credentials which are nested in authentication.
+type redactor struct {
+	paths [][]string
+}
+
+func newRedactor(sensitiveFields []string) *redactor {
+	r := &redactor{}
+	for _, field := range append(DefaultSensitiveFields, sensitiveFields...) {
+		if field = strings.TrimSpace(field); field != "" {
+			r.paths = append(r.paths, strings.Split(strings.ToLower(field), "."))
+		}
+	}
+	return r
+}
+
+// redact returns the JSON representation of the value with all sensitive fields masked.
+// If the value cannot be represented as JSON, it is masked as a whole.
+func (r *redactor) redact(value interface{}) string {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return RedactedValue
+	}
+
+	var generic interface{}
+	if err := json.Unmarshal(bytes, &generic); err != nil {
+		return RedactedValue
+	}
+
+	bytes, err = json.Marshal(r.redactValue(generic, nil))
+	if err != nil {
+		return RedactedValue
+	}
+	return string(bytes)
+}
+
+func (r *redactor) redactValue(value interface{}, path []string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			fieldPath := append(path[:len(path):len(path)], strings.ToLower(key))
+			if r.isSensitive(fieldPath) {
+				v[key] = RedactedValue
+			} else {
+				v[key] = r.redactValue(field, fieldPath)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = r.redactValue(item, path)
+		}
+	}
+	return value
+}
+
+func (r *redactor) isSensitive(path []string) bool {
+	for _, sensitivePath := range r.paths {
+		if len(sensitivePath) > len(path) {
+			continue
+		}
+		if equalPaths(sensitivePath, path[len(path)-len(sensitivePath):]) {
+			return true
+		}
+	}
+	return false
+}
+
+func equalPaths(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
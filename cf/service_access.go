@@ -26,6 +26,20 @@ func (pc *PlatformClient) EnableAccessForPlan(ctx context.Context, request *plat
 		return err
 	}
 
+	if plan.VisibilityType == VisibilityType.SPACE {
+		return pc.enableAccessForSpaceScopedPlan(ctx, request, plan)
+	}
+
+	if isAdminVisibilityRequest(request) {
+		// the visibility reported for admin plans, which is not a visibility in any organization
+		if plan.VisibilityType != VisibilityType.ADMIN {
+			return errors.Errorf("Cannot enable plan access for admins only. Plan with catalog id %s from service broker %s is visible with type %s",
+				request.CatalogPlanID, request.BrokerName, plan.VisibilityType)
+		}
+		logger.Infof("Plan with GUID %s is already visible only to admins", plan.GUID)
+		return nil
+	}
+
 	if plan.Public {
 		return errors.Errorf("Plan with catalog id %s from service broker %s is already public",
 			request.CatalogPlanID, request.BrokerName)
@@ -47,11 +61,17 @@ func (pc *PlatformClient) EnableAccessForPlan(ctx context.Context, request *plat
 				plan.GUID, strings.Join(orgGUIDs, ", "), strings.Join(existingOrgGUIDs, ", "))
 		}
 
-		err = pc.AddOrganizationVisibilities(ctx, plan.GUID, existingOrgGUIDs)
+		if plan.VisibilityType == VisibilityType.ADMIN {
+			// admin plans have no organizations to append to
+			err = pc.ReplaceOrganizationVisibilities(ctx, plan.GUID, existingOrgGUIDs)
+		} else {
+			err = pc.AddOrganizationVisibilities(ctx, plan.GUID, existingOrgGUIDs)
+		}
 		if err != nil {
 			return fmt.Errorf("could not enable access for plan with GUID %s in organizations with GUID %s: %v",
 				plan.GUID, strings.Join(orgGUIDs, ", "), err)
 		}
+		pc.planResolver.UpdatePlanVisibilityType(plan.CatalogPlanID, plan.BrokerName, VisibilityType.ORGANIZATION)
 		logger.Infof("Enabled access for plan with GUID %s in organizations with GUID %s",
 			plan.GUID, strings.Join(orgGUIDs, ", "))
 	} else {
@@ -61,7 +81,7 @@ func (pc *PlatformClient) EnableAccessForPlan(ctx context.Context, request *plat
 			return fmt.Errorf("could not enable public access for plan with GUID %s: %v", plan.GUID, err)
 		}
 
-		pc.planResolver.UpdatePlan(plan.CatalogPlanID, plan.BrokerName, true)
+		pc.planResolver.UpdatePlanVisibilityType(plan.CatalogPlanID, plan.BrokerName, VisibilityType.PUBLIC)
 	}
 
 	return nil
@@ -76,6 +96,17 @@ func (pc *PlatformClient) DisableAccessForPlan(ctx context.Context, request *pla
 		return err
 	}
 
+	if plan.VisibilityType == VisibilityType.SPACE {
+		return pc.disableAccessForSpaceScopedPlan(ctx, request, plan)
+	}
+
+	if isAdminVisibilityRequest(request) {
+		// the reconciler removes the visibility reported for admin plans when Service Manager has no visibility
+		// for the plan, the plan stays visible only to admins then
+		logger.Infof("Plan with GUID %s stays visible only to admins", plan.GUID)
+		return nil
+	}
+
 	scheduler := reconcile.NewScheduler(ctx, pc.settings.Reconcile.MaxParallelRequests)
 	if orgGUIDs, ok := request.Labels[OrgLabelKey]; ok && len(orgGUIDs) != 0 {
 		if plan.Public {
@@ -83,6 +114,12 @@ func (pc *PlatformClient) DisableAccessForPlan(ctx context.Context, request *pla
 				request.CatalogPlanID, request.BrokerName)
 		}
 
+		if plan.VisibilityType == VisibilityType.ADMIN {
+			logger.Infof("Plan with GUID %s is visible only to admins and not in organizations with GUID %s",
+				plan.GUID, strings.Join(orgGUIDs, ", "))
+			return nil
+		}
+
 		for _, orgGUID := range orgGUIDs {
 			pc.scheduleDeleteOrgVisibilityForPlan(ctx, request, scheduler, plan.GUID, orgGUID)
 		}
@@ -94,7 +131,7 @@ func (pc *PlatformClient) DisableAccessForPlan(ctx context.Context, request *pla
 
 		logger.Infof("Disabled access for plan with GUID %s in organizations with GUID %s",
 			plan.GUID, strings.Join(orgGUIDs, ", "))
-	} else {
+	} else if plan.VisibilityType != VisibilityType.ADMIN {
 		// We didn't receive a list of organizations means we need to delete all visibilities of this plan
 		visibilities, err := pc.getPlanVisibilitiesByPlanId(ctx, plan.GUID)
 		if err != nil {
@@ -112,8 +149,6 @@ func (pc *PlatformClient) DisableAccessForPlan(ctx context.Context, request *pla
 		if err = scheduler.Await(); err != nil {
 			return fmt.Errorf("could not disable access for plan with GUID %s: %v", plan.GUID, err)
 		}
-
-		pc.planResolver.UpdatePlan(plan.CatalogPlanID, plan.BrokerName, true)
 	}
 
 	return nil
@@ -139,6 +174,90 @@ func (pc *PlatformClient) scheduleDeleteOrgVisibilityForPlan(
 	}
 }
 
+// enableAccessForSpaceScopedPlan checks that the requested access is already granted, because
+// the plans of space-scoped brokers are always visible in the space of the broker and only there
+func (pc *PlatformClient) enableAccessForSpaceScopedPlan(ctx context.Context, request *platform.ModifyPlanAccessRequest, plan *PlanData) error {
+	if orgGUIDs := request.Labels[OrgLabelKey]; len(orgGUIDs) != 0 {
+		return errors.Errorf("Cannot enable plan access for orgs. Plan with catalog id %s from service broker %s is scoped to a space",
+			request.CatalogPlanID, request.BrokerName)
+	}
+
+	spaceGUIDs := request.Labels[SpaceLabelKey]
+	if len(spaceGUIDs) == 0 {
+		log.C(ctx).Infof("Plan with GUID %s is space-scoped and is already visible in the space of its broker", plan.GUID)
+		return nil
+	}
+
+	spaceGUID, err := pc.getPlanSpaceGUID(ctx, plan.GUID)
+	if err != nil {
+		return err
+	}
+	for _, requestedSpaceGUID := range spaceGUIDs {
+		if requestedSpaceGUID != spaceGUID {
+			return errors.Errorf("Cannot enable plan access for space with GUID %s. Plan with catalog id %s from service broker %s is scoped to the space with GUID %s",
+				requestedSpaceGUID, request.CatalogPlanID, request.BrokerName, spaceGUID)
+		}
+	}
+
+	return nil
+}
+
+// disableAccessForSpaceScopedPlan fails unless the plan is not visible where the access should be disabled anyway,
+// because the plans of space-scoped brokers cannot be hidden from the space of the broker
+func (pc *PlatformClient) disableAccessForSpaceScopedPlan(ctx context.Context, request *platform.ModifyPlanAccessRequest, plan *PlanData) error {
+	if orgGUIDs := request.Labels[OrgLabelKey]; len(orgGUIDs) != 0 && len(request.Labels[SpaceLabelKey]) == 0 {
+		log.C(ctx).Infof("Plan with GUID %s is space-scoped and is not visible in organizations with GUID %s",
+			plan.GUID, strings.Join(orgGUIDs, ", "))
+		return nil
+	}
+
+	if spaceGUIDs := request.Labels[SpaceLabelKey]; len(spaceGUIDs) != 0 {
+		spaceGUID, err := pc.getPlanSpaceGUID(ctx, plan.GUID)
+		if err != nil {
+			return err
+		}
+		visibleInRequestedSpace := false
+		for _, requestedSpaceGUID := range spaceGUIDs {
+			visibleInRequestedSpace = visibleInRequestedSpace || requestedSpaceGUID == spaceGUID
+		}
+		if !visibleInRequestedSpace {
+			log.C(ctx).Infof("Plan with GUID %s is scoped to the space with GUID %s and is not visible in spaces with GUID %s",
+				plan.GUID, spaceGUID, strings.Join(spaceGUIDs, ", "))
+			return nil
+		}
+	}
+
+	return errors.Errorf("Cannot disable plan access. Plan with catalog id %s from service broker %s is scoped to a space and is always visible in it",
+		request.CatalogPlanID, request.BrokerName)
+}
+
+func (pc *PlatformClient) getPlanSpaceGUID(ctx context.Context, planGUID string) (string, error) {
+	visibilities, err := pc.getPlanVisibilitiesByPlanId(ctx, planGUID)
+	if err != nil {
+		return "", fmt.Errorf("could not get service plan visibilities for the plan with GUID %s: %v", planGUID, err)
+	}
+
+	for _, visibility := range visibilities {
+		if visibility.SpaceGuid != "" {
+			return visibility.SpaceGuid, nil
+		}
+	}
+	return "", errors.Errorf("Plan with GUID %s is not visible in any space", planGUID)
+}
+
+// isAdminVisibilityRequest reports whether the request is about the visibility of a plan visible only to admins
+func isAdminVisibilityRequest(request *platform.ModifyPlanAccessRequest) bool {
+	if len(request.Labels[OrgLabelKey]) != 0 || len(request.Labels[SpaceLabelKey]) != 0 {
+		return false
+	}
+	for _, visibilityType := range request.Labels[VisibilityTypeLabelKey] {
+		if visibilityType == string(VisibilityType.ADMIN) {
+			return true
+		}
+	}
+	return false
+}
+
 func (pc *PlatformClient) validateRequestAndGetPlan(request *platform.ModifyPlanAccessRequest) (*PlanData, error) {
 	if request == nil {
 		return nil, errors.Errorf("Modify plan access request cannot be nil")
@@ -7,6 +7,9 @@ import (
 	"github.com/Peripli/service-broker-proxy-cf/cf"
 	"github.com/Peripli/service-broker-proxy-cf/cf/internal"
 	"github.com/Peripli/service-broker-proxy/pkg/platform"
+	"github.com/Peripli/service-broker-proxy/pkg/sbproxy"
+	"github.com/Peripli/service-broker-proxy/pkg/sbproxy/reconcile"
+	"github.com/Peripli/service-broker-proxy/pkg/sm/smfakes"
 	"github.com/Peripli/service-manager/pkg/types"
 	"github.com/gofrs/uuid"
 	. "github.com/onsi/ginkgo"
@@ -86,6 +89,43 @@ var _ = Describe("Client Service Plan Access", func() {
 		return client.DisableAccessForPlan(ctx, req)
 	}
 
+	// resync reconciles the visibilities of the plans of the broker with the visibilities returned by Service Manager
+	resync := func(settings *cf.Settings, broker *cf.CCServiceBroker, plans []*cf.CCServicePlan, smVisibilities []*types.Visibility) *smfakes.FakeClient {
+		offering := generatedCFServiceOfferings[broker.GUID][0]
+		smClient := &smfakes.FakeClient{}
+		smClient.PutCredentialsReturns(&types.BrokerPlatformCredential{Base: types.Base{ID: "credentials-id"}}, nil)
+		smClient.GetBrokersReturns([]*types.ServiceBroker{{
+			Base:      types.Base{ID: broker.GUID},
+			Name:      strings.TrimSuffix(strings.TrimPrefix(broker.Name, reconcile.DefaultProxyBrokerPrefix), "-"+broker.GUID),
+			BrokerURL: "https://broker.example.com",
+		}}, nil)
+		smClient.GetServiceOfferingsReturns([]*types.ServiceOffering{{
+			Base:     types.Base{ID: offering.GUID},
+			BrokerID: broker.GUID,
+		}}, nil)
+		var smPlans []*types.ServicePlan
+		for _, plan := range plans {
+			smPlans = append(smPlans, &types.ServicePlan{
+				Base:              types.Base{ID: plan.GUID},
+				ServiceOfferingID: offering.GUID,
+				CatalogID:         plan.BrokerCatalog.ID,
+			})
+		}
+		smClient.GetPlansReturns(smPlans, nil)
+		smClient.GetVisibilitiesReturns(smVisibilities, nil)
+
+		// the resync refetches the catalog of the broker before the visibilities are reconciled
+		ccServer.RouteToHandler(http.MethodPatch, "/v3/service_brokers/"+broker.GUID, ghttp.RespondWith(http.StatusAccepted, nil,
+			http.Header{"Location": []string{"/v3/jobs/" + broker.GUID}}))
+		setCCJobResponse(ccServer, false, cf.JobState.COMPLETE)
+		setCCGetBrokerResponse(ccServer, generatedCFBrokers)
+
+		resyncer := reconcile.NewResyncer(settings.Reconcile, client, smClient, settings.Sm,
+			settings.Reconcile.URL+sbproxy.APIPrefix, settings.Reconcile.LegacyURL+sbproxy.APIPrefix+"/%s")
+		resyncer.Resync(ctx, true)
+		return smClient
+	}
+
 	AfterEach(func() {
 		if ccServer != nil {
 			ccServer.Close()
@@ -418,4 +458,311 @@ var _ = Describe("Client Service Plan Access", func() {
 			})
 		})
 	})
+
+	Describe("for a plan visible only to admins", func() {
+		var (
+			settings  *cf.Settings
+			broker    *cf.CCServiceBroker
+			adminPlan *cf.CCServicePlan
+		)
+
+		visibilityUpdates := func(method string) int {
+			count := 0
+			for _, request := range ccServer.ReceivedRequests() {
+				if strings.Contains(request.URL.Path, "/visibility") && request.Method == method {
+					count++
+				}
+			}
+			return count
+		}
+
+		BeforeEach(func() {
+			broker = generatedCFBrokers[0]
+			adminPlan = filterPlans(generatedCFPlans[generatedCFServiceOfferings[broker.GUID][0].GUID], cf.VisibilityType.ORGANIZATION)[0]
+			adminPlan.VisibilityType = cf.VisibilityType.ADMIN
+			generatedCFVisibilities[adminPlan.GUID] = &cf.ServicePlanVisibilitiesResponse{
+				Type: string(cf.VisibilityType.ADMIN),
+			}
+
+			ccServer = createCCServer(generatedCFOrganizations, generatedCFBrokers, generatedCFServiceOfferings, generatedCFPlans, generatedCFVisibilities)
+			settings, client = testhelper.CCClientWithThrottling(ccServer.URL(), maxAllowedParallelRequests, JobPollTimeout)
+		})
+
+		requestForLabels := func(labels types.Labels) *platform.ModifyPlanAccessRequest {
+			return &platform.ModifyPlanAccessRequest{
+				BrokerName:    broker.Name,
+				CatalogPlanID: adminPlan.BrokerCatalog.ID,
+				Labels:        labels,
+			}
+		}
+
+		Context("when enabling access", func() {
+			It("replaces the visibility type with the provided organizations", func() {
+				err := enableAccessForPlan(ctx, requestForLabels(types.Labels{cf.OrgLabelKey: []string{generatedCFOrganizations[0].GUID}}))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(visibilityUpdates(http.MethodPatch)).To(Equal(1))
+				Expect(visibilityUpdates(http.MethodPost)).To(Equal(0))
+
+				err = client.EnableAccessForPlan(ctx, requestForLabels(types.Labels{cf.OrgLabelKey: []string{generatedCFOrganizations[1].GUID}}))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(visibilityUpdates(http.MethodPost)).To(Equal(1))
+			})
+
+			It("does nothing if the admin visibility type is provided", func() {
+				err := enableAccessForPlan(ctx, requestForLabels(types.Labels{cf.VisibilityTypeLabelKey: []string{string(cf.VisibilityType.ADMIN)}}))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(visibilityUpdates(http.MethodPatch)).To(Equal(0))
+				Expect(visibilityUpdates(http.MethodPost)).To(Equal(0))
+			})
+
+			It("makes the plan public if no organizations are provided", func() {
+				err := enableAccessForPlan(ctx, requestForLabels(types.Labels{}))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(visibilityUpdates(http.MethodPatch)).To(Equal(1))
+
+				err = client.EnableAccessForPlan(ctx, requestForLabels(types.Labels{}))
+				Expect(err).To(MatchError(MatchRegexp("is already public")))
+			})
+		})
+
+		Context("when disabling access", func() {
+			It("does nothing if organizations are provided", func() {
+				err := disableAccessForPlan(ctx, requestForLabels(types.Labels{cf.OrgLabelKey: []string{generatedCFOrganizations[0].GUID}}))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(visibilityUpdates(http.MethodDelete)).To(Equal(0))
+			})
+
+			It("does nothing if no organizations are provided", func() {
+				err := disableAccessForPlan(ctx, requestForLabels(types.Labels{}))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(visibilityUpdates(http.MethodGet)).To(Equal(0))
+				Expect(visibilityUpdates(http.MethodPatch)).To(Equal(0))
+			})
+
+			It("does nothing if the admin visibility type is provided", func() {
+				err := disableAccessForPlan(ctx, requestForLabels(types.Labels{cf.VisibilityTypeLabelKey: []string{string(cf.VisibilityType.ADMIN)}}))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(visibilityUpdates(http.MethodGet)).To(Equal(0))
+				Expect(visibilityUpdates(http.MethodPatch)).To(Equal(0))
+			})
+
+			It("keeps the organizations of a plan no longer visible only to admins if the admin visibility type is provided", func() {
+				orgPlan := filterPlans(generatedCFPlans[generatedCFServiceOfferings[broker.GUID][0].GUID], cf.VisibilityType.ORGANIZATION)[0]
+				err := disableAccessForPlan(ctx, &platform.ModifyPlanAccessRequest{
+					BrokerName:    broker.Name,
+					CatalogPlanID: orgPlan.BrokerCatalog.ID,
+					Labels:        types.Labels{cf.VisibilityTypeLabelKey: []string{string(cf.VisibilityType.ADMIN)}},
+				})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(visibilityUpdates(http.MethodDelete)).To(Equal(0))
+			})
+		})
+
+		Context("when the visibilities are resynced with Service Manager", func() {
+			BeforeEach(func() {
+				// the other brokers and plans are unknown to Service Manager and would be removed by the resync
+				offerings := map[string][]*cf.CCServiceOffering{
+					broker.GUID: generatedCFServiceOfferings[broker.GUID][:1],
+				}
+				plans := map[string][]*cf.CCServicePlan{
+					offerings[broker.GUID][0].GUID: {adminPlan},
+				}
+				ccServer.Close()
+				ccServer = createCCServer(generatedCFOrganizations, generatedCFBrokers[:1], offerings, plans, generatedCFVisibilities)
+				settings, client = testhelper.CCClientWithThrottling(ccServer.URL(), maxAllowedParallelRequests, JobPollTimeout)
+			})
+
+			It("keeps the plan visible only to admins when Service Manager has no visibility of the plan", func() {
+				smClient := resync(settings, broker, []*cf.CCServicePlan{adminPlan}, []*types.Visibility{})
+
+				Expect(smClient.GetVisibilitiesCallCount()).To(Equal(1))
+				Expect(visibilityUpdates(http.MethodPatch)).To(Equal(0))
+				Expect(visibilityUpdates(http.MethodPost)).To(Equal(0))
+				Expect(visibilityUpdates(http.MethodDelete)).To(Equal(0))
+				Expect(logInterceptor.String()).ToNot(ContainSubstring("could not remove visibilities"))
+			})
+
+			It("replaces the visibility type with the organizations of Service Manager", func() {
+				resync(settings, broker, []*cf.CCServicePlan{adminPlan}, []*types.Visibility{{
+					Base: types.Base{Labels: types.Labels{
+						cf.OrgLabelKey: []string{generatedCFOrganizations[0].GUID},
+					}},
+					PlatformID:    "cf-platform",
+					ServicePlanID: adminPlan.GUID,
+				}})
+
+				Expect(visibilityUpdates(http.MethodPatch)).To(Equal(1))
+				Expect(logInterceptor.String()).ToNot(ContainSubstring("could not create visibilities"))
+			})
+		})
+	})
+
+	Describe("for a public plan", func() {
+		BeforeEach(func() {
+			ccServer = createCCServer(generatedCFOrganizations, generatedCFBrokers, generatedCFServiceOfferings, generatedCFPlans, generatedCFVisibilities)
+			_, client = testhelper.CCClientWithThrottling(ccServer.URL(), maxAllowedParallelRequests, JobPollTimeout)
+		})
+
+		It("keeps the plan public when all access is disabled", func() {
+			broker := generatedCFBrokers[0]
+			publicPlan := filterPlans(generatedCFPlans[generatedCFServiceOfferings[broker.GUID][0].GUID], cf.VisibilityType.PUBLIC)[0]
+			request := platform.ModifyPlanAccessRequest{
+				BrokerName:    broker.Name,
+				CatalogPlanID: publicPlan.BrokerCatalog.ID,
+				Labels:        types.Labels{},
+			}
+
+			err := disableAccessForPlan(ctx, &request)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			for _, r := range ccServer.ReceivedRequests() {
+				if r.URL.Path == fmt.Sprintf("/v3/service_plans/%s/visibility", publicPlan.GUID) {
+					Expect(r.Method).To(Equal(http.MethodGet))
+				}
+			}
+
+			request.Labels = types.Labels{cf.OrgLabelKey: []string{generatedCFOrganizations[0].GUID}}
+			err = client.DisableAccessForPlan(ctx, &request)
+			Expect(err).To(MatchError(MatchRegexp("Plan with catalog id .* is public")))
+		})
+	})
+
+	Describe("for a plan of a space-scoped broker", func() {
+		const spaceGUID = "space-guid"
+		var (
+			settings        *cf.Settings
+			broker          *cf.CCServiceBroker
+			spaceScopedPlan *cf.CCServicePlan
+		)
+
+		visibilityUpdates := func() int {
+			count := 0
+			for _, request := range ccServer.ReceivedRequests() {
+				if strings.HasSuffix(request.URL.Path, "/visibility") && request.Method != http.MethodGet {
+					count++
+				}
+			}
+			return count
+		}
+
+		BeforeEach(func() {
+			generatedCFBrokers = generateCFBrokers(1)
+			broker = generatedCFBrokers[0]
+			broker.Relationships.Space.Data.GUID = spaceGUID
+			generatedCFServiceOfferings = generateCFServiceOfferings(generatedCFBrokers, 1)
+			generatedCFPlans = generateCFPlans(generatedCFServiceOfferings, 1, 0)
+			spaceScopedPlan = generatedCFPlans[generatedCFServiceOfferings[broker.GUID][0].GUID][0]
+			spaceScopedPlan.VisibilityType = cf.VisibilityType.SPACE
+			generatedCFVisibilities = map[string]*cf.ServicePlanVisibilitiesResponse{
+				spaceScopedPlan.GUID: {
+					Type:  string(cf.VisibilityType.SPACE),
+					Space: &cf.Space{Guid: spaceGUID},
+				},
+			}
+
+			ccServer = createCCServer(generatedCFOrganizations, generatedCFBrokers, generatedCFServiceOfferings, generatedCFPlans, generatedCFVisibilities)
+			settings, client = testhelper.CCClientWithThrottling(ccServer.URL(), maxAllowedParallelRequests, JobPollTimeout)
+		})
+
+		requestForLabels := func(labels types.Labels) *platform.ModifyPlanAccessRequest {
+			return &platform.ModifyPlanAccessRequest{
+				BrokerName:    broker.Name,
+				CatalogPlanID: spaceScopedPlan.BrokerCatalog.ID,
+				Labels:        labels,
+			}
+		}
+
+		It("is reported as public in the space of its broker", func() {
+			Expect(client.ResetCache(ctx)).To(Succeed())
+			visibilities, err := client.GetVisibilitiesByBrokers(ctx, []string{broker.Name})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(visibilities).To(ConsistOf(&platform.Visibility{
+				Public:             true,
+				CatalogPlanID:      spaceScopedPlan.BrokerCatalog.ID,
+				PlatformBrokerName: broker.Name,
+				Labels: map[string]string{
+					cf.SpaceLabelKey: spaceGUID,
+				},
+			}))
+		})
+
+		Context("when enabling access", func() {
+			It("does nothing if no scope is provided", func() {
+				err := enableAccessForPlan(ctx, requestForLabels(types.Labels{}))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(visibilityUpdates()).To(Equal(0))
+			})
+
+			It("does nothing if the space of the broker is provided", func() {
+				err := enableAccessForPlan(ctx, requestForLabels(types.Labels{cf.SpaceLabelKey: []string{spaceGUID}}))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(visibilityUpdates()).To(Equal(0))
+			})
+
+			It("returns an error if another space is provided", func() {
+				err := enableAccessForPlan(ctx, requestForLabels(types.Labels{cf.SpaceLabelKey: []string{"other-space-guid"}}))
+				Expect(err).To(MatchError(MatchRegexp(fmt.Sprintf(
+					"Cannot enable plan access for space with GUID other-space-guid. .* is scoped to the space with GUID %s", spaceGUID))))
+			})
+
+			It("returns an error if organizations are provided", func() {
+				err := enableAccessForPlan(ctx, requestForLabels(types.Labels{cf.OrgLabelKey: []string{generatedCFOrganizations[0].GUID}}))
+				Expect(err).To(MatchError(MatchRegexp("Cannot enable plan access for orgs. .* is scoped to a space")))
+				Expect(visibilityUpdates()).To(Equal(0))
+			})
+		})
+
+		Context("when disabling access", func() {
+			It("does nothing if organizations are provided", func() {
+				err := disableAccessForPlan(ctx, requestForLabels(types.Labels{cf.OrgLabelKey: []string{generatedCFOrganizations[0].GUID}}))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(visibilityUpdates()).To(Equal(0))
+			})
+
+			It("does nothing if another space is provided", func() {
+				err := disableAccessForPlan(ctx, requestForLabels(types.Labels{cf.SpaceLabelKey: []string{"other-space-guid"}}))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(visibilityUpdates()).To(Equal(0))
+			})
+
+			It("returns an error if the space of the broker is provided", func() {
+				err := disableAccessForPlan(ctx, requestForLabels(types.Labels{cf.SpaceLabelKey: []string{spaceGUID}}))
+				Expect(err).To(MatchError(MatchRegexp("Cannot disable plan access. .* is scoped to a space and is always visible in it")))
+				Expect(visibilityUpdates()).To(Equal(0))
+			})
+
+			It("returns an error if no scope is provided", func() {
+				err := disableAccessForPlan(ctx, requestForLabels(types.Labels{}))
+				Expect(err).To(MatchError(MatchRegexp("Cannot disable plan access. .* is scoped to a space and is always visible in it")))
+				Expect(visibilityUpdates()).To(Equal(0))
+			})
+		})
+
+		Context("when the visibilities are resynced with Service Manager", func() {
+			It("does not change the access when Service Manager has the visibility of the plan in the space", func() {
+				smClient := resync(settings, broker, []*cf.CCServicePlan{spaceScopedPlan}, []*types.Visibility{
+					{
+						Base: types.Base{Labels: types.Labels{
+							cf.SpaceLabelKey: []string{spaceGUID},
+						}},
+						PlatformID:    "cf-platform",
+						ServicePlanID: spaceScopedPlan.GUID,
+					},
+				})
+
+				Expect(smClient.GetVisibilitiesCallCount()).To(Equal(1))
+				Expect(visibilityUpdates()).To(Equal(0))
+				Expect(logInterceptor.String()).ToNot(ContainSubstring("could not remove visibilities"))
+				Expect(logInterceptor.String()).ToNot(ContainSubstring("could not create visibilities"))
+			})
+
+			It("reports that the plan cannot be hidden when Service Manager has no visibility of the plan", func() {
+				smClient := resync(settings, broker, []*cf.CCServicePlan{spaceScopedPlan}, []*types.Visibility{})
+
+				Expect(smClient.GetVisibilitiesCallCount()).To(Equal(1))
+				Expect(visibilityUpdates()).To(Equal(0))
+				Expect(logInterceptor.String()).To(ContainSubstring("is scoped to a space and is always visible in it"))
+			})
+		})
+	})
 })
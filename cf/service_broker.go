@@ -2,21 +2,28 @@ package cf
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/Peripli/service-manager/pkg/log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Peripli/service-broker-proxy/pkg/platform"
+	"github.com/Peripli/service-broker-proxy/pkg/sbproxy"
 )
 
 const (
-	CreateBrokerError = "could not retrieve service broker with name %s: %v"
-	DeleteBrokerError = "could not delete service broker with GUID %s: %v"
-	UpdateBrokerError = "could not update service broker with GUID %s: %v"
+	CreateBrokerError = "could not retrieve service broker with name %s: %w"
+	DeleteBrokerError = "could not delete service broker with GUID %s: %w"
+	UpdateBrokerError = "could not update service broker with GUID %s: %w"
 )
 
+// errMissingJobURL is returned when Cloud Controller accepts an asynchronous broker operation without a job URL
+var errMissingJobURL = errors.New("no job URL returned by Cloud Controller")
+
 type AuthenticationTypeValue string
 
 // AuthenticationType is the supported authentication types.
@@ -43,6 +50,7 @@ type CCServiceBroker struct {
 	Name          string                `json:"name"`
 	URL           string                `json:"url"`
 	Relationships CCBrokerRelationships `json:"relationships"`
+	Metadata      CCMetadata            `json:"metadata"`
 }
 
 // CCSaveServiceBrokerRequest used for create and update broker requests payload
@@ -50,6 +58,13 @@ type CCSaveServiceBrokerRequest struct {
 	Name           string            `json:"name"`
 	URL            string            `json:"url"`
 	Authentication *CCAuthentication `json:"authentication,omitempty"`
+	Metadata       *CCMetadata       `json:"metadata,omitempty"`
+}
+
+// CCMetadata CF CC metadata object
+type CCMetadata struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
 // CCAuthentication CF CC authentication object
@@ -77,19 +92,33 @@ func (pc *PlatformClient) GetBrokers(ctx context.Context) ([]*platform.ServiceBr
 	}
 	logger.Infof("Fetched %d service brokers from CF", len(brokers))
 
+	pc.knownBrokers.add(brokers...)
+
 	var clientBrokers []*platform.ServiceBroker
+	foreignBrokers, unnamedBrokers := 0, 0
 	for _, broker := range brokers {
-		if broker.Relationships.Space.Data.GUID == "" {
+		if pc.isForeignBroker(broker) {
+			foreignBrokers++
+			continue
+		}
+		name, ok := pc.brokerNamer.smName(broker.Name)
+		if !ok {
+			unnamedBrokers++
+			continue
+		}
+		if broker.Relationships.Space.Data.GUID == "" || pc.isManagedBroker(broker) {
 			serviceBroker := &platform.ServiceBroker{
 				GUID:      broker.GUID,
-				Name:      broker.Name,
+				Name:      name,
 				BrokerURL: broker.URL,
 			}
 			clientBrokers = append(clientBrokers, serviceBroker)
 		}
 	}
 
-	logger.Infof("Filtered out %d space-scoped brokers", len(brokers)-len(clientBrokers))
+	logger.Infof("Filtered out %d brokers registered by other proxy instances, %d brokers not matching the broker name template "+
+		"and %d space-scoped brokers not registered by Service Manager",
+		foreignBrokers, unnamedBrokers, len(brokers)-len(clientBrokers)-foreignBrokers-unnamedBrokers)
 	return clientBrokers, nil
 }
 
@@ -108,10 +137,16 @@ func (pc *PlatformClient) GetBroker(ctx context.Context, GUID string) (*platform
 	if err != nil {
 		return nil, fmt.Errorf("could not retrieve service broker with GUID %s: %v", GUID, err)
 	}
+	pc.knownBrokers.add(serviceBrokerResponse)
 
+	name, ok := pc.brokerNamer.smName(serviceBrokerResponse.Name)
+	if !ok {
+		return nil, fmt.Errorf("service broker with name %s and GUID %s is not named by the broker name template",
+			serviceBrokerResponse.Name, GUID)
+	}
 	return &platform.ServiceBroker{
 		GUID:      serviceBrokerResponse.GUID,
-		Name:      serviceBrokerResponse.Name,
+		Name:      name,
 		BrokerURL: serviceBrokerResponse.URL,
 	}, nil
 }
@@ -120,7 +155,7 @@ func (pc *PlatformClient) GetBroker(ctx context.Context, GUID string) (*platform
 // that is already registered in CF
 func (pc *PlatformClient) GetBrokerByName(ctx context.Context, name string) (*platform.ServiceBroker, error) {
 	brokers, err := pc.ListServiceBrokersByQuery(ctx, url.Values{
-		CCQueryParams.Names: []string{name},
+		CCQueryParams.Names: []string{pc.brokerNamer.platformName(name)},
 	})
 	if err != nil || len(brokers) == 0 {
 		return nil, fmt.Errorf("could not retrieve service broker with name %s: %v", name, err)
@@ -129,15 +164,22 @@ func (pc *PlatformClient) GetBrokerByName(ctx context.Context, name string) (*pl
 	broker := brokers[0]
 	log.C(ctx).Infof("Retrieved service broker with name %s, GUID %s and URL %s",
 		broker.Name, broker.GUID, broker.URL)
+	pc.knownBrokers.add(broker)
 
-	if broker.Relationships.Space.Data.GUID != "" {
+	if pc.isForeignBroker(broker) {
+		return nil, fmt.Errorf("service broker with name %s and GUID %s is registered by proxy instance %s",
+			broker.Name, broker.GUID, broker.Metadata.Labels[ProxyInstanceLabel])
+	}
+
+	if broker.Relationships.Space.Data.GUID != "" && !pc.isManagedBroker(broker) {
 		return nil, fmt.Errorf("service broker with name %s and GUID %s is scoped to a space with GUID %s",
 			broker.Name, broker.GUID, broker.Relationships.Space.Data.GUID)
 	}
 
+	// the broker is looked up by the name produced by the template from the given name
 	return &platform.ServiceBroker{
 		GUID:      broker.GUID,
-		Name:      broker.Name,
+		Name:      name,
 		BrokerURL: broker.URL,
 	}, nil
 }
@@ -146,12 +188,37 @@ func (pc *PlatformClient) GetBrokerByName(ctx context.Context, name string) (*pl
 // registering a new broker in CF
 func (pc *PlatformClient) CreateBroker(ctx context.Context, r *platform.CreateServiceBrokerRequest) (*platform.ServiceBroker, error) {
 	logger := log.C(ctx)
+	if pc.isDryRun() {
+		pc.dryRunPlan.record(ctx, DryRunAction{
+			Operation:  DryRunOperation.CREATE_BROKER,
+			BrokerName: r.Name,
+			BrokerURL:  r.BrokerURL,
+		})
+		// the GUID does not exist in CF, so the reads of the broker data return nothing
+		return &platform.ServiceBroker{
+			GUID:      "dry-run-" + r.Name,
+			Name:      r.Name,
+			BrokerURL: r.BrokerURL,
+		}, nil
+	}
+
+	resumedJob, err := pc.awaitResumedJob(ctx, func(job PendingJob) bool {
+		return job.Operation == JobOperation.CREATE_BROKER && job.BrokerName == r.Name
+	})
+	if err != nil {
+		return nil, fmt.Errorf(CreateBrokerError, r.Name, err)
+	}
+	if resumedJob != nil && resumedJob.err == nil {
+		logger.Infof("Service broker with name %s was created by a resumed job", r.Name)
+		return pc.GetBrokerByName(ctx, r.Name)
+	}
+
 	request := PlatformClientRequest{
 		CTX:    ctx,
 		URL:    "/v3/service_brokers",
 		Method: http.MethodPost,
 		RequestBody: CCSaveServiceBrokerRequest{
-			Name: r.Name,
+			Name: pc.brokerNamer.platformName(r.Name),
 			URL:  r.BrokerURL,
 			Authentication: &CCAuthentication{
 				Type: AuthenticationType.BASIC,
@@ -160,25 +227,37 @@ func (pc *PlatformClient) CreateBroker(ctx context.Context, r *platform.CreateSe
 					Password: r.Password,
 				},
 			},
+			Metadata: pc.brokerMetadata(r.ID),
 		},
 	}
 
 	res, err := pc.MakeRequest(request)
-	if err != nil || res.JobURL == "" {
+	if err != nil && pc.settings.CF.AdoptExistingBrokers && isUnprocessableEntityError(err) {
+		return pc.adoptBroker(ctx, r, err)
+	}
+	if err != nil {
 		return nil, fmt.Errorf(CreateBrokerError, r.Name, err)
 	}
+	if res.JobURL == "" {
+		return nil, fmt.Errorf(CreateBrokerError, r.Name, errMissingJobURL)
+	}
 
 	jobURL, err := url.Parse(res.JobURL)
 	if err != nil {
 		return nil, fmt.Errorf(CreateBrokerError, r.Name, err)
 	}
 
-	jobErr := pc.ScheduleJobPolling(ctx, jobURL.Path)
+	logger.Infof("Start polling job url: %s, for create broker operation of broker with name %s", res.JobURL, r.Name)
+	jobErr := pc.pollBrokerJob(ctx, PendingJob{
+		URL:        jobURL.Path,
+		Operation:  JobOperation.CREATE_BROKER,
+		BrokerName: r.Name,
+		StartedAt:  time.Now(),
+	})
 	if jobErr != nil {
 		return nil, fmt.Errorf(CreateBrokerError, r.Name, jobErr.Error)
 	}
 
-	logger.Infof("Start polling job url: %s, for create broker operation: %v", res.JobURL, r)
 	broker, err := pc.GetBrokerByName(ctx, r.Name)
 	if err != nil {
 		return nil, fmt.Errorf(CreateBrokerError, r.Name, err)
@@ -194,10 +273,63 @@ func (pc *PlatformClient) CreateBroker(ctx context.Context, r *platform.CreateSe
 	return response, nil
 }
 
+// adoptBroker takes over the broker registered in CF with the name of the broker to create, if it is registered
+// with the same URL or with a URL of the proxy. The broker is updated to point to Service Manager, which labels it as managed.
+func (pc *PlatformClient) adoptBroker(ctx context.Context, r *platform.CreateServiceBrokerRequest, createErr error) (*platform.ServiceBroker, error) {
+	existingBroker, err := pc.GetBrokerByName(ctx, r.Name)
+	if err != nil {
+		// the creation did not fail because of a name conflict
+		return nil, fmt.Errorf(CreateBrokerError, r.Name, createErr)
+	}
+
+	if existingBroker.BrokerURL != r.BrokerURL && !pc.isManagedBrokerURL(existingBroker.BrokerURL) {
+		return nil, fmt.Errorf("service broker with name %s and GUID %s cannot be adopted as its URL %s is not registered by Service Manager",
+			existingBroker.Name, existingBroker.GUID, existingBroker.BrokerURL)
+	}
+
+	log.C(ctx).Infof("Adopting service broker with name %s, GUID %s and URL %s",
+		existingBroker.Name, existingBroker.GUID, existingBroker.BrokerURL)
+	return pc.UpdateBroker(ctx, &platform.UpdateServiceBrokerRequest{
+		ID:        r.ID,
+		GUID:      existingBroker.GUID,
+		Name:      r.Name,
+		BrokerURL: r.BrokerURL,
+		Username:  r.Username,
+		Password:  r.Password,
+	})
+}
+
 // DeleteBroker implements service-broker-proxy/pkg/cf/Client.DeleteBroker and provides logic for
 // deleting broker in CF
 func (pc *PlatformClient) DeleteBroker(ctx context.Context, r *platform.DeleteServiceBrokerRequest) error {
 	logger := log.C(ctx)
+	if pc.isDryRun() {
+		pc.dryRunPlan.record(ctx, DryRunAction{
+			Operation:  DryRunOperation.DELETE_BROKER,
+			BrokerGUID: r.GUID,
+			BrokerName: r.Name,
+		})
+		return nil
+	}
+
+	if broker, found := pc.knownBrokers.get(r.GUID); found && !pc.isManagedBroker(broker) {
+		return fmt.Errorf(DeleteBrokerError, r.GUID, errors.New("the broker is not managed by Service Manager"))
+	}
+	resumedJob, err := pc.awaitResumedJob(ctx, func(job PendingJob) bool {
+		return job.BrokerGUID == r.GUID
+	})
+	if err != nil {
+		return fmt.Errorf(DeleteBrokerError, r.GUID, err)
+	}
+	if resumedJob != nil && resumedJob.err == nil && resumedJob.Operation == JobOperation.DELETE_BROKER {
+		logger.Infof("Service broker with GUID %s was deleted by a resumed job", r.GUID)
+		return nil
+	}
+
+	if err := pc.checkBrokerInstances(ctx, r); err != nil {
+		return fmt.Errorf(DeleteBrokerError, r.GUID, err)
+	}
+
 	path := fmt.Sprintf("/v3/service_brokers/%s", r.GUID)
 	request := PlatformClientRequest{
 		CTX:    ctx,
@@ -206,21 +338,31 @@ func (pc *PlatformClient) DeleteBroker(ctx context.Context, r *platform.DeleteSe
 	}
 
 	res, err := pc.MakeRequest(request)
-	if err != nil || res.JobURL == "" {
-		return fmt.Errorf(DeleteBrokerError, r.Name, err)
+	if err != nil {
+		return fmt.Errorf(DeleteBrokerError, r.GUID, err)
+	}
+	if res.JobURL == "" {
+		return fmt.Errorf(DeleteBrokerError, r.GUID, errMissingJobURL)
 	}
 
 	jobURL, err := url.Parse(res.JobURL)
 	if err != nil {
-		return fmt.Errorf(DeleteBrokerError, r.Name, err)
+		return fmt.Errorf(DeleteBrokerError, r.GUID, err)
 	}
 
-	logger.Infof("Start polling job url: %s, for delete broker operation: %v", res.JobURL, r)
-	jobErr := pc.ScheduleJobPolling(ctx, jobURL.Path)
+	logger.Infof("Start polling job url: %s, for delete broker operation of broker with name %s", res.JobURL, r.Name)
+	jobErr := pc.pollBrokerJob(ctx, PendingJob{
+		URL:        jobURL.Path,
+		Operation:  JobOperation.DELETE_BROKER,
+		BrokerGUID: r.GUID,
+		BrokerName: r.Name,
+		StartedAt:  time.Now(),
+	})
 	if jobErr != nil {
-		return fmt.Errorf(DeleteBrokerError, r.Name, jobErr.Error)
+		return fmt.Errorf(DeleteBrokerError, r.GUID, jobErr.Error)
 	}
 
+	pc.knownBrokers.remove(r.GUID)
 	logger.Infof("Deleted service broker with GUID %s", r.GUID)
 	return nil
 }
@@ -229,10 +371,35 @@ func (pc *PlatformClient) DeleteBroker(ctx context.Context, r *platform.DeleteSe
 // updating a broker registration in CF
 func (pc *PlatformClient) UpdateBroker(ctx context.Context, r *platform.UpdateServiceBrokerRequest) (*platform.ServiceBroker, error) {
 	logger := log.C(ctx)
+	if pc.isDryRun() {
+		pc.dryRunPlan.record(ctx, DryRunAction{
+			Operation:  DryRunOperation.UPDATE_BROKER,
+			BrokerGUID: r.GUID,
+			BrokerName: r.Name,
+			BrokerURL:  r.BrokerURL,
+		})
+		return &platform.ServiceBroker{
+			GUID:      r.GUID,
+			Name:      r.Name,
+			BrokerURL: r.BrokerURL,
+		}, nil
+	}
+
+	if broker, found := pc.knownBrokers.get(r.GUID); found && pc.isForeignBroker(broker) {
+		return nil, fmt.Errorf(UpdateBrokerError, r.GUID,
+			fmt.Errorf("the broker is registered by proxy instance %s", broker.Metadata.Labels[ProxyInstanceLabel]))
+	}
+	if _, err := pc.awaitResumedJob(ctx, func(job PendingJob) bool {
+		return job.BrokerGUID == r.GUID
+	}); err != nil {
+		return nil, fmt.Errorf(UpdateBrokerError, r.GUID, err)
+	}
+
 	requestBody := CCSaveServiceBrokerRequest{
-		Name:           r.Name,
+		Name:           pc.brokerNamer.platformName(r.Name),
 		URL:            r.BrokerURL,
 		Authentication: nil,
+		Metadata:       pc.brokerMetadata(r.ID),
 	}
 	if len(r.Username) > 0 && len(r.Password) > 0 {
 		requestBody.Authentication = &CCAuthentication{
@@ -252,25 +419,35 @@ func (pc *PlatformClient) UpdateBroker(ctx context.Context, r *platform.UpdateSe
 	}
 
 	res, err := pc.MakeRequest(request)
-	if err != nil || res.JobURL == "" {
-		return nil, fmt.Errorf(UpdateBrokerError, r.Name, err)
+	if err != nil {
+		return nil, fmt.Errorf(UpdateBrokerError, r.GUID, err)
+	}
+	if res.JobURL == "" {
+		return nil, fmt.Errorf(UpdateBrokerError, r.GUID, errMissingJobURL)
 	}
 
 	jobURL, err := url.Parse(res.JobURL)
 	if err != nil {
-		return nil, fmt.Errorf(UpdateBrokerError, r.Name, err)
+		return nil, fmt.Errorf(UpdateBrokerError, r.GUID, err)
 	}
 
-	logger.Infof("Start polling job url: %s, for update broker operation: %v", res.JobURL, r)
-	jobErr := pc.ScheduleJobPolling(ctx, jobURL.Path)
+	logger.Infof("Start polling job url: %s, for update broker operation of broker with name %s", res.JobURL, r.Name)
+	jobErr := pc.pollBrokerJob(ctx, PendingJob{
+		URL:        jobURL.Path,
+		Operation:  JobOperation.UPDATE_BROKER,
+		BrokerGUID: r.GUID,
+		BrokerName: r.Name,
+		StartedAt:  time.Now(),
+	})
 	if jobErr != nil {
-		return nil, fmt.Errorf(UpdateBrokerError, r.Name, jobErr.Error)
+		return nil, fmt.Errorf(UpdateBrokerError, r.GUID, jobErr.Error)
 	}
 
 	broker, err := pc.GetBroker(ctx, r.GUID)
 	if err != nil {
-		return nil, fmt.Errorf(CreateBrokerError, r.Name, err)
+		return nil, fmt.Errorf(UpdateBrokerError, r.GUID, err)
 	}
+	pc.planResolver.RenameBroker(broker.GUID, broker.Name)
 
 	logger.Infof("Updated service broker with GUID %s, name %s and URL %s",
 		broker.GUID, broker.Name, broker.BrokerURL)
@@ -278,6 +455,15 @@ func (pc *PlatformClient) UpdateBroker(ctx context.Context, r *platform.UpdateSe
 	return broker, err
 }
 
+// isManagedBrokerURL reports whether the broker URL points to the proxy, i.e. the broker is registered by Service Manager
+func (pc *PlatformClient) isManagedBrokerURL(brokerURL string) bool {
+	reconcileSettings := pc.settings.Reconcile
+	if reconcileSettings.URL != "" && strings.HasPrefix(brokerURL, reconcileSettings.URL+sbproxy.APIPrefix) {
+		return true
+	}
+	return reconcileSettings.LegacyURL != "" && strings.HasPrefix(brokerURL, reconcileSettings.LegacyURL+sbproxy.APIPrefix)
+}
+
 func (pc *PlatformClient) ListServiceBrokersByQuery(ctx context.Context, query url.Values) ([]CCServiceBroker, error) {
 	var serviceBrokers []CCServiceBroker
 
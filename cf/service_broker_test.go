@@ -2,16 +2,22 @@ package cf_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/Peripli/service-broker-proxy-cf/cf"
 	"github.com/Peripli/service-broker-proxy-cf/cf/internal"
 	"github.com/Peripli/service-broker-proxy/pkg/platform"
+	"github.com/Peripli/service-manager/pkg/log"
 	"github.com/gofrs/uuid"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
 	"io"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
 )
 
 var _ = Describe("Client ServiceBroker", func() {
@@ -128,6 +134,79 @@ var _ = Describe("Client ServiceBroker", func() {
 					assertBrokersFoundMatchTestBroker(1, brokers...)
 				})
 			})
+
+			Context("space-scoped broker registered by Service Manager exists", func() {
+				It("returns the global brokers and the space-scoped broker", func() {
+					ccSpaceScopedBroker.URL = "http://10.0.2.2/v1/osb/broker-id"
+					setCCBrokersResponse(ccServer, []*cf.CCServiceBroker{&ccGlobalBroker, &ccSpaceScopedBroker})
+					brokers, err := client.GetBrokers(ctx)
+
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(brokers).To(ConsistOf(testBroker, &platform.ServiceBroker{
+						GUID:      ccSpaceScopedBroker.GUID,
+						Name:      ccSpaceScopedBroker.Name,
+						BrokerURL: ccSpaceScopedBroker.URL,
+					}))
+				})
+			})
+
+			Context("broker named by the broker name template exists", func() {
+				It("returns the broker with its Service Manager name", func() {
+					settings := testhelper.CCSettings(ccServer.URL(), maxAllowedParallelRequests, JobPollTimeout)
+					settings.CF.BrokerNameTemplate = "sm-{{.Name}}-{{.Env}}"
+					settings.CF.BrokerNameEnv = "dev"
+					client, err = cf.NewClient(settings)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					ccGlobalBroker.Name = "sm-" + testBroker.Name + "-dev"
+					setCCBrokersResponse(ccServer, []*cf.CCServiceBroker{&ccGlobalBroker})
+					brokers, err := client.GetBrokers(ctx)
+
+					Expect(err).ShouldNot(HaveOccurred())
+					assertBrokersFoundMatchTestBroker(1, brokers...)
+				})
+			})
+
+			Context("broker not named by the broker name template exists", func() {
+				It("returns only the brokers named by the template", func() {
+					settings := testhelper.CCSettings(ccServer.URL(), maxAllowedParallelRequests, JobPollTimeout)
+					settings.CF.BrokerNameTemplate = "sm-{{.Name}}-{{.Env}}"
+					settings.CF.BrokerNameEnv = "dev"
+					client, err = cf.NewClient(settings)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					otherBroker := ccGlobalBroker
+					otherBroker.GUID = "other-broker-guid"
+					otherBroker.Name = "other-broker"
+					ccGlobalBroker.Name = "sm-" + testBroker.Name + "-dev"
+					setCCBrokersResponse(ccServer, []*cf.CCServiceBroker{&ccGlobalBroker, &otherBroker})
+					brokers, err := client.GetBrokers(ctx)
+
+					Expect(err).ShouldNot(HaveOccurred())
+					assertBrokersFoundMatchTestBroker(1, brokers...)
+				})
+			})
+
+			Context("broker labeled by another proxy instance exists", func() {
+				It("returns only the brokers not labeled by other proxy instances", func() {
+					settings := testhelper.CCSettings(ccServer.URL(), maxAllowedParallelRequests, JobPollTimeout)
+					settings.CF.ProxyInstance = "proxy-a"
+					client, err = cf.NewClient(settings)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					foreignBroker := ccGlobalBroker
+					foreignBroker.GUID = "foreign-broker-guid"
+					foreignBroker.Metadata.Labels = map[string]string{
+						cf.ManagedBrokerLabel: "true",
+						cf.ProxyInstanceLabel: "proxy-b",
+					}
+					setCCBrokersResponse(ccServer, []*cf.CCServiceBroker{&ccGlobalBroker, &foreignBroker})
+					brokers, err := client.GetBrokers(ctx)
+
+					Expect(err).ShouldNot(HaveOccurred())
+					assertBrokersFoundMatchTestBroker(1, brokers...)
+				})
+			})
 		})
 	})
 
@@ -175,6 +254,21 @@ var _ = Describe("Client ServiceBroker", func() {
 			})
 		})
 
+		Context("when the broker is not named by the broker name template", func() {
+			It("returns an error", func() {
+				settings := testhelper.CCSettings(ccServer.URL(), maxAllowedParallelRequests, JobPollTimeout)
+				settings.CF.BrokerNameTemplate = "sm-{{.Name}}-{{.Env}}"
+				settings.CF.BrokerNameEnv = "dev"
+				client, err = cf.NewClient(settings)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				setCCGetBrokerResponse(ccServer, []*cf.CCServiceBroker{&ccGlobalBroker})
+				_, err := client.GetBroker(ctx, brokerGUID)
+
+				Expect(err).To(MatchError(ContainSubstring("is not named by the broker name template")))
+			})
+		})
+
 	})
 
 	Describe("GetBrokerByName", func() {
@@ -233,6 +327,17 @@ var _ = Describe("Client ServiceBroker", func() {
 							ccSpaceScopedBroker.Name, ccSpaceScopedBroker.GUID, cfSpaceGUID)))
 				})
 			})
+
+			Context("when the broker is space-scoped and registered by Service Manager", func() {
+				It("returns the broker", func() {
+					ccSpaceScopedBroker.URL = "http://10.0.2.2/v1/osb/broker-id"
+					setCCBrokersResponse(ccServer, []*cf.CCServiceBroker{&ccSpaceScopedBroker})
+					broker, err := client.GetBrokerByName(ctx, ccSpaceScopedBroker.Name)
+
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(broker.GUID).To(Equal(ccSpaceScopedBroker.GUID))
+				})
+			})
 		})
 
 	})
@@ -251,6 +356,7 @@ var _ = Describe("Client ServiceBroker", func() {
 						Password: brokerPassword,
 					},
 				},
+				Metadata: managedBrokerMetadata(),
 			}
 
 			actualRequest = &platform.CreateServiceBrokerRequest{
@@ -299,6 +405,180 @@ var _ = Describe("Client ServiceBroker", func() {
 				Expect(err).ShouldNot(HaveOccurred())
 				Expect(broker).To(Equal(testBroker))
 			})
+
+			It("labels the broker with the Service Manager broker ID and the proxy instance", func() {
+				settings := testhelper.CCSettings(ccServer.URL(), maxAllowedParallelRequests, JobPollTimeout)
+				settings.CF.ProxyInstance = "proxy-a"
+				client, err = cf.NewClient(settings)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				expectedMetadata := managedBrokerMetadata()
+				expectedMetadata.Labels[cf.BrokerIDLabel] = "sm-broker-id"
+				expectedMetadata.Labels[cf.ProxyInstanceLabel] = "proxy-a"
+				ccServer.SetHandler(0, ghttp.CombineHandlers(
+					ghttp.VerifyRequest(http.MethodPost, "/v3/service_brokers"),
+					func(rw http.ResponseWriter, req *http.Request) {
+						var body cf.CCSaveServiceBrokerRequest
+						Expect(json.NewDecoder(req.Body).Decode(&body)).To(Succeed())
+						Expect(body.Metadata).To(Equal(expectedMetadata))
+					},
+					ghttp.RespondWith(http.StatusAccepted, nil, http.Header{
+						"Location": {fmt.Sprintf("/v3/jobs/%s", jobGUID.String())},
+					}),
+				))
+				setCCJobResponse(ccServer, false, cf.JobState.COMPLETE)
+				setCCBrokersResponse(ccServer, []*cf.CCServiceBroker{&ccGlobalBroker})
+
+				actualRequest.ID = "sm-broker-id"
+				_, err := client.CreateBroker(ctx, actualRequest)
+
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+
+			It("registers the broker with the name of the broker name template", func() {
+				settings := testhelper.CCSettings(ccServer.URL(), maxAllowedParallelRequests, JobPollTimeout)
+				settings.CF.BrokerNameTemplate = "sm-{{.Name}}-{{.Env}}"
+				settings.CF.BrokerNameEnv = "dev"
+				client, err = cf.NewClient(settings)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				platformName := "sm-" + testBroker.Name + "-dev"
+				ccServer.SetHandler(0, ghttp.CombineHandlers(
+					ghttp.VerifyRequest(http.MethodPost, "/v3/service_brokers"),
+					func(rw http.ResponseWriter, req *http.Request) {
+						var body cf.CCSaveServiceBrokerRequest
+						Expect(json.NewDecoder(req.Body).Decode(&body)).To(Succeed())
+						Expect(body.Name).To(Equal(platformName))
+					},
+					ghttp.RespondWith(http.StatusAccepted, nil, http.Header{
+						"Location": {fmt.Sprintf("/v3/jobs/%s", jobGUID.String())},
+					}),
+				))
+				setCCJobResponse(ccServer, false, cf.JobState.COMPLETE)
+				ccGlobalBroker.Name = platformName
+				setCCBrokersResponse(ccServer, []*cf.CCServiceBroker{&ccGlobalBroker})
+
+				broker, err := client.CreateBroker(ctx, actualRequest)
+
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(broker).To(Equal(testBroker))
+			})
+
+			It("returns the details of a failed job", func() {
+				ccServer.RouteToHandler(http.MethodGet, fmt.Sprintf("/v3/jobs/%s", jobGUID.String()), func(rw http.ResponseWriter, req *http.Request) {
+					writeJSONResponse(cf.Job{
+						GUID:  jobGUID.String(),
+						State: cf.JobState.FAILED,
+						RawErrors: []cf.JobErrorDetails{
+							{Code: 270012, Title: "CF-ServiceBrokerCatalogInvalid", Detail: "Service broker catalog is invalid"},
+						},
+					}, rw)
+				})
+
+				_, err := client.CreateBroker(ctx, actualRequest)
+
+				var failedErr *cf.JobFailedError
+				Expect(errors.As(err, &failedErr)).To(BeTrue())
+				Expect(failedErr.Operation).To(Equal(cf.JobOperation.CREATE_BROKER))
+				Expect(failedErr.Errors).To(HaveLen(1))
+				Expect(err.Error()).To(ContainSubstring("create_broker operation failed"))
+				Expect(err.Error()).To(ContainSubstring("Service broker catalog is invalid (CF-ServiceBrokerCatalogInvalid, code 270012)"))
+			})
+
+			It("does not log the broker password", func() {
+				setCCJobResponse(ccServer, false, cf.JobState.COMPLETE)
+				setCCBrokersResponse(ccServer, []*cf.CCServiceBroker{&ccGlobalBroker})
+
+				ctx, err := log.Configure(context.Background(), &log.Settings{
+					Level:  "debug",
+					Format: "text",
+					Output: "ginkgowriter",
+				})
+				Expect(err).ShouldNot(HaveOccurred())
+
+				_, err = client.CreateBroker(ctx, actualRequest)
+
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(logInterceptor.String()).To(ContainSubstring(cf.RedactedValue))
+				Expect(logInterceptor.String()).NotTo(ContainSubstring(brokerUsername))
+				Expect(logInterceptor.String()).NotTo(ContainSubstring("Password:" + brokerPassword))
+			})
+		})
+		Context("when a broker with the same name exists in CC", func() {
+			var patchRequests int
+
+			BeforeEach(func() {
+				ccResponseCode = http.StatusUnprocessableEntity
+				ccResponse = cf.CCErrorResponse{
+					Errors: []cf.CCError{{Code: 10008, Title: "CF-UnprocessableEntity", Detail: "Name must be unique"}},
+				}
+				patchRequests = 0
+
+				setCCJobResponse(ccServer, false, cf.JobState.COMPLETE)
+				setCCGetBrokerResponse(ccServer, []*cf.CCServiceBroker{&ccGlobalBroker})
+				ccServer.RouteToHandler(http.MethodPatch, "/v3/service_brokers/"+testBroker.GUID, func(rw http.ResponseWriter, req *http.Request) {
+					patchRequests++
+					var body cf.CCSaveServiceBrokerRequest
+					Expect(json.NewDecoder(req.Body).Decode(&body)).To(Succeed())
+					Expect(body.URL).To(Equal(actualRequest.BrokerURL))
+					Expect(body.Metadata.Labels).To(HaveKeyWithValue(cf.ManagedBrokerLabel, "true"))
+
+					rw.Header().Set("Location", fmt.Sprintf("/v3/jobs/%s", jobGUID.String()))
+					rw.WriteHeader(http.StatusAccepted)
+				})
+			})
+
+			Context("when adoption is disabled", func() {
+				It("returns an error", func() {
+					setCCBrokersResponse(ccServer, []*cf.CCServiceBroker{&ccGlobalBroker})
+
+					_, err := client.CreateBroker(ctx, actualRequest)
+
+					Expect(err).To(HaveOccurred())
+					Expect(patchRequests).To(BeZero())
+				})
+			})
+
+			Context("when adoption is enabled", func() {
+				BeforeEach(func() {
+					settings := testhelper.CCSettings(ccServer.URL(), maxAllowedParallelRequests, JobPollTimeout)
+					settings.CF.AdoptExistingBrokers = true
+					client, err = cf.NewClient(settings)
+					Expect(err).ShouldNot(HaveOccurred())
+				})
+
+				It("adopts the broker if it is registered with the same URL", func() {
+					setCCBrokersResponse(ccServer, []*cf.CCServiceBroker{&ccGlobalBroker})
+
+					broker, err := client.CreateBroker(ctx, actualRequest)
+
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(broker).To(Equal(testBroker))
+					Expect(patchRequests).To(Equal(1))
+				})
+
+				It("adopts the broker if it is registered with a URL of the proxy", func() {
+					proxyBroker := ccGlobalBroker
+					proxyBroker.URL = "http://proxy.com/v1/osb/broker-id"
+					setCCBrokersResponse(ccServer, []*cf.CCServiceBroker{&proxyBroker})
+
+					_, err := client.CreateBroker(ctx, actualRequest)
+
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(patchRequests).To(Equal(1))
+				})
+
+				It("does not adopt the broker if it is registered with another URL", func() {
+					otherBroker := ccGlobalBroker
+					otherBroker.URL = "http://other-broker.com"
+					setCCBrokersResponse(ccServer, []*cf.CCServiceBroker{&otherBroker})
+
+					_, err := client.CreateBroker(ctx, actualRequest)
+
+					Expect(err).To(MatchError(ContainSubstring("cannot be adopted")))
+					Expect(patchRequests).To(BeZero())
+				})
+			})
 		})
 	})
 
@@ -319,6 +599,7 @@ var _ = Describe("Client ServiceBroker", func() {
 					}),
 				),
 			)
+			setCCServiceOfferingsResponse(ccServer, map[string][]*cf.CCServiceOffering{})
 		})
 
 		Context("when an error status code is returned by CC", func() {
@@ -330,7 +611,8 @@ var _ = Describe("Client ServiceBroker", func() {
 			It("returns an error", func() {
 				err := client.DeleteBroker(ctx, actualRequest)
 
-				Expect(err).To(HaveOccurred())
+				Expect(err).To(MatchError(ContainSubstring(
+					fmt.Sprintf("could not delete service broker with GUID %s", testBroker.GUID))))
 			})
 		})
 
@@ -348,12 +630,203 @@ var _ = Describe("Client ServiceBroker", func() {
 				Expect(err).ShouldNot(HaveOccurred())
 			})
 		})
+
+		Context("when the broker is known not to be managed by Service Manager", func() {
+			It("returns an error without deleting it", func() {
+				setCCBrokersResponse(ccServer, []*cf.CCServiceBroker{&ccGlobalBroker})
+				_, err := client.GetBrokers(ctx)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				err = client.DeleteBroker(ctx, actualRequest)
+
+				Expect(err).To(MatchError(ContainSubstring("the broker is not managed by Service Manager")))
+			})
+		})
+
+		Context("when the broker is labeled as managed by Service Manager", func() {
+			BeforeEach(func() {
+				ccResponseCode = http.StatusAccepted
+				ccResponse = nil
+			})
+
+			It("deletes it", func() {
+				ccGlobalBroker.Metadata.Labels = map[string]string{cf.ManagedBrokerLabel: "true"}
+				setCCBrokersResponse(ccServer, []*cf.CCServiceBroker{&ccGlobalBroker})
+				setCCJobResponse(ccServer, false, cf.JobState.COMPLETE)
+				_, err := client.GetBrokers(ctx)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				err = client.DeleteBroker(ctx, actualRequest)
+
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+		})
+
+		Context("when the broker still has service instances", func() {
+			var (
+				plans          map[string][]*cf.CCServicePlan
+				planInUse      *cf.CCServicePlan
+				deleteRequests func() int
+			)
+
+			BeforeEach(func() {
+				ccResponseCode = http.StatusAccepted
+				ccResponse = nil
+
+				serviceOfferings := generateCFServiceOfferings([]*cf.CCServiceBroker{&ccGlobalBroker}, 1)
+				serviceOffering := serviceOfferings[ccGlobalBroker.GUID][0]
+				serviceOffering.Name = "test-service"
+				plans = generateCFPlans(serviceOfferings, 1, 1)
+				planInUse = plans[serviceOffering.GUID][0]
+				planInUse.Name = "test-plan"
+				setCCServiceOfferingsResponse(ccServer, serviceOfferings)
+				setCCPlansResponse(ccServer, plans)
+
+				var serviceInstances []*cf.CCServiceInstance
+				for i := 0; i < 2; i++ {
+					serviceInstances = append(serviceInstances, &cf.CCServiceInstance{
+						GUID: fmt.Sprintf("instance-%d", i),
+						Relationships: cf.CCServiceInstanceRelationships{
+							ServicePlan: cf.CCRelationship{Data: cf.CCData{GUID: planInUse.GUID}},
+						},
+					})
+				}
+				setCCServiceInstancesResponse(ccServer, serviceInstances)
+
+				deleteRequests = func() int {
+					count := 0
+					for _, req := range ccServer.ReceivedRequests() {
+						if req.Method == http.MethodDelete {
+							count++
+						}
+					}
+					return count
+				}
+			})
+
+			It("returns an error listing the plans in use without deleting the broker", func() {
+				err := client.DeleteBroker(ctx, actualRequest)
+
+				var inUseErr *cf.BrokerInUseError
+				Expect(errors.As(err, &inUseErr)).To(BeTrue())
+				Expect(inUseErr.PlansInUse).To(Equal([]cf.PlanUsage{{
+					ServiceOfferingName: "test-service",
+					PlanName:            "test-plan",
+					PlanGUID:            planInUse.GUID,
+					Instances:           2,
+				}}))
+				Expect(err).To(MatchError(ContainSubstring("service offering test-service plan test-plan (2 instances)")))
+				Expect(deleteRequests()).To(BeZero())
+			})
+
+			It("lists the service instances of all the plans at once", func() {
+				Expect(client.DeleteBroker(ctx, actualRequest)).To(HaveOccurred())
+
+				var listRequests []url.Values
+				for _, req := range ccServer.ReceivedRequests() {
+					if req.URL.Path == "/v3/service_instances" {
+						listRequests = append(listRequests, req.URL.Query())
+					}
+				}
+				Expect(listRequests).To(HaveLen(1))
+				var planGUIDs []string
+				for _, servicePlans := range plans {
+					for _, plan := range servicePlans {
+						planGUIDs = append(planGUIDs, plan.GUID)
+					}
+				}
+				Expect(strings.Split(listRequests[0].Get(cf.CCQueryParams.ServicePlanGuids), ",")).To(ConsistOf(planGUIDs))
+			})
+
+			Context("when the broker deletion policy is revoke_visibilities", func() {
+				BeforeEach(func() {
+					settings := testhelper.CCSettings(ccServer.URL(), maxAllowedParallelRequests, JobPollTimeout)
+					settings.CF.BrokerDeletionPolicy = cf.BrokerDeletionPolicy.REVOKE_VISIBILITIES
+					client, err = cf.NewClient(settings)
+					Expect(err).ShouldNot(HaveOccurred())
+				})
+
+				It("keeps the broker, makes its plans visible to admins only and returns an error", func() {
+					var revokedPlans []string
+					ccServer.RouteToHandler(http.MethodPatch, regexp.MustCompile(`/v3/service_plans/(?P<guid>[A-Za-z0-9_-]+)`),
+						func(rw http.ResponseWriter, req *http.Request) {
+							body, err := io.ReadAll(req.Body)
+							Expect(err).ShouldNot(HaveOccurred())
+							Expect(string(body)).To(ContainSubstring(string(cf.VisibilityType.ADMIN)))
+							revokedPlans = append(revokedPlans, req.URL.Path)
+							rw.WriteHeader(http.StatusOK)
+						})
+
+					err := client.DeleteBroker(ctx, actualRequest)
+
+					var inUseErr *cf.BrokerInUseError
+					Expect(errors.As(err, &inUseErr)).To(BeTrue())
+					Expect(inUseErr.VisibilitiesRevoked).To(BeTrue())
+					Expect(err).To(MatchError(ContainSubstring("the visibilities of its plans are revoked instead")))
+					Expect(revokedPlans).To(HaveLen(2))
+					Expect(deleteRequests()).To(BeZero())
+				})
+
+				It("keeps the plans visible to admins only in the cache", func() {
+					ccGlobalBroker.Metadata.Labels = map[string]string{cf.ManagedBrokerLabel: "true"}
+					setCCBrokersResponse(ccServer, []*cf.CCServiceBroker{&ccGlobalBroker})
+					Expect(client.ResetCache(ctx)).To(Succeed())
+					ccServer.RouteToHandler(http.MethodPatch, regexp.MustCompile(`/v3/service_plans/(?P<guid>[A-Za-z0-9_-]+)`),
+						ghttp.RespondWith(http.StatusOK, nil))
+					ccServer.RouteToHandler(http.MethodGet, regexp.MustCompile(`/v3/service_plans/(?P<guid>[A-Za-z0-9_-]+)/visibility`),
+						ghttp.RespondWithJSONEncoded(http.StatusOK, cf.ServicePlanVisibilitiesResponse{Type: string(cf.VisibilityType.ADMIN)}))
+
+					Expect(client.DeleteBroker(ctx, actualRequest)).To(HaveOccurred())
+					visibilities, err := client.GetVisibilitiesByBrokers(ctx, []string{testBroker.Name})
+
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(visibilities).To(HaveLen(2))
+					for _, visibility := range visibilities {
+						Expect(visibility.Public).To(BeFalse())
+						Expect(visibility.Labels).To(Equal(map[string]string{
+							cf.VisibilityTypeLabelKey: string(cf.VisibilityType.ADMIN),
+						}))
+					}
+				})
+			})
+
+			Context("when the broker deletion policy is force", func() {
+				BeforeEach(func() {
+					settings := testhelper.CCSettings(ccServer.URL(), maxAllowedParallelRequests, JobPollTimeout)
+					settings.CF.BrokerDeletionPolicy = cf.BrokerDeletionPolicy.FORCE
+					client, err = cf.NewClient(settings)
+					Expect(err).ShouldNot(HaveOccurred())
+				})
+
+				It("deletes the broker without checking its service instances", func() {
+					setCCJobResponse(ccServer, false, cf.JobState.COMPLETE)
+
+					err := client.DeleteBroker(ctx, actualRequest)
+
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(deleteRequests()).To(Equal(1))
+				})
+			})
+		})
 	})
 
 	Describe("UpdateBroker", func() {
 		var actualRequest *platform.UpdateServiceBrokerRequest
 
 		BeforeEach(func() {
+			expectedRequest = &cf.CCSaveServiceBrokerRequest{
+				Name: testBroker.Name,
+				URL:  testBroker.BrokerURL,
+				Authentication: &cf.CCAuthentication{
+					Type: cf.AuthenticationType.BASIC,
+					Credentials: cf.CCCredentials{
+						Username: brokerUsername,
+						Password: brokerPassword,
+					},
+				},
+				Metadata: managedBrokerMetadata(),
+			}
+
 			actualRequest = &platform.UpdateServiceBrokerRequest{
 				GUID:      testBroker.GUID,
 				Name:      testBroker.Name,
@@ -401,6 +874,42 @@ var _ = Describe("Client ServiceBroker", func() {
 				Expect(err).ShouldNot(HaveOccurred())
 				Expect(broker).To(Equal(testBroker))
 			})
+
+			It("returns an update error if the updated broker cannot be retrieved", func() {
+				setCCJobResponse(ccServer, false, cf.JobState.COMPLETE)
+				setCCGetBrokerResponse(ccServer, nil)
+
+				_, err := client.UpdateBroker(ctx, actualRequest)
+
+				Expect(err).To(MatchError(ContainSubstring(
+					fmt.Sprintf("could not update service broker with GUID %s", testBroker.GUID))))
+			})
+
+			It("moves the cached plans of the broker to its new name", func() {
+				serviceOfferings := generateCFServiceOfferings([]*cf.CCServiceBroker{&ccGlobalBroker}, 1)
+				plans := generateCFPlans(serviceOfferings, 1, 0)
+				plan := plans[serviceOfferings[ccGlobalBroker.GUID][0].GUID][0]
+				setCCServiceOfferingsResponse(ccServer, serviceOfferings)
+				setCCPlansResponse(ccServer, plans)
+				Expect(client.ResetBroker(ctx, &platform.ServiceBroker{GUID: testBroker.GUID, Name: "old-name"}, false)).To(Succeed())
+
+				setCCJobResponse(ccServer, false, cf.JobState.COMPLETE)
+				setCCGetBrokerResponse(ccServer, []*cf.CCServiceBroker{&ccGlobalBroker})
+
+				_, err := client.UpdateBroker(ctx, actualRequest)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				Expect(client.EnableAccessForPlan(ctx, &platform.ModifyPlanAccessRequest{
+					BrokerName:    "old-name",
+					CatalogPlanID: plan.BrokerCatalog.ID,
+				})).To(MatchError(ContainSubstring("No plan found")))
+
+				setCCVisibilitiesUpdateResponse(ccServer, plans, false)
+				Expect(client.EnableAccessForPlan(ctx, &platform.ModifyPlanAccessRequest{
+					BrokerName:    testBroker.Name,
+					CatalogPlanID: plan.BrokerCatalog.ID,
+				})).To(Succeed())
+			})
 		})
 
 		Context("when username or password wasn't provided", func() {
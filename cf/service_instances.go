@@ -0,0 +1,55 @@
+package cf
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// CCServiceInstance CF CC partial Service Instance object
+type CCServiceInstance struct {
+	GUID          string                         `json:"guid"`
+	Name          string                         `json:"name"`
+	Relationships CCServiceInstanceRelationships `json:"relationships"`
+}
+
+// CCServiceInstanceRelationships CF CC Service Instance relationships object
+type CCServiceInstanceRelationships struct {
+	ServicePlan CCRelationship `json:"service_plan"`
+}
+
+// CCListServiceInstancesResponse CF CC pagination response for Service Instances list
+type CCListServiceInstancesResponse struct {
+	Pagination CCPagination        `json:"pagination"`
+	Resources  []CCServiceInstance `json:"resources"`
+}
+
+// ListServiceInstancesByQuery returns the service instances matching the query
+func (pc *PlatformClient) ListServiceInstancesByQuery(ctx context.Context, query url.Values) ([]CCServiceInstance, error) {
+	var serviceInstances []CCServiceInstance
+
+	requestUrl := "/v3/service_instances?" + query.Encode()
+	for {
+		var serviceInstancesResponse CCListServiceInstancesResponse
+		request := PlatformClientRequest{
+			CTX:          ctx,
+			URL:          requestUrl,
+			Method:       http.MethodGet,
+			ResponseBody: &serviceInstancesResponse,
+		}
+		_, err := pc.MakeRequest(request)
+		if err != nil {
+			return []CCServiceInstance{}, errors.Wrap(err, "Error requesting service instances")
+		}
+
+		serviceInstances = append(serviceInstances, serviceInstancesResponse.Resources...)
+		requestUrl = serviceInstancesResponse.Pagination.Next.Href
+		if requestUrl == "" {
+			break
+		}
+	}
+
+	return serviceInstances, nil
+}
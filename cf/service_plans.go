@@ -15,6 +15,7 @@ type ServicePlan struct {
 	CatalogPlanId       string
 	ServiceOfferingGuid string
 	Public              bool
+	VisibilityType      VisibilityTypeValue
 }
 
 // CCServicePlan CF CC partial Service Plan object
@@ -66,6 +67,7 @@ func (pc *PlatformClient) ListServicePlansByQuery(ctx context.Context, query url
 				CatalogPlanId:       servicePlan.BrokerCatalog.ID,
 				ServiceOfferingGuid: servicePlan.Relationships.ServiceOffering.Data.GUID,
 				Public:              servicePlan.VisibilityType == VisibilityType.PUBLIC,
+				VisibilityType:      servicePlan.VisibilityType,
 			})
 		}
 
@@ -107,6 +107,7 @@ var _ = Describe("Service Plans", func() {
 						Expect(plan.BrokerCatalog.ID).To(Equal(plansMap[plan.GUID].CatalogPlanId))
 						Expect(plan.Name).To(Equal(plansMap[plan.GUID].Name))
 						Expect(isPublic).To(Equal(plansMap[plan.GUID].Public))
+						Expect(plan.VisibilityType).To(Equal(plansMap[plan.GUID].VisibilityType))
 						Expect(plan.Relationships.ServiceOffering.Data.GUID).To(Equal(plansMap[plan.GUID].ServiceOfferingGuid))
 					}
 				}
@@ -5,16 +5,28 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/Peripli/service-broker-proxy/pkg/platform"
 	"github.com/Peripli/service-broker-proxy/pkg/sbproxy/reconcile"
 	"github.com/Peripli/service-manager/pkg/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // OrgLabelKey label key for CF organization visibilities
 const OrgLabelKey = "organization_guid"
 
+// SpaceLabelKey label key for the visibilities of plans from CF space-scoped brokers
+const SpaceLabelKey = "space_guid"
+
+// VisibilityTypeLabelKey label key for the CF visibility type of plans which are not visible in any organization or space
+const VisibilityTypeLabelKey = "visibility_type"
+
 var VisibilityType = struct {
 	PUBLIC       VisibilityTypeValue
 	ADMIN        VisibilityTypeValue
@@ -32,6 +44,7 @@ type VisibilityTypeValue string
 type ServicePlanVisibilitiesResponse struct {
 	Type          string         `json:"type"`
 	Organizations []Organization `json:"organizations"`
+	Space         *Space         `json:"space,omitempty"`
 }
 
 type UpdateOrganizationVisibilitiesRequest struct {
@@ -52,9 +65,16 @@ type Organization struct {
 	Name string `json:"name"`
 }
 
+// Space is the space of the service plan visibility of a space-scoped plan
+type Space struct {
+	Guid string `json:"guid"`
+	Name string `json:"name"`
+}
+
 type ServicePlanVisibility struct {
 	ServicePlanGuid  string
 	OrganizationGuid string
+	SpaceGuid        string
 }
 
 // VisibilityScopeLabelKey returns key to be used when scoping visibilities
@@ -64,17 +84,45 @@ func (pc *PlatformClient) VisibilityScopeLabelKey() string {
 
 // GetVisibilitiesByBrokers returns platform visibilities grouped by brokers based on given SM brokers.
 // The visibilities are taken from CF cloud controller.
-// For public plans, visibilities are created so that sync with sm visibilities is possible
-func (pc *PlatformClient) GetVisibilitiesByBrokers(ctx context.Context, brokerNames []string) ([]*platform.Visibility, error) {
+// For public plans, visibilities are created so that sync with sm visibilities is possible.
+// Plans visible only to admins are reported with their visibility type, so that they can be told apart
+// from the plans which are restricted to organizations but not visible in any of them.
+// The plans of space-scoped brokers are visible to everyone in the space of their broker,
+// so they are reported as public visibilities labeled with the GUID of the space.
+func (pc *PlatformClient) GetVisibilitiesByBrokers(ctx context.Context, brokerNames []string) (_ []*platform.Visibility, err error) {
+	ctx, span := startSpan(ctx, "GetVisibilitiesByBrokers", trace.WithAttributes(
+		attribute.StringSlice("cf.broker.names", brokerNames)))
+	defer func() { endSpan(span, err) }()
+
 	plans := pc.planResolver.GetBrokerPlans(brokerNames)
 	publicPlans := filterPublicPlans(plans)
+	adminPlans := filterAdminPlans(plans)
+
+	orgScopedPlanGUIDs, spaceScopedPlanGUIDs := splitPlanGUIDsByScope(plans)
 
-	visibilities, err := pc.getPlansVisibilities(ctx, getPlanGUIDs(plans))
+	visibilities, err := pc.getPlansVisibilities(ctx, orgScopedPlanGUIDs, pc.settings.CF.BulkVisibilities)
+	if err != nil {
+		return nil, err
+	}
+	// the bulk loading supports only organization visibilities
+	spaceVisibilities, err := pc.getPlansVisibilities(ctx, spaceScopedPlanGUIDs, false)
 	if err != nil {
 		return nil, err
 	}
 
-	result := make([]*platform.Visibility, 0, len(visibilities)+len(publicPlans))
+	result := make([]*platform.Visibility, 0, len(visibilities)+len(spaceVisibilities)+len(publicPlans)+len(adminPlans))
+
+	for _, visibility := range spaceVisibilities {
+		plan := plans[visibility.ServicePlanGuid]
+		result = append(result, &platform.Visibility{
+			Public:             true,
+			CatalogPlanID:      plan.CatalogPlanID,
+			PlatformBrokerName: plan.BrokerName,
+			Labels: map[string]string{
+				SpaceLabelKey: visibility.SpaceGuid,
+			},
+		})
+	}
 
 	for _, visibility := range visibilities {
 		plan := plans[visibility.ServicePlanGuid]
@@ -88,6 +136,18 @@ func (pc *PlatformClient) GetVisibilitiesByBrokers(ctx context.Context, brokerNa
 		})
 	}
 
+	// admin plans are visible only to CF admins, unlike the plans which are not visible in any organization
+	for _, plan := range adminPlans {
+		result = append(result, &platform.Visibility{
+			Public:             false,
+			CatalogPlanID:      plan.CatalogPlanID,
+			PlatformBrokerName: plan.BrokerName,
+			Labels: map[string]string{
+				VisibilityTypeLabelKey: string(VisibilityType.ADMIN),
+			},
+		})
+	}
+
 	for _, plan := range publicPlans {
 		result = append(result, &platform.Visibility{
 			Public:             true,
@@ -102,26 +162,62 @@ func (pc *PlatformClient) GetVisibilitiesByBrokers(ctx context.Context, brokerNa
 
 // UpdateServicePlanVisibilityType updates service plan visibility type
 func (pc *PlatformClient) UpdateServicePlanVisibilityType(ctx context.Context, planGUID string, visibilityType VisibilityTypeValue) error {
+	if pc.isDryRun() {
+		pc.dryRunPlan.record(ctx, DryRunAction{
+			Operation:      DryRunOperation.UPDATE_SERVICE_PLAN_VISIBILITY_TYPE,
+			PlanGUID:       planGUID,
+			VisibilityType: visibilityType,
+		})
+		return nil
+	}
 	return pc.updateServicePlanVisibilities(ctx, http.MethodPatch, planGUID, visibilityType)
 }
 
 // AddOrganizationVisibilities appends organization visibilities to the existing list of the organizations
 func (pc *PlatformClient) AddOrganizationVisibilities(ctx context.Context, planGUID string, organizationGUIDs []string) error {
+	if pc.isDryRun() {
+		pc.dryRunPlan.record(ctx, DryRunAction{
+			Operation:         DryRunOperation.ADD_ORGANIZATION_VISIBILITIES,
+			PlanGUID:          planGUID,
+			VisibilityType:    VisibilityType.ORGANIZATION,
+			OrganizationGUIDs: organizationGUIDs,
+		})
+		return nil
+	}
 	return pc.updateServicePlanVisibilities(ctx, http.MethodPost, planGUID, VisibilityType.ORGANIZATION, organizationGUIDs...)
 }
 
 // ReplaceOrganizationVisibilities replaces existing list of organizations
 func (pc *PlatformClient) ReplaceOrganizationVisibilities(ctx context.Context, planGUID string, organizationGUIDs []string) error {
+	if pc.isDryRun() {
+		pc.dryRunPlan.record(ctx, DryRunAction{
+			Operation:         DryRunOperation.REPLACE_ORGANIZATION_VISIBILITIES,
+			PlanGUID:          planGUID,
+			VisibilityType:    VisibilityType.ORGANIZATION,
+			OrganizationGUIDs: organizationGUIDs,
+		})
+		return nil
+	}
 	return pc.updateServicePlanVisibilities(ctx, http.MethodPatch, planGUID, VisibilityType.ORGANIZATION, organizationGUIDs...)
 }
 
+// DeleteOrganizationVisibilities removes the visibility of the plan in the given organization
 func (pc *PlatformClient) DeleteOrganizationVisibilities(ctx context.Context, planGUID string, organizationGUID string) error {
+	if pc.isDryRun() {
+		pc.dryRunPlan.record(ctx, DryRunAction{
+			Operation:         DryRunOperation.DELETE_ORGANIZATION_VISIBILITIES,
+			PlanGUID:          planGUID,
+			OrganizationGUIDs: []string{organizationGUID},
+		})
+		return nil
+	}
 	path := fmt.Sprintf("/v3/service_plans/%s/visibility/%s", planGUID, organizationGUID)
 
 	resp, err := pc.MakeRequest(PlatformClientRequest{
-		CTX:    ctx,
-		Method: http.MethodDelete,
-		URL:    path,
+		CTX:        ctx,
+		Method:     http.MethodDelete,
+		URL:        path,
+		Idempotent: true,
 	})
 	if err != nil {
 		return errors.Wrapf(err, "Error deleting service plan visibility.")
@@ -144,15 +240,29 @@ func filterPublicPlans(plans PlanMap) []PlanData {
 	return publicPlans
 }
 
-func getPlanGUIDs(plans PlanMap) []string {
-	guids := make([]string, 0, len(plans))
-	for guid := range plans {
-		guids = append(guids, guid)
+func filterAdminPlans(plans PlanMap) []PlanData {
+	var adminPlans []PlanData
+	for _, plan := range plans {
+		if plan.VisibilityType == VisibilityType.ADMIN {
+			adminPlans = append(adminPlans, plan)
+		}
 	}
-	return guids
+	return adminPlans
 }
 
-func (pc *PlatformClient) getPlansVisibilities(ctx context.Context, planGUIDs []string) ([]ServicePlanVisibility, error) {
+// splitPlanGUIDsByScope splits the GUIDs of the plans scoped to the space of their broker from the others
+func splitPlanGUIDsByScope(plans PlanMap) (orgScoped []string, spaceScoped []string) {
+	for guid, plan := range plans {
+		if plan.VisibilityType == VisibilityType.SPACE {
+			spaceScoped = append(spaceScoped, guid)
+		} else {
+			orgScoped = append(orgScoped, guid)
+		}
+	}
+	return orgScoped, spaceScoped
+}
+
+func (pc *PlatformClient) getPlansVisibilities(ctx context.Context, planGUIDs []string, bulk bool) ([]ServicePlanVisibility, error) {
 	var result []ServicePlanVisibility
 	// protects result
 	var mutex sync.Mutex
@@ -162,7 +272,7 @@ func (pc *PlatformClient) getPlansVisibilities(ctx context.Context, planGUIDs []
 	for _, chunk := range chunks {
 		chunk := chunk // copy for goroutine
 		err := scheduler.Schedule(func(ctx context.Context) error {
-			visibilities, err := pc.getPlansVisibilitiesByPlanIds(ctx, chunk)
+			visibilities, err := pc.getPlansVisibilitiesByPlanIds(ctx, chunk, bulk)
 			if err != nil {
 				return err
 			}
@@ -183,10 +293,24 @@ func (pc *PlatformClient) getPlansVisibilities(ctx context.Context, planGUIDs []
 	return result, nil
 }
 
-func (pc *PlatformClient) getPlansVisibilitiesByPlanIds(ctx context.Context, planGUIDs []string) ([]ServicePlanVisibility, error) {
+func (pc *PlatformClient) getPlansVisibilitiesByPlanIds(ctx context.Context, planGUIDs []string, bulk bool) ([]ServicePlanVisibility, error) {
 	logger := log.C(ctx)
 	logger.Infof("Loading visibilities for service plans with GUIDs %v from Cloud Foundry...", planGUIDs)
 
+	if bulk && atomic.LoadInt32(&pc.bulkVisibilitiesUnsupported) == 0 {
+		servicePlansVisibilities, err := pc.getPlansVisibilitiesInBulk(ctx, planGUIDs)
+		if err == nil {
+			logger.Infof("Loaded %d visibilities from Cloud Foundry", len(servicePlansVisibilities))
+			return servicePlansVisibilities, nil
+		}
+		if !isNotFoundError(err) && !isBadQueryParameterError(err) {
+			return nil, errors.Wrap(err, "Error requesting service plan visibilities")
+		}
+
+		logger.Warnf("Cloud Foundry does not support loading service plan visibilities in bulk, loading them per plan: %v", err)
+		atomic.StoreInt32(&pc.bulkVisibilitiesUnsupported, 1)
+	}
+
 	var servicePlansVisibilities []ServicePlanVisibility
 	for _, planGUID := range planGUIDs {
 		servicePlanVisibilities, err := pc.getPlanVisibilitiesByPlanId(ctx, planGUID)
@@ -201,6 +325,67 @@ func (pc *PlatformClient) getPlansVisibilitiesByPlanIds(ctx context.Context, pla
 	return servicePlansVisibilities, nil
 }
 
+// getPlansVisibilitiesInBulk loads the organization visibilities of the given plans with paginated listings.
+// Only the plans which are visible in selected organizations are looked up. The organizations in which any of them
+// is visible are listed at once and then the plans visible in each of these organizations, unless there are fewer
+// plans than organizations, in which case the organizations of each plan are requested separately.
+func (pc *PlatformClient) getPlansVisibilitiesInBulk(ctx context.Context, planGUIDs []string) ([]ServicePlanVisibility, error) {
+	pageSize := []string{strconv.Itoa(pc.settings.CF.PageSize)}
+	orgScopedPlans, err := pc.ListServicePlansByQuery(ctx, url.Values{
+		CCQueryParams.GUIDs:           []string{strings.Join(planGUIDs, ",")},
+		CCQueryParams.VisibilityTypes: []string{string(VisibilityType.ORGANIZATION)},
+		CCQueryParams.PageSize:        pageSize,
+	})
+	if err != nil || len(orgScopedPlans) == 0 {
+		return nil, err
+	}
+
+	orgScopedPlanGUIDs := make([]string, 0, len(orgScopedPlans))
+	for _, plan := range orgScopedPlans {
+		orgScopedPlanGUIDs = append(orgScopedPlanGUIDs, plan.GUID)
+	}
+	organizations, err := pc.ListOrganizationsByQuery(ctx, url.Values{
+		CCQueryParams.ServicePlanGuids: []string{strings.Join(orgScopedPlanGUIDs, ",")},
+		CCQueryParams.PageSize:         pageSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var servicePlanVisibilities []ServicePlanVisibility
+	if len(orgScopedPlanGUIDs) < len(organizations) {
+		for _, planGUID := range orgScopedPlanGUIDs {
+			visibilities, err := pc.getPlanVisibilitiesByPlanId(ctx, planGUID)
+			if err != nil {
+				return nil, err
+			}
+			servicePlanVisibilities = append(servicePlanVisibilities, visibilities...)
+		}
+		return servicePlanVisibilities, nil
+	}
+
+	for _, org := range organizations {
+		plans, err := pc.ListServicePlansByQuery(ctx, url.Values{
+			CCQueryParams.GUIDs:             []string{strings.Join(orgScopedPlanGUIDs, ",")},
+			CCQueryParams.OrganizationGuids: []string{org.GUID},
+			CCQueryParams.VisibilityTypes:   []string{string(VisibilityType.ORGANIZATION)},
+			CCQueryParams.PageSize:          pageSize,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, plan := range plans {
+			servicePlanVisibilities = append(servicePlanVisibilities, ServicePlanVisibility{
+				ServicePlanGuid:  plan.GUID,
+				OrganizationGuid: org.GUID,
+			})
+		}
+	}
+
+	return servicePlanVisibilities, nil
+}
+
 func (pc *PlatformClient) getPlanVisibilitiesByPlanId(ctx context.Context, planGUID string) ([]ServicePlanVisibility, error) {
 	var servicePlanVisibilitiesResp ServicePlanVisibilitiesResponse
 	var servicePlanVisibilities []ServicePlanVisibility
@@ -216,6 +401,15 @@ func (pc *PlatformClient) getPlanVisibilitiesByPlanId(ctx context.Context, planG
 		return nil, errors.Wrap(err, "Error requesting service plan visibilities")
 	}
 
+	if servicePlanVisibilitiesResp.Type == string(VisibilityType.SPACE) && servicePlanVisibilitiesResp.Space != nil {
+		return []ServicePlanVisibility{
+			{
+				ServicePlanGuid: planGUID,
+				SpaceGuid:       servicePlanVisibilitiesResp.Space.Guid,
+			},
+		}, nil
+	}
+
 	if servicePlanVisibilitiesResp.Type != string(VisibilityType.ORGANIZATION) {
 		return []ServicePlanVisibility{}, nil
 	}
@@ -246,7 +440,7 @@ func (pc *PlatformClient) updateServicePlanVisibilities(
 			Type:          string(visibilityType),
 			Organizations: newOrganizations(organizationGUIDs),
 		}
-	case VisibilityType.PUBLIC:
+	case VisibilityType.PUBLIC, VisibilityType.ADMIN:
 		requestBody = UpdateVisibilitiesRequest{
 			Type: string(visibilityType),
 		}
@@ -259,6 +453,8 @@ func (pc *PlatformClient) updateServicePlanVisibilities(
 		Method:      requestMethod,
 		URL:         path,
 		RequestBody: requestBody,
+		// replacing the visibilities has the same outcome no matter how many times it is done
+		Idempotent: requestMethod == http.MethodPatch,
 	})
 	if err != nil {
 		return errors.Wrapf(err, "Error updating service plan visibility.")
@@ -10,6 +10,8 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
+	"net/http"
+	"regexp"
 )
 
 var _ = Describe("Client Service Plan Visibilities", func() {
@@ -177,6 +179,213 @@ var _ = Describe("Client Service Plan Visibilities", func() {
 				}
 			})
 		})
+		Context("for a plan visible only to admins", func() {
+			It("should report it with the admin visibility type", func() {
+				broker := generatedCFBrokers[0]
+				plan := filterPlans(generatedCFPlans[generatedCFServiceOfferings[broker.GUID][0].GUID], cf.VisibilityType.ORGANIZATION)[0]
+				plan.VisibilityType = cf.VisibilityType.ADMIN
+				generatedCFVisibilities[plan.GUID] = &cf.ServicePlanVisibilitiesResponse{
+					Type: string(cf.VisibilityType.ADMIN),
+				}
+
+				platformVisibilities, err := getVisibilitiesByBrokers(ctx, []string{broker.Name})
+				Expect(err).ShouldNot(HaveOccurred())
+
+				var planVisibilities []*platform.Visibility
+				for _, visibility := range platformVisibilities {
+					if visibility.CatalogPlanID == plan.BrokerCatalog.ID {
+						planVisibilities = append(planVisibilities, visibility)
+					}
+				}
+				Expect(planVisibilities).To(ConsistOf(&platform.Visibility{
+					Public:             false,
+					CatalogPlanID:      plan.BrokerCatalog.ID,
+					PlatformBrokerName: broker.Name,
+					Labels: map[string]string{
+						cf.VisibilityTypeLabelKey: string(cf.VisibilityType.ADMIN),
+					},
+				}))
+			})
+		})
+	})
+
+	Describe("Get visibilities in bulk", func() {
+		var settings *cf.Settings
+
+		countRequests := func(path *regexp.Regexp) int {
+			count := 0
+			for _, request := range ccServer.ReceivedRequests() {
+				if path.MatchString(request.URL.RequestURI()) {
+					count++
+				}
+			}
+			return count
+		}
+		bulkPath := regexp.MustCompile(`^/v3/service_plans\?.*visibility_types=organization`)
+		organizationsPath := regexp.MustCompile(`^/v3/organizations\?`)
+		nextOrganizationsPath := regexp.MustCompile(`^/v3/organizations\?.*page=`)
+		organizationPlansPath := regexp.MustCompile(`^/v3/service_plans\?.*organization_guids=`)
+		perPlanPath := regexp.MustCompile(`^/v3/service_plans/[A-Za-z0-9_-]+/visibility$`)
+
+		assertAllVisibilitiesAreReturned := func(platformVisibilities []*platform.Visibility) {
+			for _, expectedCFVisibilities := range expectedCFVisibilities {
+				for _, expectedCFVisibility := range expectedCFVisibilities {
+					Expect(platformVisibilities).Should(ContainElement(expectedCFVisibility))
+				}
+			}
+		}
+
+		BeforeEach(func() {
+			generatedCFBrokers = generateCFBrokers(2)
+			generatedCFServiceOfferings = generateCFServiceOfferings(generatedCFBrokers, 3)
+			generatedCFPlans = generateCFPlans(generatedCFServiceOfferings, 5, 1)
+			generatedCFVisibilities, expectedCFVisibilities = generateCFVisibilities(
+				generatedCFPlans, []cf.Organization{
+					{
+						Name: org1Name,
+						Guid: org1Guid,
+					},
+					{
+						Name: org2Name,
+						Guid: org2Guid,
+					},
+				},
+				generatedCFServiceOfferings,
+				generatedCFBrokers)
+
+			ccServer = createCCServer(generatedCFBrokers, generatedCFServiceOfferings, generatedCFPlans, generatedCFVisibilities)
+			setCCPlanOrganizationsResponse(ccServer, generatedCFVisibilities)
+			ccServer.RouteToHandler(http.MethodGet, "/v3/service_plans",
+				parallelRequestsChecker(ccPlansHandler(generatedCFPlans, generatedCFVisibilities)))
+
+			settings = testhelper.CCSettings(ccServer.URL(), maxAllowedParallelRequests, JobPollTimeout)
+			settings.CF.BulkVisibilities = true
+			// smaller than the organizations of a plan so that the responses are paginated
+			settings.CF.PageSize = 1
+		})
+
+		JustBeforeEach(func() {
+			var err error
+			client, err = cf.NewClient(settings)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("loads the visibilities without requesting them per plan", func() {
+			platformVisibilities, err := getVisibilitiesByBrokers(ctx, getBrokerNames(generatedCFBrokers))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			assertAllVisibilitiesAreReturned(platformVisibilities)
+			Expect(countRequests(bulkPath)).To(BeNumerically(">", 0))
+			Expect(countRequests(nextOrganizationsPath)).To(BeNumerically(">", 0))
+			Expect(countRequests(perPlanPath)).To(Equal(0))
+		})
+
+		It("lists the organizations of a chunk of plans at once", func() {
+			_, err := getVisibilitiesByBrokers(ctx, getBrokerNames(generatedCFBrokers))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			var planGUIDs []string
+			for _, plans := range generatedCFPlans {
+				for _, plan := range plans {
+					planGUIDs = append(planGUIDs, plan.GUID)
+				}
+			}
+			chunks := (len(planGUIDs) + settings.CF.ChunkSize - 1) / settings.CF.ChunkSize
+			// the two organizations are listed on two pages
+			Expect(countRequests(organizationsPath)).To(Equal(2 * chunks))
+			Expect(countRequests(organizationPlansPath)).To(Equal(2 * chunks))
+		})
+
+		It("loads the organizations per plan when the plans are visible in more organizations", func() {
+			settings.CF.ChunkSize = 1
+
+			platformVisibilities, err := getVisibilitiesByBrokers(ctx, getBrokerNames(generatedCFBrokers))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			assertAllVisibilitiesAreReturned(platformVisibilities)
+			orgScopedPlans := 0
+			for _, plans := range generatedCFPlans {
+				orgScopedPlans += len(filterPlans(plans, cf.VisibilityType.ORGANIZATION))
+			}
+			Expect(countRequests(perPlanPath)).To(Equal(orgScopedPlans))
+			Expect(countRequests(organizationPlansPath)).To(Equal(0))
+		})
+
+		It("loads the visibilities of space-scoped plans per plan", func() {
+			broker := generatedCFBrokers[0]
+			plan := filterPlans(generatedCFPlans[generatedCFServiceOfferings[broker.GUID][0].GUID], cf.VisibilityType.ORGANIZATION)[0]
+			plan.VisibilityType = cf.VisibilityType.SPACE
+			generatedCFVisibilities[plan.GUID] = &cf.ServicePlanVisibilitiesResponse{
+				Type:  string(cf.VisibilityType.SPACE),
+				Space: &cf.Space{Guid: "space-guid"},
+			}
+
+			platformVisibilities, err := getVisibilitiesByBrokers(ctx, getBrokerNames(generatedCFBrokers))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			var planVisibilities []*platform.Visibility
+			for _, visibility := range platformVisibilities {
+				if visibility.CatalogPlanID == plan.BrokerCatalog.ID {
+					planVisibilities = append(planVisibilities, visibility)
+				}
+			}
+			Expect(planVisibilities).To(ConsistOf(&platform.Visibility{
+				Public:             true,
+				CatalogPlanID:      plan.BrokerCatalog.ID,
+				PlatformBrokerName: broker.Name,
+				Labels: map[string]string{
+					cf.SpaceLabelKey: "space-guid",
+				},
+			}))
+			Expect(countRequests(perPlanPath)).To(Equal(1))
+		})
+
+		Context("when cloud controller does not support it", func() {
+			BeforeEach(func() {
+				plansHandler := ccPlansHandler(generatedCFPlans, generatedCFVisibilities)
+				ccServer.RouteToHandler(http.MethodGet, "/v3/service_plans", func(rw http.ResponseWriter, req *http.Request) {
+					if req.URL.Query().Get(cf.CCQueryParams.VisibilityTypes) == "" {
+						plansHandler(rw, req)
+						return
+					}
+					ghttp.RespondWithJSONEncoded(http.StatusBadRequest, cf.CCErrorResponse{
+						Errors: []cf.CCError{{
+							Code:   10005,
+							Title:  "CF-BadQueryParameter",
+							Detail: "The query parameter is invalid: Unknown query parameter(s): 'visibility_types'",
+						}},
+					})(rw, req)
+				})
+			})
+
+			It("loads the visibilities per plan from then on", func() {
+				platformVisibilities, err := getVisibilitiesByBrokers(ctx, getBrokerNames(generatedCFBrokers))
+				Expect(err).ShouldNot(HaveOccurred())
+				assertAllVisibilitiesAreReturned(platformVisibilities)
+
+				bulkRequests := countRequests(bulkPath)
+				Expect(bulkRequests).To(BeNumerically(">", 0))
+				Expect(countRequests(perPlanPath)).To(BeNumerically(">", 0))
+
+				platformVisibilities, err = client.GetVisibilitiesByBrokers(ctx, getBrokerNames(generatedCFBrokers))
+				Expect(err).ShouldNot(HaveOccurred())
+				assertAllVisibilitiesAreReturned(platformVisibilities)
+				Expect(countRequests(bulkPath)).To(Equal(bulkRequests))
+			})
+		})
+
+		Context("when cloud controller fails", func() {
+			BeforeEach(func() {
+				setCCPlanOrganizationsResponse(ccServer, nil)
+			})
+
+			It("returns an error", func() {
+				_, err := getVisibilitiesByBrokers(ctx, getBrokerNames(generatedCFBrokers))
+				Expect(err).To(HaveOccurred())
+				Expect(logInterceptor.String()).To(MatchRegexp(fmt.Sprintf("Error requesting service plan visibilities.*%s", unknownError.Detail)))
+				Expect(countRequests(perPlanPath)).To(Equal(0))
+			})
+		})
 	})
 
 	Describe("Get visibilities when cloud controller is not working", func() {
@@ -0,0 +1,109 @@
+package cf
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/Peripli/service-broker-proxy-cf/cf"
+
+// TracingSettings configures the export of the traces of the proxy to an OTLP collector
+type TracingSettings struct {
+	// Enabled enables the export of traces
+	Enabled bool `mapstructure:"enabled"`
+	// Endpoint is the host and port of the OTLP HTTP collector
+	Endpoint string `mapstructure:"endpoint"`
+	// URLPath is the path of the OTLP HTTP collector receiving the traces
+	URLPath string `mapstructure:"url_path"`
+	// Insecure disables TLS for the connections to the collector
+	Insecure bool `mapstructure:"insecure"`
+	// ServiceName is the name of the service the traces are reported for
+	ServiceName string `mapstructure:"service_name"`
+	// SampleRatio is the ratio of traces started by the proxy which are sampled, between 0 and 1
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+}
+
+// DefaultTracingSettings returns the default tracing settings
+func DefaultTracingSettings() *TracingSettings {
+	return &TracingSettings{
+		Enabled:     false,
+		URLPath:     "/v1/traces",
+		ServiceName: "service-broker-proxy-cf",
+		SampleRatio: 1,
+	}
+}
+
+// Validate validates the tracing settings
+func (s *TracingSettings) Validate() error {
+	if !s.Enabled {
+		return nil
+	}
+	if len(s.Endpoint) == 0 {
+		return errors.New("tracing endpoint missing")
+	}
+	if s.SampleRatio < 0 || s.SampleRatio > 1 {
+		return errors.New("tracing sample_ratio must be between 0 and 1 inclusive")
+	}
+	return nil
+}
+
+// ConfigureTracing installs the W3C trace context propagation and, if enabled, the export of traces
+// over OTLP HTTP. The returned function flushes the pending spans and stops the export.
+func ConfigureTracing(ctx context.Context, settings *TracingSettings) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if settings == nil || !settings.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	options := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(settings.Endpoint),
+		otlptracehttp.WithURLPath(settings.URLPath),
+	}
+	if settings.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(settings.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(settings.ServiceName))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+
+	return tracerProvider.Shutdown, nil
+}
+
+// startSpan starts a span of the proxy using the globally configured tracer provider
+func startSpan(ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, options...)
+}
+
+// endSpan ends the span recording the given error, if any
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// injectTraceContext adds the trace context of the given context to the headers of an outgoing request
+func injectTraceContext(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
@@ -0,0 +1,165 @@
+package cf_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Peripli/service-broker-proxy-cf/cf"
+	"github.com/Peripli/service-broker-proxy-cf/cf/internal"
+	"github.com/gofrs/uuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var _ = Describe("Tracing", func() {
+	var (
+		client       *cf.PlatformClient
+		spanRecorder *tracetest.SpanRecorder
+	)
+
+	spansNamed := func(name string) []sdktrace.ReadOnlySpan {
+		var spans []sdktrace.ReadOnlySpan
+		for _, span := range spanRecorder.Ended() {
+			if span.Name() == name {
+				spans = append(spans, span)
+			}
+		}
+		return spans
+	}
+
+	attributeValue := func(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+		for _, attr := range span.Attributes() {
+			if attr.Key == key {
+				return attr.Value
+			}
+		}
+		return attribute.Value{}
+	}
+
+	BeforeEach(func() {
+		ctx = context.TODO()
+		spanRecorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+
+		parallelRequestsCounter = 0
+		maxAllowedParallelRequests = 3
+		ccServer = testhelper.FakeCCServer(false)
+		_, client = testhelper.CCClientWithThrottling(ccServer.URL(), maxAllowedParallelRequests, 2)
+	})
+
+	AfterEach(func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+		if ccServer != nil {
+			ccServer.Close()
+			ccServer = nil
+		}
+	})
+
+	Context("when the cache is reset", func() {
+		It("traces the requests to Cloud Controller as children and propagates the trace context", func() {
+			brokers := generateCFBrokers(1)
+			serviceOfferings := generateCFServiceOfferings(brokers, 1)
+			setCCBrokersResponse(ccServer, brokers)
+			setCCServiceOfferingsResponse(ccServer, serviceOfferings)
+			setCCPlansResponse(ccServer, generateCFPlans(serviceOfferings, 1, 1))
+
+			Expect(client.ResetCache(ctx)).To(Succeed())
+
+			resetSpans := spansNamed("ResetCache")
+			Expect(resetSpans).To(HaveLen(1))
+			traceID := resetSpans[0].SpanContext().TraceID()
+
+			requestSpans := spansNamed("CC GET /v3/service_brokers")
+			Expect(requestSpans).To(HaveLen(1))
+			Expect(requestSpans[0].Parent().SpanID()).To(Equal(resetSpans[0].SpanContext().SpanID()))
+			Expect(requestSpans[0].SpanKind()).To(Equal(trace.SpanKindClient))
+			Expect(attributeValue(requestSpans[0], "http.status_code").AsInt64()).To(Equal(int64(http.StatusOK)))
+
+			propagated := false
+			for _, request := range ccServer.ReceivedRequests() {
+				if request.URL.Path == "/v3/service_brokers" {
+					Expect(request.Header.Get("traceparent")).To(ContainSubstring(traceID.String()))
+					propagated = true
+				}
+			}
+			Expect(propagated).To(BeTrue())
+		})
+
+		It("records the error of a failed reset", func() {
+			setCCBrokersResponse(ccServer, nil)
+
+			Expect(client.ResetCache(ctx)).ToNot(Succeed())
+
+			resetSpans := spansNamed("ResetCache")
+			Expect(resetSpans).To(HaveLen(1))
+			Expect(resetSpans[0].Status().Description).ToNot(BeEmpty())
+			Expect(resetSpans[0].Events()).ToNot(BeEmpty())
+		})
+	})
+
+	Context("when a job is polled", func() {
+		It("traces every attempt", func() {
+			jobGUID, err := uuid.NewV4()
+			Expect(err).ShouldNot(HaveOccurred())
+			setCCJobResponse(ccServer, false, cf.JobState.COMPLETE)
+
+			_, jobErr := client.PollJob(ctx, fmt.Sprintf("/v3/jobs/%s", jobGUID))
+			Expect(jobErr).To(BeNil())
+
+			pollSpans := spansNamed("PollJob")
+			Expect(pollSpans).To(HaveLen(1))
+			Expect(attributeValue(pollSpans[0], "cf.job.attempt").AsInt64()).To(Equal(int64(1)))
+			Expect(attributeValue(pollSpans[0], "cf.job.state").AsString()).To(Equal(string(cf.JobState.COMPLETE)))
+			Expect(spansNamed("CC GET /v3/jobs/:guid")[0].Parent().SpanID()).To(Equal(pollSpans[0].SpanContext().SpanID()))
+		})
+	})
+
+	Describe("ConfigureTracing", func() {
+		var collector *ghttp.Server
+
+		BeforeEach(func() {
+			collector = ghttp.NewServer()
+			collector.RouteToHandler(http.MethodPost, "/v1/traces", ghttp.RespondWith(http.StatusOK, nil))
+		})
+
+		AfterEach(func() {
+			collector.Close()
+		})
+
+		It("exports the spans to the OTLP collector", func() {
+			settings := cf.DefaultTracingSettings()
+			settings.Enabled = true
+			settings.Insecure = true
+			settings.Endpoint = strings.TrimPrefix(collector.URL(), "http://")
+
+			shutdown, err := cf.ConfigureTracing(ctx, settings)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			setCCBrokersResponse(ccServer, nil)
+			Expect(client.ResetCache(ctx)).ToNot(Succeed())
+			Expect(shutdown(ctx)).To(Succeed())
+
+			Expect(collector.ReceivedRequests()).ToNot(BeEmpty())
+			Expect(collector.ReceivedRequests()[0].Header.Get("Content-Type")).To(Equal("application/x-protobuf"))
+		})
+
+		It("does not export spans when disabled", func() {
+			shutdown, err := cf.ConfigureTracing(ctx, cf.DefaultTracingSettings())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(shutdown(ctx)).To(Succeed())
+
+			Expect(collector.ReceivedRequests()).To(BeEmpty())
+		})
+	})
+})
@@ -6,6 +6,7 @@ import (
 
 	"github.com/Peripli/service-broker-proxy-cf/cf"
 	"github.com/Peripli/service-broker-proxy/pkg/sbproxy"
+	"github.com/Peripli/service-manager/pkg/log"
 )
 
 func main() {
@@ -22,15 +23,40 @@ func main() {
 		panic(fmt.Errorf("error loading config: %s", err))
 	}
 
+	shutdownTracing, err := cf.ConfigureTracing(ctx, proxySettings.Tracing)
+	if err != nil {
+		panic(fmt.Errorf("error configuring tracing: %s", err))
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.C(ctx).WithError(err).Error("error shutting down tracing")
+		}
+	}()
+
 	platformClient, err := cf.NewClient(proxySettings)
 	if err != nil {
 		panic(fmt.Errorf("error creating CF client: %s", err))
 	}
 
+	if err := platformClient.ResumeJobs(ctx); err != nil {
+		panic(fmt.Errorf("error resuming CF jobs: %s", err))
+	}
+
+	platformClient.RestoreCache(ctx)
+	cacheSnapshotsDone := platformClient.StartCacheSnapshots(ctx)
+
 	proxyBuilder, err := sbproxy.New(ctx, cancel, env, &proxySettings.Settings, platformClient)
 	if err != nil {
 		panic(fmt.Errorf("error creating sbproxy: %s", err))
 	}
 
+	proxyBuilder.RegisterControllers(cf.NewMetricsController(platformClient))
+	if proxySettings.CF.DryRun {
+		proxyBuilder.RegisterControllers(cf.NewDryRunController(platformClient))
+	}
+
 	proxyBuilder.Build().Run()
+
+	cancel()
+	<-cacheSnapshotsDone
 }